@@ -0,0 +1,194 @@
+package acl
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/utils"
+)
+
+const (
+	ALLOW string = "allow"
+	DENY  string = "deny"
+)
+
+var (
+	InvaildPolicy = errors.New("acl policy must be allow or deny")
+	InvaildRule   = errors.New("acl rule must have exactly one of cidr, country and asn")
+	CantFindRule  = errors.New("can't find acl rule")
+	RuleExists    = errors.New("acl rule already exists")
+
+	// 全局的访问控制列表，在黑名单之后检查，为 nil 时允许所有的地址
+	GlobalAccessList *AccessList
+)
+
+/**
+*	location 的访问控制列表，与全局的黑名单不同，
+*	它由有序的 allow/deny 规则和默认策略组成，可以实现白名单
+*	规则可以按照 CIDR、国家代码或者 ASN 匹配，后两者需要加载 GeoDB，
+*	没有加载数据库或者查不到地址时，这类规则不匹配任何地址
+ */
+type AccessList struct {
+	sync.RWMutex
+	policy string
+	rules  []accessRule
+}
+
+type accessRule struct {
+	config.AclRule
+	ipNet *net.IPNet
+}
+
+func validPolicy(policy string) error {
+	if policy != ALLOW && policy != DENY {
+		return InvaildPolicy
+	}
+	return nil
+}
+
+// 没有掩码的地址视为单个主机，国家代码统一为大写
+func parseRule(rule config.AclRule) (accessRule, error) {
+	if err := validPolicy(rule.Action); err != nil {
+		return accessRule{}, err
+	}
+	set := 0
+	for _, has := range []bool{rule.Cidr != "", rule.Country != "", rule.Asn != 0} {
+		if has {
+			set++
+		}
+	}
+	if set != 1 {
+		return accessRule{}, InvaildRule
+	}
+	if rule.Country != "" {
+		return accessRule{AclRule: config.AclRule{Action: rule.Action, Country: strings.ToUpper(rule.Country)}}, nil
+	}
+	if rule.Asn != 0 {
+		return accessRule{AclRule: config.AclRule{Action: rule.Action, Asn: rule.Asn}}, nil
+	}
+	ipNet, err := utils.ParseCIDR(rule.Cidr)
+	if err != nil {
+		return accessRule{}, InvaildIpAddress
+	}
+	return accessRule{
+		AclRule: config.AclRule{Action: rule.Action, Cidr: ipNet.String()},
+		ipNet:   ipNet,
+	}, nil
+}
+
+// geo 只在第一次遇到国家或者 ASN 规则时查询
+func (rule *accessRule) match(ip net.IP, geo *GeoInfo, looked *bool) bool {
+	if rule.ipNet != nil {
+		return rule.ipNet.Contains(ip)
+	}
+	if !*looked {
+		*geo, _ = GeoDB.Lookup(ip)
+		*looked = true
+	}
+	if rule.Country != "" {
+		return rule.Country == geo.Country
+	}
+	return rule.Asn == geo.Asn
+}
+
+func NewAccessList(conf config.AccessList) (*AccessList, error) {
+	list := &AccessList{
+		policy: ALLOW,
+		rules:  make([]accessRule, 0, len(conf.Rules)),
+	}
+	if conf.Default != "" {
+		if err := validPolicy(conf.Default); err != nil {
+			return nil, err
+		}
+		list.policy = conf.Default
+	}
+	for _, rule := range conf.Rules {
+		r, err := parseRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		list.rules = append(list.rules, r)
+	}
+	return list, nil
+}
+
+// ip 可以带有端口、方括号或者 zone，无法解析的地址使用默认策略
+func (list *AccessList) Allow(ip string) bool {
+	list.RLock()
+	defer list.RUnlock()
+	if parsed := utils.ParseIP(ip); parsed != nil {
+		var geo GeoInfo
+		looked := false
+		for idx := range list.rules {
+			if list.rules[idx].match(parsed, &geo, &looked) {
+				return list.rules[idx].Action == ALLOW
+			}
+		}
+	}
+	return list.policy == ALLOW
+}
+
+// index 从 1 开始，插入到第 index 条规则之前，小于 1 或者超出范围时追加到末尾
+func (list *AccessList) AddRule(rule config.AclRule, index int) error {
+	r, err := parseRule(rule)
+	if err != nil {
+		return err
+	}
+	list.Lock()
+	defer list.Unlock()
+	// 同样的规则只保留一条，先匹配的规则才会生效
+	for _, exist := range list.rules {
+		if exist.AclRule == r.AclRule {
+			return RuleExists
+		}
+	}
+	if index < 1 || index > len(list.rules) {
+		list.rules = append(list.rules, r)
+		return nil
+	}
+	list.rules = append(list.rules[:index-1], append([]accessRule{r}, list.rules[index-1:]...)...)
+	return nil
+}
+
+func (list *AccessList) DeleteRule(rule config.AclRule) error {
+	r, err := parseRule(rule)
+	if err != nil {
+		return err
+	}
+	list.Lock()
+	defer list.Unlock()
+	for idx, exist := range list.rules {
+		if exist.AclRule == r.AclRule {
+			list.rules = append(list.rules[:idx], list.rules[idx+1:]...)
+			return nil
+		}
+	}
+	return CantFindRule
+}
+
+func (list *AccessList) SetDefault(policy string) error {
+	if err := validPolicy(policy); err != nil {
+		return err
+	}
+	list.Lock()
+	defer list.Unlock()
+	list.policy = policy
+	return nil
+}
+
+// 返回当前的配置，用于记录到 location 中
+func (list *AccessList) Config() config.AccessList {
+	list.RLock()
+	defer list.RUnlock()
+	res := config.AccessList{
+		Default: list.policy,
+		Rules:   make([]config.AclRule, 0, len(list.rules)),
+	}
+	for _, rule := range list.rules {
+		res.Rules = append(res.Rules, rule.AclRule)
+	}
+	return res
+}
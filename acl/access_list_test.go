@@ -0,0 +1,55 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessList(t *testing.T) {
+	list, err := NewAccessList(config.AccessList{
+		Default: DENY,
+		Rules: []config.AclRule{
+			{Action: DENY, Cidr: "10.1.0.0/16"},
+			{Action: ALLOW, Cidr: "10.0.0.0/8"},
+			{Action: ALLOW, Cidr: "2001:db8::/32"},
+		},
+	})
+	assert.NoError(t, err)
+	// 第一条匹配的规则生效
+	assert.False(t, list.Allow("10.1.2.3:8080"))
+	assert.True(t, list.Allow("10.2.3.4:8080"))
+	assert.True(t, list.Allow("::ffff:10.2.3.4"))
+	assert.True(t, list.Allow("[2001:db8::1%eth0]:443"))
+	assert.False(t, list.Allow("192.168.1.1"))
+	assert.False(t, list.Allow("garbage"))
+
+	assert.NoError(t, list.AddRule(config.AclRule{Action: ALLOW, Cidr: "10.1.2.3"}, 1))
+	assert.True(t, list.Allow("10.1.2.3"))
+	assert.Equal(t, RuleExists, list.AddRule(config.AclRule{Action: ALLOW, Cidr: "10.1.2.3/32"}, 0))
+	assert.Equal(t, "10.1.2.3/32", list.Config().Rules[0].Cidr)
+
+	assert.NoError(t, list.DeleteRule(config.AclRule{Action: ALLOW, Cidr: "10.1.2.3"}))
+	assert.False(t, list.Allow("10.1.2.3"))
+	assert.Equal(t, CantFindRule, list.DeleteRule(config.AclRule{Action: ALLOW, Cidr: "10.1.2.3"}))
+
+	assert.NoError(t, list.SetDefault(ALLOW))
+	assert.True(t, list.Allow("192.168.1.1"))
+	assert.Equal(t, InvaildPolicy, list.SetDefault("maybe"))
+	assert.Equal(t, 3, len(list.Config().Rules))
+}
+
+func TestAccessListInvalid(t *testing.T) {
+	_, err := NewAccessList(config.AccessList{Default: "maybe"})
+	assert.Equal(t, InvaildPolicy, err)
+	_, err = NewAccessList(config.AccessList{Rules: []config.AclRule{{Action: "block", Cidr: "10.0.0.0/8"}}})
+	assert.Equal(t, InvaildPolicy, err)
+	_, err = NewAccessList(config.AccessList{Rules: []config.AclRule{{Action: ALLOW, Cidr: "10.0.0.0/40"}}})
+	assert.Equal(t, InvaildIpAddress, err)
+
+	// 没有配置时允许所有的访问
+	list, err := NewAccessList(config.AccessList{})
+	assert.NoError(t, err)
+	assert.True(t, list.Allow("10.0.0.1"))
+}
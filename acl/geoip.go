@@ -0,0 +1,187 @@
+package acl
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/qiancijun/cheryl/logger"
+)
+
+var (
+	// 检查数据库文件是否变化的间隔
+	GeoReloadInterval = 30 * time.Second
+
+	GeoDB *GeoIP
+)
+
+// 国家代码为 ISO 3166-1 的两位大写字母
+type GeoInfo struct {
+	Country string `json:"country"`
+	Asn     uint   `json:"asn"`
+}
+
+// 同时兼容 Country/City 与 ASN 数据库的字段
+type geoRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+}
+
+type geoDatabase struct {
+	path    string
+	modTime time.Time
+	reader  *maxminddb.Reader
+}
+
+/**
+*	本地的 MaxMind 格式（mmdb）数据库，通常同时加载国家与 ASN 两个数据库，
+*	查询结果合并在一起。数据库文件变化之后自动重新加载，加载失败时继续使用旧的数据库
+ */
+type GeoIP struct {
+	sync.RWMutex
+	// 转发给上游时携带客户端国家代码的请求头，为空时不添加
+	CountryHeader string
+	databases     []*geoDatabase
+	stop          chan struct{}
+}
+
+func init() {
+	GeoDB = NewGeoIP()
+}
+
+func NewGeoIP() *GeoIP {
+	return &GeoIP{}
+}
+
+// 读入内存而不是 mmap，避免文件被原地覆盖时读到不完整的数据
+func openGeoDatabase(path string) (*geoDatabase, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return &geoDatabase{path: path, modTime: info.ModTime(), reader: reader}, nil
+}
+
+// 加载数据库并且开始监视文件的变化，paths 为空时关闭 GeoIP
+func (g *GeoIP) Open(paths []string) error {
+	databases := make([]*geoDatabase, 0, len(paths))
+	for _, path := range paths {
+		db, err := openGeoDatabase(path)
+		if err != nil {
+			return err
+		}
+		databases = append(databases, db)
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.stop != nil {
+		close(g.stop)
+		g.stop = nil
+	}
+	g.databases = databases
+	if len(databases) > 0 {
+		g.stop = make(chan struct{})
+		go g.watch(g.stop)
+	}
+	return nil
+}
+
+func (g *GeoIP) Close() {
+	g.Lock()
+	defer g.Unlock()
+	if g.stop != nil {
+		close(g.stop)
+		g.stop = nil
+	}
+	g.databases = nil
+}
+
+func (g *GeoIP) watch(stop chan struct{}) {
+	ticker := time.NewTicker(GeoReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			g.Reload()
+		}
+	}
+}
+
+// 重新加载修改时间发生变化的数据库
+func (g *GeoIP) Reload() {
+	g.RLock()
+	databases := g.databases
+	g.RUnlock()
+	for idx, db := range databases {
+		info, err := os.Stat(db.path)
+		if err != nil || info.ModTime().Equal(db.modTime) {
+			continue
+		}
+		fresh, err := openGeoDatabase(db.path)
+		if err != nil {
+			logger.Warnf("{GeoIP} can't reload %s, keep the old one: %s", db.path, err.Error())
+			continue
+		}
+		// Lookup 在锁外使用旧的切片，替换时复制一份新的切片
+		g.Lock()
+		if idx < len(g.databases) && g.databases[idx] == db {
+			replaced := make([]*geoDatabase, len(g.databases))
+			copy(replaced, g.databases)
+			replaced[idx] = fresh
+			g.databases = replaced
+		}
+		g.Unlock()
+		logger.Infof("{GeoIP} reload %s", db.path)
+	}
+}
+
+func (g *GeoIP) Loaded() bool {
+	g.RLock()
+	defer g.RUnlock()
+	return len(g.databases) > 0
+}
+
+// 没有加载数据库或者所有数据库都查不到时返回 false
+func (g *GeoIP) Lookup(ip net.IP) (GeoInfo, bool) {
+	g.RLock()
+	databases := g.databases
+	g.RUnlock()
+	var info GeoInfo
+	for _, db := range databases {
+		var record geoRecord
+		// IPv4 数据库无法查询 IPv6 地址，忽略错误
+		if err := db.reader.Lookup(ip, &record); err != nil {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = record.Country.IsoCode
+			if info.Country == "" {
+				info.Country = record.RegisteredCountry.IsoCode
+			}
+		}
+		if info.Asn == 0 {
+			info.Asn = record.AutonomousSystemNumber
+		}
+	}
+	info.Country = strings.ToUpper(info.Country)
+	return info, info.Country != "" || info.Asn != 0
+}
@@ -0,0 +1,228 @@
+package acl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func mmdbString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+func mmdbUint32(v uint32) []byte {
+	res := []byte{0xC0 | 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(res[1:], v)
+	return res
+}
+
+// kv 依次为编码之后的键和值
+func mmdbMap(kv ...[]byte) []byte {
+	res := []byte{0xE0 | byte(len(kv)/2)}
+	for _, b := range kv {
+		res = append(res, b...)
+	}
+	return res
+}
+
+/**
+*	构造只包含 IPv4 网段的 mmdb 文件，记录大小为 32 位
+*	网段之间不能互相包含
+ */
+func buildMMDB(networks map[string][]byte) []byte {
+	type node struct {
+		children [2]*node
+		data     [2][]byte
+	}
+	root := &node{}
+	for cidr, data := range networks {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		ip := ipNet.IP.To4()
+		ones, _ := ipNet.Mask.Size()
+		cur := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> uint(7-i%8)) & 1
+			if i == ones-1 {
+				cur.data[bit] = data
+				break
+			}
+			if cur.children[bit] == nil {
+				cur.children[bit] = &node{}
+			}
+			cur = cur.children[bit]
+		}
+	}
+	nodes := []*node{root}
+	ids := map[*node]uint32{root: 0}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil {
+				ids[child] = uint32(len(nodes))
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	count := uint32(len(nodes))
+	var tree, data bytes.Buffer
+	for _, n := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			record := count
+			if n.children[bit] != nil {
+				record = ids[n.children[bit]]
+			} else if n.data[bit] != nil {
+				record = count + 16 + uint32(data.Len())
+				data.Write(n.data[bit])
+			}
+			binary.Write(&tree, binary.BigEndian, record)
+		}
+	}
+	tree.Write(make([]byte, 16))
+	tree.Write(data.Bytes())
+	tree.WriteString("\xAB\xCD\xEFMaxMind.com")
+	tree.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint32(count),
+		mmdbString("record_size"), mmdbUint32(32),
+		mmdbString("ip_version"), mmdbUint32(4),
+		mmdbString("database_type"), mmdbString("Cheryl-Test"),
+		mmdbString("binary_format_major_version"), mmdbUint32(2),
+	))
+	return tree.Bytes()
+}
+
+func country(field, code string) []byte {
+	return mmdbMap(mmdbString(field), mmdbMap(mmdbString("iso_code"), mmdbString(code)))
+}
+
+func writeGeoDatabases(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	countryDB := filepath.Join(dir, "country.mmdb")
+	asnDB := filepath.Join(dir, "asn.mmdb")
+	assert.NoError(t, os.WriteFile(countryDB, buildMMDB(map[string][]byte{
+		"1.2.3.0/24": country("country", "CN"),
+		"5.6.0.0/16": country("registered_country", "us"),
+	}), 0644))
+	assert.NoError(t, os.WriteFile(asnDB, buildMMDB(map[string][]byte{
+		"1.2.0.0/16": mmdbMap(mmdbString("autonomous_system_number"), mmdbUint32(4134)),
+	}), 0644))
+	return countryDB, asnDB
+}
+
+func TestGeoIP(t *testing.T) {
+	countryDB, asnDB := writeGeoDatabases(t)
+	g := NewGeoIP()
+	_, ok := g.Lookup(net.ParseIP("1.2.3.4"))
+	assert.False(t, ok)
+	assert.Error(t, g.Open([]string{filepath.Join(filepath.Dir(countryDB), "missing.mmdb")}))
+	assert.NoError(t, g.Open([]string{countryDB, asnDB}))
+	defer g.Close()
+
+	cases := map[string]GeoInfo{
+		"1.2.3.4": {Country: "CN", Asn: 4134},
+		"1.2.4.4": {Asn: 4134},
+		"5.6.7.8": {Country: "US"},
+		"9.9.9.9": {},
+		// IPv4 数据库查不到 IPv6 地址
+		"2001:db8::1": {},
+	}
+	for ip, expected := range cases {
+		info, ok := g.Lookup(net.ParseIP(ip))
+		assert.Equal(t, expected, info, ip)
+		assert.Equal(t, expected != GeoInfo{}, ok, ip)
+	}
+
+	// 文件变化之后重新加载
+	assert.NoError(t, os.WriteFile(countryDB, buildMMDB(map[string][]byte{
+		"1.2.3.0/24": country("country", "JP"),
+	}), 0644))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(countryDB, later, later))
+	g.Reload()
+	info, _ := g.Lookup(net.ParseIP("1.2.3.4"))
+	assert.Equal(t, GeoInfo{Country: "JP", Asn: 4134}, info)
+
+	// 损坏的文件不会替换正在使用的数据库
+	assert.NoError(t, os.WriteFile(countryDB, []byte("broken"), 0644))
+	later = later.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(countryDB, later, later))
+	g.Reload()
+	info, _ = g.Lookup(net.ParseIP("1.2.3.4"))
+	assert.Equal(t, "JP", info.Country)
+}
+
+func TestGeoIPReloadWhileLookup(t *testing.T) {
+	countryDB, asnDB := writeGeoDatabases(t)
+	g := NewGeoIP()
+	assert.NoError(t, g.Open([]string{countryDB, asnDB}))
+	defer g.Close()
+
+	// 重新加载时正在进行的查询继续使用旧的数据库
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				g.Lookup(net.ParseIP("1.2.3.4"))
+			}
+		}
+	}()
+	later := time.Now()
+	for i := 0; i < 10; i++ {
+		later = later.Add(time.Minute)
+		assert.NoError(t, os.Chtimes(countryDB, later, later))
+		g.Reload()
+	}
+	close(stop)
+	<-done
+	info, _ := g.Lookup(net.ParseIP("1.2.3.4"))
+	assert.Equal(t, GeoInfo{Country: "CN", Asn: 4134}, info)
+}
+
+func TestGeoAccessList(t *testing.T) {
+	countryDB, asnDB := writeGeoDatabases(t)
+	old := GeoDB
+	GeoDB = NewGeoIP()
+	defer func() { GeoDB = old }()
+
+	_, err := NewAccessList(config.AccessList{Rules: []config.AclRule{{Action: ALLOW, Cidr: "1.2.3.0/24", Country: "CN"}}})
+	assert.Equal(t, InvaildRule, err)
+	_, err = NewAccessList(config.AccessList{Rules: []config.AclRule{{Action: ALLOW}}})
+	assert.Equal(t, InvaildRule, err)
+
+	list, err := NewAccessList(config.AccessList{
+		Default: DENY,
+		Rules: []config.AclRule{
+			{Action: DENY, Asn: 4134},
+			{Action: ALLOW, Country: "us"},
+			{Action: ALLOW, Cidr: "9.9.9.0/24"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "US", list.Config().Rules[1].Country)
+
+	// 没有加载数据库时国家与 ASN 规则不匹配
+	assert.False(t, list.Allow("5.6.7.8"))
+	assert.True(t, list.Allow("9.9.9.9"))
+
+	assert.NoError(t, GeoDB.Open([]string{countryDB, asnDB}))
+	defer GeoDB.Close()
+	assert.False(t, list.Allow("1.2.3.4"))
+	assert.True(t, list.Allow("5.6.7.8:443"))
+	assert.True(t, list.Allow("9.9.9.9"))
+	assert.False(t, list.Allow("8.8.8.8"))
+
+	assert.NoError(t, list.DeleteRule(config.AclRule{Action: DENY, Asn: 4134}))
+	assert.NoError(t, list.AddRule(config.AclRule{Action: ALLOW, Country: "cn"}, 1))
+	assert.Equal(t, RuleExists, list.AddRule(config.AclRule{Action: ALLOW, Country: "CN"}, 0))
+	assert.True(t, list.Allow("1.2.3.4"))
+}
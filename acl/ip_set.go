@@ -0,0 +1,134 @@
+package acl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 没有指定集合时规则所属的集合
+const DEFAULT_SET string = "blacklist"
+
+var InvaildSetName = errors.New("ip set name can't be empty")
+
+/**
+*	使用 cidrs 替换整个集合，cidrs 为空时删除集合
+*	所有的 CIDR 都能解析时才会修改，属于其他集合的 CIDR 会被移动到这个集合中
+ */
+func (tree *RadixTree) ReplaceSet(set string, cidrs []string) error {
+	if set == NO_VALUE {
+		return InvaildSetName
+	}
+	type entry struct {
+		key       ipKey
+		bits      int
+		canonical string
+	}
+	entries := make([]entry, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		key, bits, canonical, err := parseIPNet(cidr)
+		if err != nil {
+			return fmt.Errorf("%s: %s", cidr, err.Error())
+		}
+		entries = append(entries, entry{key, bits, canonical})
+	}
+	tree.Lock()
+	defer tree.Unlock()
+	for canonical, name := range tree.Sets {
+		if name != set {
+			continue
+		}
+		if key, bits, _, err := parseIPNet(canonical); err == nil {
+			tree.remove(key, bits, canonical)
+		}
+	}
+	for _, e := range entries {
+		tree.add(e.key, e.bits, e.canonical, set, time.Time{})
+	}
+	return nil
+}
+
+// 规范化之后去重并排序的 CIDR，与导出的格式一致，导入之后再导出的结果不变
+func CanonicalCidrs(cidrs []string) ([]string, error) {
+	seen := make(map[string]bool, len(cidrs))
+	res := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, _, canonical, err := parseIPNet(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", cidr, err.Error())
+		}
+		if !seen[canonical] {
+			seen[canonical] = true
+			res = append(res, canonical)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// 集合中的 CIDR，不包括已经过期的规则
+func (tree *RadixTree) GetSet(set string) []string {
+	return tree.GetSets()[set]
+}
+
+// 所有的集合以及集合中排好序的 CIDR
+func (tree *RadixTree) GetSets() map[string][]string {
+	tree.RLock()
+	defer tree.RUnlock()
+	now := time.Now()
+	res := make(map[string][]string)
+	for canonical := range tree.Record {
+		if expire, has := tree.Expires[canonical]; has && !now.Before(expire) {
+			continue
+		}
+		set := tree.Sets[canonical]
+		if set == NO_VALUE {
+			set = DEFAULT_SET
+		}
+		res[set] = append(res[set], canonical)
+	}
+	for _, cidrs := range res {
+		sort.Strings(cidrs)
+	}
+	return res
+}
+
+// 纯文本格式：每行一个 CIDR，忽略空行以及 # 开头的注释
+func ParseIpList(r io.Reader) ([]string, error) {
+	res := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line != "" {
+			res = append(res, line)
+		}
+	}
+	return res, scanner.Err()
+}
+
+// 每个集合以 "# 集合名称" 开头，可以按照集合拆分之后重新导入
+func WriteIpSets(w io.Writer, sets map[string][]string) error {
+	names := make([]string, 0, len(sets))
+	for name := range sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "# %s\n", name); err != nil {
+			return err
+		}
+		for _, cidr := range sets[name] {
+			if _, err := fmt.Fprintln(w, cidr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package acl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIpSet(t *testing.T) {
+	tr := NewRadixTree()
+	assert.NoError(t, tr.Add("192.168.0.0/16", DEFAULT_SET))
+	assert.NoError(t, tr.AddWithExpire("10.0.0.1/32", "scanner", time.Now().Add(time.Hour)))
+	assert.Equal(t, InvaildSetName, tr.Add("10.0.0.2/32", ""))
+	assert.Equal(t, InvaildSetName, tr.ReplaceSet("", nil))
+
+	assert.NoError(t, tr.ReplaceSet("tor-exits", []string{"1.2.3.4/32", "5.6.0.0/16", "2001:db8::/32"}))
+	set, deny := tr.AccessControl("5.6.7.8")
+	assert.True(t, deny)
+	assert.Equal(t, "tor-exits", set)
+	set, _ = tr.AccessControl("192.168.1.1")
+	assert.Equal(t, DEFAULT_SET, set)
+
+	// 任意一个 CIDR 无法解析时不做任何修改
+	assert.Error(t, tr.ReplaceSet("tor-exits", []string{"1.2.3.5/32", "bad"}))
+	assert.Equal(t, []string{"1.2.3.4/32", "2001:db8::/32", "5.6.0.0/16"}, tr.GetSet("tor-exits"))
+
+	// 替换整个集合，属于其他集合的 CIDR 移动到这个集合
+	assert.NoError(t, tr.ReplaceSet("tor-exits", []string{"1.2.3.5/32", "10.0.0.1/32"}))
+	_, deny = tr.AccessControl("5.6.7.8")
+	assert.False(t, deny)
+	set, _ = tr.AccessControl("10.0.0.1")
+	assert.Equal(t, "tor-exits", set)
+	assert.Len(t, tr.GetRemaining(), 0)
+	assert.Equal(t, map[string][]string{
+		DEFAULT_SET: {"192.168.0.0/16"},
+		"tor-exits": {"1.2.3.5/32", "10.0.0.1/32"},
+	}, tr.GetSets())
+
+	// 删除集合
+	assert.NoError(t, tr.ReplaceSet("tor-exits", nil))
+	assert.Equal(t, []string{"192.168.0.0/16"}, tr.GetBlackList())
+	assert.Len(t, tr.Sets, 1)
+}
+
+func TestIpList(t *testing.T) {
+	cidrs, err := ParseIpList(strings.NewReader("# office\n10.0.0.0/8\n\n  192.168.1.1/32  # vpn\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1/32"}, cidrs)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteIpSets(&buf, map[string][]string{
+		"tor-exits": {"1.2.3.4/32"},
+		"office":    {"10.0.0.0/8", "192.168.1.1/32"},
+	}))
+	assert.Equal(t, "# office\n10.0.0.0/8\n192.168.1.1/32\n# tor-exits\n1.2.3.4/32\n", buf.String())
+	cidrs, err = ParseIpList(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, cidrs, 3)
+}
+
+func TestIpSetRoundTrip(t *testing.T) {
+	tr := NewRadixTree()
+	cidrs, err := CanonicalCidrs([]string{"10.0.0.5/8", "10.0.0.0/8", "2001:db8::1/32", "192.168.1.1/32"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1/32", "2001:db8::/32"}, cidrs)
+	_, err = CanonicalCidrs([]string{"bad"})
+	assert.Error(t, err)
+
+	// 导出之后重新导入，集合的内容不变
+	assert.NoError(t, tr.ReplaceSet("office", []string{"10.0.0.5/8", "2001:db8::1/32", "192.168.1.1/32"}))
+	exported := tr.GetSets()
+	assert.Equal(t, map[string][]string{"office": cidrs}, exported)
+	var buf bytes.Buffer
+	assert.NoError(t, WriteIpSets(&buf, exported))
+	imported, err := ParseIpList(&buf)
+	assert.NoError(t, err)
+	imported, err = CanonicalCidrs(imported)
+	assert.NoError(t, err)
+	assert.Equal(t, cidrs, imported)
+	assert.NoError(t, tr.ReplaceSet("office", imported))
+	assert.Equal(t, exported, tr.GetSets())
+}
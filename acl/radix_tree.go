@@ -3,9 +3,11 @@ package acl
 import (
 	"errors"
 	"io"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/qiancijun/cheryl/logger"
 	"github.com/qiancijun/cheryl/utils"
@@ -13,22 +15,33 @@ import (
 )
 
 const (
-	MAX_IPV4_BIT uint32 = 0x80000000
-	NO_VALUE     string = ""
+	MAX_IP_BIT int    = 128
+	NO_VALUE   string = ""
+	// IPv4 地址以 IPv4-mapped IPv6 地址（::ffff:a.b.c.d）的形式保存
+	IPV4_OFFSET int = 96
 )
 
 var (
-	InvaildIpAddress = errors.New("invaild ip address, maybe with out mask")
-	InvaildNetMask   = errors.New("invaild net mask, must in [0, 32]")
-	CantFindIpNet    = errors.New("can't find ip")
+	InvaildIpAddress  = errors.New("invaild ip address, maybe with out mask")
+	InvaildNetMask    = errors.New("invaild net mask, must in [0, 32] for ipv4 or [0, 128] for ipv6")
+	CantFindIpNet     = errors.New("can't find ip")
 	AccessControlList *RadixTree
 )
 
+/**
+*	以 128 位的 IPv6 地址作为键的前缀树，IPv4 地址转换为 IPv4-mapped IPv6 地址，
+*	因此 IPv4 的规则同样可以匹配 ::ffff:a.b.c.d 形式的客户端地址
+*	Expires: 有时限的规则过期的绝对时间，由写入 raft 日志的请求决定，
+*	所有节点在同一时刻认为规则失效，过期的规则由 Purge 清理
+*	Sets: 规则所属的地址集合，节点中保存的值就是集合的名称，每条规则只属于一个集合
+ */
 type RadixTree struct {
 	sync.RWMutex
-	root   *radixNode
-	free   *radixNode
-	Record map[string]bool `json:"record"`
+	root    *radixNode
+	free    *radixNode
+	Record  map[string]bool      `json:"record"`
+	Expires map[string]time.Time `json:"expires"`
+	Sets    map[string]string    `json:"sets"`
 }
 
 type radixNode struct {
@@ -36,6 +49,17 @@ type radixNode struct {
 	left   *radixNode
 	parent *radixNode
 	value  string
+	expire time.Time
+}
+
+func (node *radixNode) expired(now time.Time) bool {
+	return !node.expire.IsZero() && !now.Before(node.expire)
+}
+
+type ipKey [16]byte
+
+func (key ipKey) bit(i int) bool {
+	return key[i/8]&(0x80>>uint(i%8)) != 0
 }
 
 func init() {
@@ -45,124 +69,178 @@ func init() {
 func NewRadixTree() *RadixTree {
 	logger.Debug("init RadixTree success")
 	return &RadixTree{
-		root:   &radixNode{nil, nil, nil, NO_VALUE},
-		free:   nil,
-		Record: make(map[string]bool),
+		root:    &radixNode{},
+		free:    nil,
+		Record:  make(map[string]bool),
+		Expires: make(map[string]time.Time),
+		Sets:    make(map[string]string),
 	}
 }
 
 func (tree *RadixTree) newNode() *radixNode {
-	var node *radixNode
 	if tree.free != nil {
-		node = tree.free
+		node := tree.free
 		tree.free = tree.free.right
+		*node = radixNode{}
 		return node
 	}
-	return &radixNode{nil, nil, nil, NO_VALUE}
+	return &radixNode{}
 }
 
-func (tree *RadixTree) insert(key uint32, mask uint32, value string) {
-	var node, next *radixNode
-	node, next = tree.root, tree.root
-	bit := MAX_IPV4_BIT
-	for (bit & mask) != 0 {
-		if (key & bit) != 0 {
-			next = node.right
-		} else {
-			next = node.left
-		}
-
-		if next == nil {
-			break
+/**
+*	解析 CIDR，返回键、前缀长度以及规范化之后的 CIDR，主机位会被清除
+*	IPv4 的掩码范围是 [0, 32]，IPv6（包括 IPv4-mapped IPv6）的掩码范围是 [0, 128]
+ */
+func parseIPNet(ipNet string) (ipKey, int, string, error) {
+	var key ipKey
+	strs := strings.Split(ipNet, "/")
+	if len(strs) != 2 {
+		return key, 0, "", InvaildIpAddress
+	}
+	ip := utils.ParseIP(strs[0])
+	if ip == nil {
+		return key, 0, "", InvaildIpAddress
+	}
+	cidr, err := strconv.Atoi(strs[1])
+	if err != nil {
+		return key, 0, "", InvaildNetMask
+	}
+	// 清除主机位，10.0.0.5/8 与 10.0.0.0/8 使用同一个键和同一条记录
+	// 以 IPv6 形式书写的地址按照 128 位计算掩码
+	if ip.To4() != nil && !strings.Contains(strs[0], ":") {
+		if cidr < 0 || cidr > 32 {
+			return key, 0, "", InvaildNetMask
 		}
-		bit >>= 1
-		node = next
+		ip = ip.To4().Mask(net.CIDRMask(cidr, 32))
+		copy(key[:], ip.To16())
+		return key, cidr + IPV4_OFFSET, ip.String() + "/" + strconv.Itoa(cidr), nil
 	}
+	if cidr < 0 || cidr > MAX_IP_BIT {
+		return key, 0, "", InvaildNetMask
+	}
+	ip = ip.To16().Mask(net.CIDRMask(cidr, MAX_IP_BIT))
+	copy(key[:], ip)
+	canonical := ip.String()
+	if ip.To4() != nil {
+		canonical = "::ffff:" + canonical
+	}
+	return key, cidr, canonical + "/" + strconv.Itoa(cidr), nil
+}
 
-	if next != nil {
-		node.value = value
-		return
+func parseIP(ip string) (ipKey, bool) {
+	var key ipKey
+	parsed := utils.ParseIP(ip)
+	if parsed == nil {
+		return key, false
 	}
+	copy(key[:], parsed.To16())
+	return key, true
+}
 
-	for (bit & mask) != 0 {
-		next = tree.newNode()
-		if next == nil {
-			logger.Error("can't create radixTree Node, this is a bug")
+func (tree *RadixTree) insert(key ipKey, bits int, value string, expire time.Time) {
+	node := tree.root
+	for i := 0; i < bits; i++ {
+		next := node.left
+		if key.bit(i) {
+			next = node.right
 		}
-		next.parent = node
-		next.value = NO_VALUE
-		if (key & bit) != 0 {
-			node.right = next
-		} else {
-			node.left = next
+		if next == nil {
+			next = tree.newNode()
+			next.parent = node
+			if key.bit(i) {
+				node.right = next
+			} else {
+				node.left = next
+			}
 		}
-		bit >>= 1
 		node = next
 	}
 	node.value = value
+	node.expire = expire
 }
 
+// value 为规则所属的集合
 func (tree *RadixTree) Add(ipNet string, value string) error {
-	strs := strings.Split(ipNet, "/")
-	ipStr := strs[0]
-	ip, err := utils.InetToi(ipStr)
-	if err != nil {
-		return InvaildIpAddress
-	}
-	if len(strs) < 2 {
-		return InvaildIpAddress
+	return tree.AddWithExpire(ipNet, value, time.Time{})
+}
+
+// expire 为零值时规则永久有效，重复添加时以最后一次的集合和过期时间为准
+func (tree *RadixTree) AddWithExpire(ipNet string, value string, expire time.Time) error {
+	if value == NO_VALUE {
+		return InvaildSetName
 	}
-	mask := strs[1]
-	cidr, err := strconv.Atoi(mask)
+	key, bits, canonical, err := parseIPNet(ipNet)
 	if err != nil {
 		return err
 	}
-	var netMask uint32 = ((1 << (32 - cidr)) - 1) ^ 0xffffffff
-	tree.insert(ip, netMask, value)
-	tree.Record[ipNet] = true
+	tree.Lock()
+	defer tree.Unlock()
+	tree.add(key, bits, canonical, value, expire)
 	return nil
 }
 
-func (tree *RadixTree) search(key uint32) string {
-	bit := MAX_IPV4_BIT
+// 调用者需要持有锁
+func (tree *RadixTree) add(key ipKey, bits int, canonical string, value string, expire time.Time) {
+	tree.insert(key, bits, value, expire)
+	tree.Record[canonical] = true
+	tree.Sets[canonical] = value
+	if expire.IsZero() {
+		delete(tree.Expires, canonical)
+	} else {
+		tree.Expires[canonical] = expire
+	}
+}
+
+// 调用者需要持有锁
+func (tree *RadixTree) remove(key ipKey, bits int, canonical string) bool {
+	ret := tree.delete(key, bits)
+	delete(tree.Record, canonical)
+	delete(tree.Expires, canonical)
+	delete(tree.Sets, canonical)
+	return ret
+}
+
+// 返回匹配的最长前缀对应的值，过期的规则不参与匹配
+func (tree *RadixTree) search(key ipKey) string {
 	node := tree.root
 	value := NO_VALUE
-	for node != nil {
-		if node.value != NO_VALUE {
+	now := time.Now()
+	for i := 0; node != nil; i++ {
+		if node.value != NO_VALUE && !node.expired(now) {
 			value = node.value
 		}
-
-		if (key & bit) != 0 {
+		if i == MAX_IP_BIT {
+			break
+		}
+		if key.bit(i) {
 			node = node.right
 		} else {
 			node = node.left
 		}
-		bit >>= 1
 	}
 	return value
 }
 
+// ip 可以带有端口、方括号或者 zone，无法解析的地址不匹配任何规则
 func (tree *RadixTree) Search(ip string) string {
-	i, _ := utils.InetToi(ip)
-	return tree.search(i)
+	key, ok := parseIP(ip)
+	if !ok {
+		logger.Debugf("{ACL} can't parse ip address %s", ip)
+		return NO_VALUE
+	}
+	tree.RLock()
+	defer tree.RUnlock()
+	return tree.search(key)
 }
 
 func (tree *RadixTree) Delete(ipNet string) error {
-	strs := strings.Split(ipNet, "/")
-	ipStr := strs[0]
-	ip, err := utils.InetToi(ipStr)
-	if err != nil || len(strs) < 2 {
-		return InvaildIpAddress
-	}
-	mask := strs[1]
-	cidr, err := strconv.Atoi(mask)
-	if err != nil || cidr < 0 || cidr > 32 {
-		return InvaildNetMask
-	}
-	var netMask uint32 = ((1 << (32 - cidr)) - 1) ^ 0xffffffff
-	ret := tree.delete(ip, netMask)
-	if ret {
-		delete(tree.Record, ipNet)
+	key, bits, canonical, err := parseIPNet(ipNet)
+	if err != nil {
+		return err
+	}
+	tree.Lock()
+	defer tree.Unlock()
+	if tree.remove(key, bits, canonical) {
 		logger.Debugf("{ACL} delete ip address %s success", ipNet)
 		return nil
 	}
@@ -170,26 +248,21 @@ func (tree *RadixTree) Delete(ipNet string) error {
 	return CantFindIpNet
 }
 
-func (tree *RadixTree) delete(key uint32, mask uint32) bool {
-	bit := MAX_IPV4_BIT
+func (tree *RadixTree) delete(key ipKey, bits int) bool {
 	node := tree.root
-	for node != nil && (bit&mask) != 0 {
-		if (key & bit) != 0 {
+	for i := 0; node != nil && i < bits; i++ {
+		if key.bit(i) {
 			node = node.right
 		} else {
 			node = node.left
 		}
-		bit >>= 1
 	}
-	if node == nil {
+	if node == nil || node.value == NO_VALUE {
 		return false
 	}
-	if node.right != nil || node.left != nil {
-		if node.value != NO_VALUE {
-			node.value = NO_VALUE
-			return true
-		}
-		return false
+	if node.right != nil || node.left != nil || node.parent == nil {
+		node.value, node.expire = NO_VALUE, time.Time{}
+		return true
 	}
 	for {
 		if node.parent.right == node {
@@ -197,9 +270,10 @@ func (tree *RadixTree) delete(key uint32, mask uint32) bool {
 		} else {
 			node.parent.left = nil
 		}
-		node.right = tree.free
+		parent := node.parent
+		node.right, node.left, node.parent = tree.free, nil, nil
 		tree.free = node
-		node = node.parent
+		node = parent
 
 		if node.right != nil || node.left != nil {
 			break
@@ -214,23 +288,62 @@ func (tree *RadixTree) delete(key uint32, mask uint32) bool {
 	return true
 }
 
+// 不包括已经过期但是还没有被清理的规则
 func (tree *RadixTree) GetBlackList() []string {
+	tree.RLock()
+	defer tree.RUnlock()
+	now := time.Now()
 	res := make([]string, 0)
 	for k := range tree.Record {
+		if expire, has := tree.Expires[k]; has && !now.Before(expire) {
+			continue
+		}
 		res = append(res, k)
 	}
 	return res
 }
 
-func (tree *RadixTree) AccessControl(ipAddress string) bool {
-	ipWithPort := strings.Split(ipAddress, ":")
-	ip := ipWithPort[0]
-	logger.Debugf("%s will access the system", ip)
-	ret := tree.Search(ip) != ""
-	if ret {
-		logger.Debugf("%s is forbidden to access system", ip)
+// 有时限的规则剩余的时间
+func (tree *RadixTree) GetRemaining() map[string]time.Duration {
+	tree.RLock()
+	defer tree.RUnlock()
+	now := time.Now()
+	res := make(map[string]time.Duration)
+	for k, expire := range tree.Expires {
+		if remaining := expire.Sub(now); remaining > 0 {
+			res[k] = remaining
+		}
 	}
-	return ret
+	return res
+}
+
+// 删除已经过期的规则，只释放内存，不影响匹配的结果，因此各个节点可以独立执行
+func (tree *RadixTree) Purge() int {
+	tree.Lock()
+	defer tree.Unlock()
+	now := time.Now()
+	purged := 0
+	for k, expire := range tree.Expires {
+		if now.Before(expire) {
+			continue
+		}
+		key, bits, _, err := parseIPNet(k)
+		if err == nil {
+			tree.remove(key, bits, k)
+		}
+		purged++
+	}
+	return purged
+}
+
+// 返回地址是否被禁止访问以及匹配的集合
+func (tree *RadixTree) AccessControl(ipAddress string) (string, bool) {
+	logger.Debugf("%s will access the system", ipAddress)
+	set := tree.Search(ipAddress)
+	if set != NO_VALUE {
+		logger.Infof("%s is forbidden to access system by ip set %s", ipAddress, set)
+	}
+	return set, set != NO_VALUE
 }
 
 
@@ -2,6 +2,7 @@ package acl
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,4 +26,140 @@ func TestRadixTree(t *testing.T) {
 	assert.Equal(t, ip3, ans)
 	ans = tr.Search("192.168.3.4")
 	assert.Equal(t, ip4, ans)
-}
\ No newline at end of file
+}
+func TestRadixTreeIPv6(t *testing.T) {
+	tr := NewRadixTree()
+	assert.NoError(t, tr.Add("2001:db8::/32", "2001:db8::/32"))
+	assert.NoError(t, tr.Add("2001:db8:1::/48", "2001:db8:1::/48"))
+	assert.NoError(t, tr.Add("fe80::1/128", "fe80::1/128"))
+	assert.NoError(t, tr.Add("10.0.0.0/8", "10.0.0.0/8"))
+	assert.NoError(t, tr.Add("::ffff:192.168.0.0/112", "::ffff:192.168.0.0/112"))
+
+	cases := map[string]string{
+		// 最长前缀匹配
+		"2001:db8::1":      "2001:db8::/32",
+		"2001:db8:1::1":    "2001:db8:1::/48",
+		"2001:db8:ffff::1": "2001:db8::/32",
+		"2001:db9::1":      "",
+		"fe80::1":          "fe80::1/128",
+		"fe80::2":          "",
+		// 带有端口、方括号和 zone 的地址
+		"[2001:db8:1::1]:8080": "2001:db8:1::/48",
+		"fe80::1%eth0":         "fe80::1/128",
+		"[fe80::1%eth0]:443":   "fe80::1/128",
+		// IPv4 与 IPv4-mapped IPv6
+		"10.1.2.3":             "10.0.0.0/8",
+		"10.1.2.3:8080":        "10.0.0.0/8",
+		"::ffff:10.1.2.3":      "10.0.0.0/8",
+		"[::ffff:10.1.2.3]:80": "10.0.0.0/8",
+		"192.168.3.4":          "::ffff:192.168.0.0/112",
+		"11.0.0.1":             "",
+		// 无法解析的地址
+		"not an ip": "",
+		"":          "",
+	}
+	for ip, expected := range cases {
+		assert.Equal(t, expected, tr.Search(ip), ip)
+	}
+
+	set, deny := tr.AccessControl("[2001:db8::1]:1234")
+	assert.True(t, deny)
+	assert.Equal(t, "2001:db8::/32", set)
+	_, deny = tr.AccessControl("[2001:db9::1]:1234")
+	assert.False(t, deny)
+	_, deny = tr.AccessControl("10.0.0.1:1234")
+	assert.True(t, deny)
+
+	assert.NoError(t, tr.Delete("2001:db8:1::/48"))
+	assert.Equal(t, "2001:db8::/32", tr.Search("2001:db8:1::1"))
+	// 非规范的写法删除同一个网段
+	assert.NoError(t, tr.Delete("2001:0db8:0000::/32"))
+	assert.Equal(t, "", tr.Search("2001:db8::1"))
+	assert.Equal(t, CantFindIpNet, tr.Delete("2001:db8::/32"))
+	assert.ElementsMatch(t, []string{"fe80::1/128", "10.0.0.0/8", "::ffff:192.168.0.0/112"}, tr.GetBlackList())
+}
+
+func TestRadixTreeInvalid(t *testing.T) {
+	tr := NewRadixTree()
+	assert.Equal(t, InvaildIpAddress, tr.Add("10.0.0.1", "x"))
+	assert.Equal(t, InvaildIpAddress, tr.Add("10.0.0/8", "x"))
+	assert.Equal(t, InvaildNetMask, tr.Add("10.0.0.0/33", "x"))
+	assert.Equal(t, InvaildNetMask, tr.Add("10.0.0.0/-1", "x"))
+	assert.Equal(t, InvaildNetMask, tr.Add("2001:db8::/129", "x"))
+	assert.Equal(t, InvaildNetMask, tr.Add("2001:db8::/abc", "x"))
+	assert.NoError(t, tr.Add("::ffff:10.0.0.0/104", "x"))
+	assert.Equal(t, 1, len(tr.GetBlackList()))
+}
+
+func TestRadixTreeDefaultRoute(t *testing.T) {
+	tr := NewRadixTree()
+	// 0.0.0.0/0 只匹配 IPv4 地址，::/0 匹配所有地址
+	assert.NoError(t, tr.Add("0.0.0.0/0", "v4"))
+	assert.Equal(t, "v4", tr.Search("1.2.3.4"))
+	assert.Equal(t, "", tr.Search("2001:db8::1"))
+	assert.NoError(t, tr.Add("::/0", "all"))
+	assert.Equal(t, "v4", tr.Search("1.2.3.4"))
+	assert.Equal(t, "all", tr.Search("2001:db8::1"))
+
+	assert.NoError(t, tr.Delete("::/0"))
+	assert.Equal(t, "", tr.Search("2001:db8::1"))
+	assert.NoError(t, tr.Delete("0.0.0.0/0"))
+	assert.Equal(t, "", tr.Search("1.2.3.4"))
+	assert.Equal(t, CantFindIpNet, tr.Delete("::/0"))
+
+	// 删除之后回收的节点可以重新使用
+	assert.NoError(t, tr.Add("2001:db8::/64", "a"))
+	assert.NoError(t, tr.Delete("2001:db8::/64"))
+	assert.NoError(t, tr.Add("2001:db8::/64", "b"))
+	assert.NoError(t, tr.Add("2001:db8:0:0:1::/80", "c"))
+	assert.Equal(t, "b", tr.Search("2001:db8::1"))
+	assert.Equal(t, "c", tr.Search("2001:db8::1:0:0:1"))
+}
+
+func TestRadixTreeExpire(t *testing.T) {
+	tr := NewRadixTree()
+	assert.NoError(t, tr.Add("10.0.0.0/8", "10.0.0.0/8"))
+	assert.NoError(t, tr.AddWithExpire("10.1.0.0/16", "10.1.0.0/16", time.Now().Add(time.Hour)))
+	assert.NoError(t, tr.AddWithExpire("10.1.2.0/24", "10.1.2.0/24", time.Now().Add(-time.Second)))
+	assert.NoError(t, tr.AddWithExpire("192.168.0.1/32", "192.168.0.1/32", time.Now().Add(-time.Second)))
+
+	// 过期的规则不参与匹配，退回到更短的前缀
+	assert.Equal(t, "10.1.0.0/16", tr.Search("10.1.2.3"))
+	assert.Equal(t, "", tr.Search("192.168.0.1"))
+	assert.ElementsMatch(t, []string{"10.0.0.0/8", "10.1.0.0/16"}, tr.GetBlackList())
+	remaining := tr.GetRemaining()
+	assert.Len(t, remaining, 1)
+	assert.True(t, remaining["10.1.0.0/16"] > 59*time.Minute)
+
+	assert.Equal(t, 2, tr.Purge())
+	assert.Len(t, tr.Record, 2)
+	assert.Len(t, tr.Expires, 1)
+	assert.Equal(t, "10.1.0.0/16", tr.Search("10.1.2.3"))
+
+	// 重新添加时没有过期时间的规则变为永久有效
+	assert.NoError(t, tr.Add("10.1.0.0/16", "10.1.0.0/16"))
+	assert.Len(t, tr.GetRemaining(), 0)
+	assert.NoError(t, tr.Delete("10.1.0.0/16"))
+	assert.Equal(t, "10.0.0.0/8", tr.Search("10.1.2.3"))
+}
+
+func TestRadixTreeHostBits(t *testing.T) {
+	tr := NewRadixTree()
+	// 带有主机位的 CIDR 与网络地址是同一条规则
+	assert.NoError(t, tr.AddWithExpire("10.0.0.5/8", "a", time.Now().Add(-time.Second)))
+	assert.NoError(t, tr.Add("10.0.0.0/8", "b"))
+	assert.NoError(t, tr.Add("2001:db8::1/32", "c"))
+	assert.NoError(t, tr.Add("::ffff:192.168.1.1/120", "d"))
+	assert.ElementsMatch(t, []string{"10.0.0.0/8", "2001:db8::/32", "::ffff:192.168.1.0/120"}, tr.GetBlackList())
+	assert.Equal(t, "b", tr.Search("10.9.9.9"))
+	assert.Equal(t, "c", tr.Search("2001:db8:ffff::1"))
+	assert.Equal(t, "d", tr.Search("192.168.1.200"))
+	// 重新添加时清除了之前的过期时间，清理过期规则不会删除它
+	assert.Equal(t, 0, tr.Purge())
+	assert.Equal(t, "b", tr.Search("10.9.9.9"))
+
+	assert.NoError(t, tr.Delete("10.1.2.3/8"))
+	assert.Equal(t, "", tr.Search("10.9.9.9"))
+	assert.Empty(t, tr.Sets["10.0.0.0/8"])
+	assert.Equal(t, CantFindIpNet, tr.Delete("10.0.0.0/8"))
+}
@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// 缓存通过校验的 basic 认证，避免每个请求都计算 bcrypt
+	VerifiedCacheSize = 1024
+)
+
+var (
+	InvalidConsumerError    = errors.New("consumer name can't be empty")
+	InvalidKeyError         = errors.New("api key digest must be a hex encoded sha256")
+	InvalidPasswordError    = errors.New("password must be a bcrypt hash")
+	CredentialConflictError = errors.New("credential is used by another consumer")
+	ConsumerNotExistsError  = errors.New("consumer not exists")
+
+	Consumers *Registry
+)
+
+type consumerKey struct{}
+
+/**
+*	消费者以及它的凭证，通过 raft 同步
+*	Keys: API Key 的 sha256 摘要，Password: basic 认证密码的 bcrypt 哈希
+ */
+type Consumer struct {
+	Name     string   `json:"name"`
+	Groups   []string `json:"groups"`
+	Keys     []string `json:"keys"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+}
+
+// 用于展示的消费者信息，不包含凭证
+type ConsumerInfo struct {
+	Name     string   `json:"name"`
+	Groups   []string `json:"groups"`
+	Keys     int      `json:"keys"`
+	Username string   `json:"username"`
+}
+
+type Registry struct {
+	sync.RWMutex
+	consumers map[string]*Consumer
+	keys      map[string]string
+	users     map[string]string
+	verified  *lru.Cache
+}
+
+func init() {
+	Consumers = NewRegistry()
+}
+
+func NewRegistry() *Registry {
+	verified, _ := lru.New(VerifiedCacheSize)
+	return &Registry{
+		consumers: make(map[string]*Consumer),
+		keys:      make(map[string]string),
+		users:     make(map[string]string),
+		verified:  verified,
+	}
+}
+
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// API Key 在写入 raft 日志之前转换为摘要，明文不会离开接收请求的节点
+func HashKey(key string) string {
+	return digest(key)
+}
+
+// 已经是 bcrypt 哈希的密码保持不变，便于导入其他系统中的凭证
+func HashPassword(password string) (string, error) {
+	if _, err := bcrypt.Cost([]byte(password)); err == nil {
+		return password, nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (c *Consumer) InGroup(groups ...string) bool {
+	for _, group := range groups {
+		for _, g := range c.Groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Consumer) Info() ConsumerInfo {
+	groups := c.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	return ConsumerInfo{Name: c.Name, Groups: groups, Keys: len(c.Keys), Username: c.Username}
+}
+
+func (c Consumer) copy() *Consumer {
+	c.Groups = append([]string{}, c.Groups...)
+	c.Keys = append([]string{}, c.Keys...)
+	return &c
+}
+
+func (c *Consumer) valid() error {
+	if c.Name == "" {
+		return InvalidConsumerError
+	}
+	for _, key := range c.Keys {
+		if b, err := hex.DecodeString(key); err != nil || len(b) != sha256.Size {
+			return InvalidKeyError
+		}
+	}
+	if c.Username != "" || c.Password != "" {
+		if c.Username == "" {
+			return errors.New("username can't be empty")
+		}
+		if _, err := bcrypt.Cost([]byte(c.Password)); err != nil {
+			return InvalidPasswordError
+		}
+	}
+	return nil
+}
+
+// 调用者需要持有锁
+func (r *Registry) remove(name string) {
+	old, has := r.consumers[name]
+	if !has {
+		return
+	}
+	for _, key := range old.Keys {
+		delete(r.keys, key)
+	}
+	if old.Username != "" {
+		delete(r.users, old.Username)
+	}
+	delete(r.consumers, name)
+}
+
+// 添加或者替换消费者，API Key 与用户名不能与其他消费者重复
+func (r *Registry) Set(c Consumer) error {
+	if err := c.valid(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, key := range c.Keys {
+		if owner, has := r.keys[key]; has && owner != c.Name {
+			return fmt.Errorf("api key: %w", CredentialConflictError)
+		}
+	}
+	if owner, has := r.users[c.Username]; c.Username != "" && has && owner != c.Name {
+		return fmt.Errorf("username %s: %w", c.Username, CredentialConflictError)
+	}
+	r.remove(c.Name)
+	consumer := c.copy()
+	r.consumers[c.Name] = consumer
+	for _, key := range consumer.Keys {
+		r.keys[key] = c.Name
+	}
+	if consumer.Username != "" {
+		r.users[consumer.Username] = c.Name
+	}
+	r.verified.Purge()
+	return nil
+}
+
+func (r *Registry) Remove(name string) {
+	r.Lock()
+	defer r.Unlock()
+	r.remove(name)
+	r.verified.Purge()
+}
+
+func (r *Registry) Get(name string) (Consumer, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	c, has := r.consumers[name]
+	if !has {
+		return Consumer{}, false
+	}
+	return *c.copy(), true
+}
+
+func (r *Registry) Infos() []ConsumerInfo {
+	r.RLock()
+	defer r.RUnlock()
+	res := make([]ConsumerInfo, 0, len(r.consumers))
+	for _, c := range r.consumers {
+		res = append(res, c.Info())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// 返回所有消费者的副本，用于生成快照
+func (r *Registry) List() []Consumer {
+	r.RLock()
+	defer r.RUnlock()
+	res := make([]Consumer, 0, len(r.consumers))
+	for _, c := range r.consumers {
+		res = append(res, *c.copy())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// 使用快照中的消费者替换当前所有的消费者
+func (r *Registry) Restore(consumers []Consumer) error {
+	restored := NewRegistry()
+	for _, c := range consumers {
+		if err := restored.Set(c); err != nil {
+			return err
+		}
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.consumers, r.keys, r.users = restored.consumers, restored.keys, restored.users
+	r.verified.Purge()
+	return nil
+}
+
+func (r *Registry) AuthenticateKey(key string) (*Consumer, bool) {
+	if key == "" {
+		return nil, false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	name, has := r.keys[HashKey(key)]
+	if !has {
+		return nil, false
+	}
+	return r.consumers[name], true
+}
+
+func (r *Registry) AuthenticateBasic(username, password string) (*Consumer, bool) {
+	cacheKey := digest(username + ":" + password)
+	r.RLock()
+	name, has := r.users[username]
+	c := r.consumers[name]
+	r.RUnlock()
+	if !has {
+		return nil, false
+	}
+	if cached, ok := r.verified.Get(cacheKey); ok && cached.(*Consumer) == c {
+		return c, true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(c.Password), []byte(password)) != nil {
+		return nil, false
+	}
+	r.verified.Add(cacheKey, c)
+	return c, true
+}
+
+// 在请求中记录通过认证的消费者，之后的限流与配额可以按照消费者识别客户端
+func WithConsumer(r *http.Request, name string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), consumerKey{}, name))
+}
+
+func ConsumerOf(r *http.Request) string {
+	name, _ := r.Context().Value(consumerKey{}).(string)
+	return name
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NoError(t, err)
+	return string(hash)
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	assert.Equal(t, InvalidConsumerError, r.Set(Consumer{}))
+	assert.Equal(t, InvalidKeyError, r.Set(Consumer{Name: "a", Keys: []string{"plain"}}))
+	assert.Equal(t, InvalidPasswordError, r.Set(Consumer{Name: "a", Username: "a", Password: "plain"}))
+
+	assert.NoError(t, r.Set(Consumer{
+		Name:     "alice",
+		Groups:   []string{"admin"},
+		Keys:     []string{HashKey("key-1"), HashKey("key-2")},
+		Username: "alice",
+		Password: hashPassword(t, "secret"),
+	}))
+	c, ok := r.AuthenticateKey("key-2")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", c.Name)
+	assert.True(t, c.InGroup("dev", "admin"))
+	_, ok = r.AuthenticateKey("key-3")
+	assert.False(t, ok)
+	_, ok = r.AuthenticateBasic("alice", "secret")
+	assert.True(t, ok)
+	// 第二次命中缓存
+	_, ok = r.AuthenticateBasic("alice", "secret")
+	assert.True(t, ok)
+	_, ok = r.AuthenticateBasic("alice", "wrong")
+	assert.False(t, ok)
+
+	// 凭证不能属于两个消费者
+	assert.ErrorIs(t, r.Set(Consumer{Name: "bob", Keys: []string{HashKey("key-1")}}), CredentialConflictError)
+	assert.ErrorIs(t, r.Set(Consumer{Name: "bob", Username: "alice", Password: hashPassword(t, "x")}), CredentialConflictError)
+
+	// 替换消费者之后旧的凭证失效，缓存也随之失效
+	assert.NoError(t, r.Set(Consumer{Name: "alice", Keys: []string{HashKey("key-3")}}))
+	_, ok = r.AuthenticateKey("key-1")
+	assert.False(t, ok)
+	_, ok = r.AuthenticateBasic("alice", "secret")
+	assert.False(t, ok)
+	assert.NoError(t, r.Set(Consumer{Name: "bob", Keys: []string{HashKey("key-1")}}))
+
+	restored := NewRegistry()
+	assert.NoError(t, restored.Restore(r.List()))
+	assert.Equal(t, []ConsumerInfo{
+		{Name: "alice", Groups: []string{}, Keys: 1},
+		{Name: "bob", Groups: []string{}, Keys: 1},
+	}, restored.Infos())
+	c, ok = restored.AuthenticateKey("key-1")
+	assert.True(t, ok)
+	assert.Equal(t, "bob", c.Name)
+
+	r.Remove("bob")
+	_, ok = r.AuthenticateKey("key-1")
+	assert.False(t, ok)
+	_, ok = r.Get("bob")
+	assert.False(t, ok)
+}
+
+func TestHashPassword(t *testing.T) {
+	hash := hashPassword(t, "secret")
+	same, err := HashPassword(hash)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, same)
+	assert.Equal(t, "", ConsumerOf(httptest.NewRequest("GET", "/", nil)))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req = WithConsumer(req, "alice")
+	assert.Equal(t, "alice", ConsumerOf(req))
+}
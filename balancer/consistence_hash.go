@@ -78,6 +78,10 @@ func (c *ConsistenceHash) Inc(_ string) {}
 // Done .
 func (c *ConsistenceHash) Done(_ string) {}
 
-func (c *ConsistenceHash) Len() int { return len(c.hosts) }
+func (c *ConsistenceHash) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.hosts)
+}
 
 func (c *ConsistenceHash) Mode() string { return "consistence-hash" }
\ No newline at end of file
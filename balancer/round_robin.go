@@ -43,8 +43,8 @@ func (r *RoundRobin) Remove(host string) {
 }
 
 func (r *RoundRobin) Balance(_ string) (string, error) {
-	r.RLock()
-	defer r.RUnlock()
+	r.Lock()
+	defer r.Unlock()
 	if len(r.hosts) == 0 {
 		return "", NoHostError
 	}
@@ -59,6 +59,10 @@ func (r *RoundRobin) Inc(_ string) {}
 // Done .
 func (r *RoundRobin) Done(_ string) {}
 
-func (r *RoundRobin) Len() int { return len(r.hosts) }
+func (r *RoundRobin) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.hosts)
+}
 
 func (r *RoundRobin) Mode() string { return "round-robin" }
\ No newline at end of file
@@ -0,0 +1,192 @@
+package ban
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/logger"
+	"github.com/qiancijun/cheryl/utils"
+)
+
+const (
+	// 上游返回 401 或者 403
+	UNAUTHORIZED string = "unauthorized"
+	// 被限流器拒绝
+	RATE_LIMITED string = "rate_limited"
+	// 路由或者上游返回 404，通常是扫描路径
+	NOT_FOUND string = "not_found"
+)
+
+var (
+	// 最多跟踪的客户端数量，超过之后淘汰最久没有事件的客户端
+	MaxTrackedClients = 10000
+
+	InvalidEventError = errors.New("event must be unauthorized, rate_limited or not_found")
+	InvalidRuleError  = errors.New("threshold, window and ban_time must be positive")
+
+	AutoBan *Detector
+)
+
+// 封禁客户端的方法，cidr 为单个地址的 CIDR
+type BanHandler func(cidr string, ttl time.Duration) error
+
+type rule struct {
+	threshold int
+	window    time.Duration
+	banTime   time.Duration
+}
+
+/**
+*	按照客户端地址统计异常行为，某一类事件在窗口内的次数达到阈值时封禁该客户端
+*	封禁通过 Handler 写入 raft 日志，所有节点都会拒绝该客户端。
+*	事件只在本节点统计，不在节点之间同步
+ */
+type Detector struct {
+	sync.Mutex
+	Handler BanHandler
+	rules   map[string]rule
+	// 客户端地址 + 事件 -> 窗口内事件发生的时间
+	events *lru.Cache
+	// 已经封禁的客户端以及封禁结束的时间，避免重复封禁。
+	// 同样按照 LRU 淘汰，轮换地址的客户端不会让它无限增长，被淘汰的客户端最多再被封禁一次
+	banned *lru.Cache
+	now    func() time.Time
+}
+
+func init() {
+	AutoBan = NewDetector()
+}
+
+func NewDetector() *Detector {
+	events, _ := lru.New(MaxTrackedClients)
+	banned, _ := lru.New(MaxTrackedClients)
+	return &Detector{
+		rules:  make(map[string]rule),
+		events: events,
+		banned: banned,
+		now:    time.Now,
+	}
+}
+
+func validEvent(event string) error {
+	if event != UNAUTHORIZED && event != RATE_LIMITED && event != NOT_FOUND {
+		return InvalidEventError
+	}
+	return nil
+}
+
+// 替换所有的规则，每类事件只能有一条规则
+func (d *Detector) SetRules(rules []config.BanRule) error {
+	res := make(map[string]rule, len(rules))
+	for _, r := range rules {
+		if err := validEvent(r.Event); err != nil {
+			return err
+		}
+		if r.Threshold <= 0 || r.Window <= 0 || r.BanTime <= 0 {
+			return InvalidRuleError
+		}
+		if _, has := res[r.Event]; has {
+			return fmt.Errorf("duplicate rule for event %s", r.Event)
+		}
+		res[r.Event] = rule{
+			threshold: r.Threshold,
+			window:    time.Duration(r.Window) * time.Second,
+			banTime:   time.Duration(r.BanTime) * time.Second,
+		}
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.rules = res
+	d.events.Purge()
+	return nil
+}
+
+// 根据上游的响应状态码记录事件
+func (d *Detector) RecordStatus(ip string, status int) {
+	switch status {
+	case 401, 403:
+		d.Record(ip, UNAUTHORIZED)
+	case 404:
+		d.Record(ip, NOT_FOUND)
+	}
+}
+
+/**
+*	记录一次事件，达到阈值时返回 true 并且调用 Handler 封禁客户端
+*	可信代理不会被封禁，否则会误伤代理后面所有的客户端。
+*	Handler 执行期间不会重复封禁，执行失败时撤销封禁的记录，之后的事件会再次触发封禁
+ */
+func (d *Detector) Record(ip string, event string) bool {
+	addr := utils.ParseIP(ip)
+	if addr == nil || utils.IsTrustedProxy(addr) {
+		return false
+	}
+	ip = addr.String()
+	d.Lock()
+	r, has := d.rules[event]
+	if !has {
+		d.Unlock()
+		return false
+	}
+	now := d.now()
+	if until, has := d.banned.Get(ip); has {
+		if now.Before(until.(time.Time)) {
+			d.Unlock()
+			return false
+		}
+		d.banned.Remove(ip)
+	}
+	key := ip + "|" + event
+	var times []time.Time
+	if v, has := d.events.Get(key); has {
+		times = v.([]time.Time)
+	}
+	// 丢弃窗口之外的事件
+	start := 0
+	for start < len(times) && now.Sub(times[start]) >= r.window {
+		start++
+	}
+	times = append(times[start:], now)
+	if len(times) < r.threshold {
+		d.events.Add(key, times)
+		d.Unlock()
+		return false
+	}
+	d.events.Remove(key)
+	until := now.Add(r.banTime)
+	d.banned.Add(ip, until)
+	handler := d.Handler
+	d.Unlock()
+
+	logger.Infof("{AutoBan} %s triggered %d %s events in %s, ban for %s", ip, len(times), event, r.window, r.banTime)
+	if handler != nil {
+		go func() {
+			if err := handler(cidr(addr), r.banTime); err != nil {
+				logger.Warnf("{AutoBan} can't ban %s: %s", ip, err.Error())
+				d.unban(ip, until)
+			}
+		}()
+	}
+	return true
+}
+
+// 封禁失败时撤销记录，期间已经被重新封禁时保留新的记录
+func (d *Detector) unban(ip string, until time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if v, has := d.banned.Peek(ip); has && v.(time.Time).Equal(until) {
+		d.banned.Remove(ip)
+	}
+}
+
+func cidr(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
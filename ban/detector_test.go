@@ -0,0 +1,101 @@
+package ban
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetector(t *testing.T) {
+	d := NewDetector()
+	now := time.Unix(1700000000, 0)
+	d.now = func() time.Time { return now }
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	bans := make(map[string]time.Duration)
+	d.Handler = func(cidr string, ttl time.Duration) error {
+		defer wg.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		bans[cidr] = ttl
+		return nil
+	}
+	assert.False(t, d.Record("1.2.3.4", NOT_FOUND))
+
+	assert.Equal(t, InvalidEventError, d.SetRules([]config.BanRule{{Event: "teapot", Threshold: 1, Window: 1, BanTime: 1}}))
+	assert.Equal(t, InvalidRuleError, d.SetRules([]config.BanRule{{Event: NOT_FOUND, Threshold: 0, Window: 1, BanTime: 1}}))
+	assert.NoError(t, d.SetRules([]config.BanRule{
+		{Event: NOT_FOUND, Threshold: 3, Window: 10, BanTime: 600},
+		{Event: UNAUTHORIZED, Threshold: 2, Window: 60, BanTime: 60},
+	}))
+
+	// 窗口之外的事件不计数
+	d.Record("1.2.3.4:5678", NOT_FOUND)
+	now = now.Add(11 * time.Second)
+	assert.False(t, d.Record("1.2.3.4", NOT_FOUND))
+	assert.False(t, d.Record("1.2.3.4", NOT_FOUND))
+	wg.Add(1)
+	assert.True(t, d.Record("1.2.3.4", NOT_FOUND))
+	// 封禁期间不会重复封禁
+	assert.False(t, d.Record("1.2.3.4", NOT_FOUND))
+
+	// 没有规则的事件不计数，状态码映射为事件
+	assert.False(t, d.Record("2001:db8::1", RATE_LIMITED))
+	d.RecordStatus("[2001:db8::1]:443", 200)
+	d.RecordStatus("[2001:db8::1]:443", 401)
+	wg.Add(1)
+	d.RecordStatus("2001:db8::1", 403)
+	wg.Wait()
+	assert.Equal(t, map[string]time.Duration{
+		"1.2.3.4/32":      600 * time.Second,
+		"2001:db8::1/128": 60 * time.Second,
+	}, bans)
+
+	// 可信代理不会被封禁
+	assert.NoError(t, utils.SetTrustedProxies([]string{"10.0.0.0/8"}))
+	defer utils.SetTrustedProxies(nil)
+	for i := 0; i < 5; i++ {
+		assert.False(t, d.Record("10.0.0.1", NOT_FOUND))
+	}
+}
+
+func TestDetectorBanFailed(t *testing.T) {
+	d := NewDetector()
+	assert.NoError(t, d.SetRules([]config.BanRule{{Event: NOT_FOUND, Threshold: 1, Window: 10, BanTime: 600}}))
+	failed := make(chan struct{})
+	d.Handler = func(cidr string, ttl time.Duration) error {
+		defer close(failed)
+		return errors.New("leader unknown")
+	}
+	assert.True(t, d.Record("1.2.3.4", NOT_FOUND))
+	<-failed
+
+	// 封禁失败之后再次触发封禁
+	banned := make(chan string, 1)
+	d.Handler = func(cidr string, ttl time.Duration) error {
+		banned <- cidr
+		return nil
+	}
+	assert.Eventually(t, func() bool { return d.Record("1.2.3.4", NOT_FOUND) }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "1.2.3.4/32", <-banned)
+	assert.False(t, d.Record("1.2.3.4", NOT_FOUND))
+}
+
+func TestDetectorBannedBounded(t *testing.T) {
+	max := MaxTrackedClients
+	MaxTrackedClients = 10
+	defer func() { MaxTrackedClients = max }()
+	d := NewDetector()
+	assert.NoError(t, d.SetRules([]config.BanRule{{Event: NOT_FOUND, Threshold: 1, Window: 10, BanTime: 600}}))
+	// 轮换地址的客户端不会让封禁记录无限增长
+	for i := 0; i < 100; i++ {
+		assert.True(t, d.Record(fmt.Sprintf("2001:db8::%x", i), NOT_FOUND))
+	}
+	assert.Equal(t, 10, d.banned.Len())
+}
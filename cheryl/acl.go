@@ -0,0 +1,59 @@
+package cheryl
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/qiancijun/cheryl/acl"
+	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/logger"
+	reverseproxy "github.com/qiancijun/cheryl/reverse_proxy"
+)
+
+// 清理全局黑名单中过期规则的间隔
+var AclPurgeInterval = time.Minute
+
+var AclTtlScopeError = errors.New("ttl is only supported by the global blacklist")
+
+// 根据 scope 修改全局黑名单或者 location 的访问控制列表，http 接口与 FSM 共用
+func applyAcl(proxyMap *reverseproxy.ProxyMap, aclLog AclLog) error {
+	ipNet := aclLog.IpAddress
+	if aclLog.Scope == "" {
+		switch aclLog.Pattern {
+		case 0:
+			return acl.AccessControlList.Delete(ipNet)
+		case 1:
+			set := aclLog.Set
+			if set == "" {
+				set = acl.DEFAULT_SET
+			}
+			return acl.AccessControlList.AddWithExpire(ipNet, set, aclLog.Expire)
+		}
+		return fmt.Errorf("unknown acl operation: %d", aclLog.Pattern)
+	}
+	if !aclLog.Expire.IsZero() {
+		return AclTtlScopeError
+	}
+	rule := config.AclRule{Action: aclLog.Action, Cidr: ipNet, Country: aclLog.Country, Asn: aclLog.Asn}
+	switch aclLog.Pattern {
+	case 0:
+		return proxyMap.DeleteAccessRule(aclLog.Scope, rule)
+	case 1:
+		return proxyMap.AddAccessRule(aclLog.Scope, rule, aclLog.Index)
+	case 2:
+		return proxyMap.SetAccessDefault(aclLog.Scope, aclLog.Action)
+	}
+	return fmt.Errorf("unknown acl operation: %d", aclLog.Pattern)
+}
+
+// 过期的规则已经不参与匹配，这里只是回收内存，每个节点各自执行
+func purgeAcl() {
+	ticker := time.NewTicker(AclPurgeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if purged := acl.AccessControlList.Purge(); purged > 0 {
+			logger.Debugf("{purgeAcl} purged %d expired acl entries", purged)
+		}
+	}
+}
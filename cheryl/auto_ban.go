@@ -0,0 +1,83 @@
+package cheryl
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/qiancijun/cheryl/logger"
+)
+
+var (
+	// 从节点向 leader 提交封禁请求的超时时间
+	AutoBanTimeout = 5 * time.Second
+	// 自动封禁的地址所属的集合
+	AutoBanSet = "auto-ban"
+)
+
+/**
+*	自动封禁的客户端写入全局黑名单，leader 直接写入 raft 日志，
+*	从节点将请求转发给 leader 的 /acl 接口，由 leader 计算过期时间
+ */
+type autoBanner struct {
+	ctx    *StateContext
+	client *http.Client
+}
+
+func newAutoBanner(ctx *StateContext) *autoBanner {
+	return &autoBanner{
+		ctx:    ctx,
+		client: &http.Client{Timeout: AutoBanTimeout},
+	}
+}
+
+func (b *autoBanner) Ban(cidr string, ttl time.Duration) error {
+	aclLog := AclLog{
+		Pattern:   1,
+		IpAddress: cidr,
+		Ttl:       int64(ttl / time.Second),
+		Set:       AutoBanSet,
+	}
+	if hs := b.ctx.State.Hs; hs != nil && hs.checkWritePermission() {
+		aclLog.Expire = time.Now().Add(ttl)
+		if err := applyAcl(b.ctx.State.ProxyMap, aclLog); err != nil {
+			return err
+		}
+		data, err := jsoniter.Marshal(aclLog)
+		if err != nil {
+			return err
+		}
+		return b.ctx.writeLogEntry(3, data)
+	}
+	return b.forward(aclLog)
+}
+
+func (b *autoBanner) forward(aclLog AclLog) error {
+	address, has := b.ctx.leaderHttpAddress()
+	if !has {
+		return fmt.Errorf("leader unknown")
+	}
+	data, err := jsoniter.Marshal(aclLog)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Post(fmt.Sprintf("http://%s/acl", address), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if err := jsoniter.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if res.Code != 200 {
+		return fmt.Errorf("%s", res.Msg)
+	}
+	logger.Debugf("{autoBan} leader %s banned %s", address, aclLog.IpAddress)
+	return nil
+}
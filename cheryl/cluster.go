@@ -107,7 +107,7 @@ func createRaftNode(conf *config.CherylConfig, ctx *StateContext) (*raftNodeInfo
 }
 
 func joinRaftCluster(conf *config.CherylConfig) error {
-	url := fmt.Sprintf("http://%s/join?peerAddress=%s&name=%s", conf.Raft.LeaderAddress, conf.Raft.RaftTCPAddress, conf.Name)
+	url := fmt.Sprintf("http://%s/join?peerAddress=%s&name=%s&httpAddress=%s", conf.Raft.LeaderAddress, conf.Raft.RaftTCPAddress, conf.Name, advertiseHttpAddress(conf))
 	response, err := http.Get(url)
 	if err != nil {
 		return err
@@ -0,0 +1,69 @@
+package cheryl
+
+import (
+	"errors"
+
+	"github.com/qiancijun/cheryl/auth"
+)
+
+var PasswordRequiredError = errors.New("password is required for a new username")
+
+/**
+*	/consumer 接口的请求，省略的字段保持不变
+*	Keys: API Key 的明文，Password: 明文或者 bcrypt 哈希，Username 为空字符串时删除 basic 认证凭证
+*	Remove: 为 true 时删除消费者
+ */
+type consumerRequest struct {
+	Name     string    `json:"name"`
+	Groups   *[]string `json:"groups"`
+	Keys     *[]string `json:"keys"`
+	Username *string   `json:"username"`
+	Password *string   `json:"password"`
+	Remove   bool      `json:"remove"`
+}
+
+// 与当前的消费者合并，并且在写入 raft 日志之前把凭证转换为摘要和哈希
+func (req consumerRequest) toLog() (ConsumerLog, error) {
+	if req.Name == "" {
+		return ConsumerLog{}, auth.InvalidConsumerError
+	}
+	if req.Remove {
+		return ConsumerLog{Name: req.Name}, nil
+	}
+	c, _ := auth.Consumers.Get(req.Name)
+	c.Name = req.Name
+	if req.Groups != nil {
+		c.Groups = *req.Groups
+	}
+	if req.Keys != nil {
+		c.Keys = make([]string, 0, len(*req.Keys))
+		for _, key := range *req.Keys {
+			c.Keys = append(c.Keys, auth.HashKey(key))
+		}
+	}
+	if req.Username != nil {
+		if *req.Username != "" && *req.Username != c.Username && req.Password == nil {
+			return ConsumerLog{}, PasswordRequiredError
+		}
+		c.Username = *req.Username
+	}
+	if c.Username == "" {
+		c.Password = ""
+	} else if req.Password != nil {
+		hash, err := auth.HashPassword(*req.Password)
+		if err != nil {
+			return ConsumerLog{}, err
+		}
+		c.Password = hash
+	}
+	return ConsumerLog{Name: req.Name, Consumer: &c}, nil
+}
+
+// http 接口与 FSM 共用
+func applyConsumer(consumerLog ConsumerLog) error {
+	if consumerLog.Consumer == nil {
+		auth.Consumers.Remove(consumerLog.Name)
+		return nil
+	}
+	return auth.Consumers.Set(*consumerLog.Consumer)
+}
@@ -0,0 +1,47 @@
+package cheryl
+
+import (
+	"testing"
+
+	"github.com/qiancijun/cheryl/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerRequest(t *testing.T) {
+	auth.Consumers = auth.NewRegistry()
+	defer func() { auth.Consumers = auth.NewRegistry() }()
+	strs := func(s ...string) *[]string { return &s }
+	str := func(s string) *string { return &s }
+
+	_, err := consumerRequest{}.toLog()
+	assert.Equal(t, auth.InvalidConsumerError, err)
+	_, err = consumerRequest{Name: "alice", Username: str("alice")}.toLog()
+	assert.Equal(t, PasswordRequiredError, err)
+
+	consumerLog, err := consumerRequest{Name: "alice", Keys: strs("key-1"), Username: str("alice"), Password: str("secret")}.toLog()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{auth.HashKey("key-1")}, consumerLog.Consumer.Keys)
+	assert.NotEqual(t, "secret", consumerLog.Consumer.Password)
+	assert.NoError(t, applyConsumer(consumerLog))
+
+	// 省略的字段保持不变
+	consumerLog, err = consumerRequest{Name: "alice", Groups: strs("admin")}.toLog()
+	assert.NoError(t, err)
+	assert.NoError(t, applyConsumer(consumerLog))
+	c, _ := auth.Consumers.Get("alice")
+	assert.Equal(t, []string{"admin"}, c.Groups)
+	assert.Len(t, c.Keys, 1)
+	_, ok := auth.Consumers.AuthenticateBasic("alice", "secret")
+	assert.True(t, ok)
+
+	// 删除 basic 认证凭证，然后删除消费者
+	consumerLog, err = consumerRequest{Name: "alice", Username: str("")}.toLog()
+	assert.NoError(t, err)
+	assert.NoError(t, applyConsumer(consumerLog))
+	_, ok = auth.Consumers.AuthenticateBasic("alice", "secret")
+	assert.False(t, ok)
+	consumerLog, err = consumerRequest{Name: "alice", Remove: true}.toLog()
+	assert.NoError(t, err)
+	assert.NoError(t, applyConsumer(consumerLog))
+	assert.Empty(t, auth.Consumers.Infos())
+}
@@ -9,8 +9,11 @@ import (
 	"github.com/hashicorp/raft"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/qiancijun/cheryl/acl"
+	"github.com/qiancijun/cheryl/auth"
 	"github.com/qiancijun/cheryl/config"
 	"github.com/qiancijun/cheryl/logger"
+	"github.com/qiancijun/cheryl/quota"
+	ratelimit "github.com/qiancijun/cheryl/rate_limit"
 	reverseproxy "github.com/qiancijun/cheryl/reverse_proxy"
 )
 
@@ -44,6 +47,22 @@ func (f *FSM) Apply(logEntry *raft.Log) interface{} {
 		ret = f.doRemoveHost(data)
 	case uint16(6):
 		ret = f.doAddHost(data)
+	case uint16(7):
+		ret = f.doHealthVerdict(data)
+	case uint16(8):
+		ret = f.doSetHostState(data)
+	case uint16(9):
+		ret = f.doRegisterNode(data)
+	case uint16(10):
+		ret = f.doSetQuota(data)
+	case uint16(11):
+		ret = f.doResetQuota(data)
+	case uint16(12):
+		ret = f.doReplaceIpSet(data)
+	case uint16(13):
+		ret = f.doSetFilters(data)
+	case uint16(14):
+		ret = f.doSetConsumer(data)
 	default:
 		logger.Warnf("Unknown log entry type: %d", optType)
 	}
@@ -54,6 +73,9 @@ func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
 	return &snapshot{
 		ProxyMap:  f.ctx.State.ProxyMap,
 		RadixTree: acl.AccessControlList,
+		Nodes:     f.ctx.State.Nodes.Copy(),
+		Quotas:    quota.Quotas.Allowances(),
+		Consumers: auth.Consumers.List(),
 	}, nil
 }
 
@@ -66,6 +88,8 @@ func (f *FSM) Restore(serialized io.ReadCloser) error {
 		logger.Errorf("can't restore State: %s", err.Error())
 		return err
 	}
+	// 关闭旧的反向代理，停止健康检查
+	f.ctx.State.ProxyMap.Close()
 	// 重新创建映射关系
 	f.ctx.State.ProxyMap = s.ProxyMap
 	f.ctx.State.ProxyMap.Relations = make(map[string]*reverseproxy.HTTPProxy)
@@ -73,7 +97,7 @@ func (f *FSM) Restore(serialized io.ReadCloser) error {
 	routerType := f.ctx.State.ProxyMap.Infos.RouterType
 	reverseproxy.GetRouterInstance(routerType)
 	// f.ctx.State.ProxyMap.Router = router
-	logger.Debugf("{Restore} locations: %s", f.ctx.State.ProxyMap.Locations)
+	logger.Debugf("{Restore} locations: %v", f.ctx.State.ProxyMap.Locations)
 	for _, l := range f.ctx.State.ProxyMap.Locations {
 		logger.Debugf("{Restore} found location: pattern: %s proxypass: %s balanceMode: %s", l.Pattern, l.ProxyPass, l.BalanceMode)
 		err := f.ctx.State.ProxyMap.AddProxyWithLocation(l)
@@ -82,40 +106,78 @@ func (f *FSM) Restore(serialized io.ReadCloser) error {
 		}
 	}
 
-	for key, limiters := range f.ctx.State.ProxyMap.Limiters {
-		httpProxy, has := f.ctx.State.ProxyMap.Relations[key]
+	// SetRateLimiter 会重新记录限流规则
+	infos := f.ctx.State.ProxyMap.Limiters
+	f.ctx.State.ProxyMap.Limiters = make(map[string][]reverseproxy.LimiterInfo)
+	for key, limiters := range infos {
+		httpProxy, has := f.ctx.State.ProxyMap.GetProxy(key)
 		if !has {
 			continue
 		}
 		for _, limiter := range limiters {
+			// 旧版本为每个访问过的路径自动创建的 qps 限流器不做任何限制，直接丢弃
+			if limiter.LimiterType == string(ratelimit.QPS) && limiter.Speed == 0 && !limiter.Global {
+				continue
+			}
 			// add methods to ProxyMap, then set rate limiter
 			httpProxy.SetRateLimiter(limiter)
 		}
 	}
 
+	// 恢复全局过滤器链
+	if err := f.ctx.State.ProxyMap.SetFilters("", f.ctx.State.ProxyMap.GlobalFilters); err != nil {
+		logger.Errorf("{Restore} can't restore global filters: %s", err.Error())
+	}
+
+	// 恢复主机的管理状态
+	hostStates := f.ctx.State.ProxyMap.HostStates
+	f.ctx.State.ProxyMap.HostStates = make(map[string]map[string]string)
+	for pattern, states := range hostStates {
+		for host, state := range states {
+			if err := f.ctx.State.ProxyMap.SetHostState(pattern, host, state); err != nil {
+				logger.Warnf("{Restore} can't restore host state %s%s: %s", pattern, host, err.Error())
+			}
+		}
+	}
+
+	// 恢复节点的 http 管理地址
+	for raftAddress, httpAddress := range s.Nodes {
+		f.ctx.State.Nodes.Add(raftAddress, httpAddress)
+	}
+
+	// 恢复消费者的配额，本地的使用量保持不变
+	quota.Quotas.Restore(s.Quotas)
+
+	// 恢复消费者以及它们的凭证
+	if err := auth.Consumers.Restore(s.Consumers); err != nil {
+		logger.Errorf("{Restore} can't restore consumers: %s", err.Error())
+	}
+
 	// 重新构建 RadixTree
 	acl.AccessControlList = acl.NewRadixTree()
 	for key := range s.RadixTree.Record {
 		logger.Debugf("{Restore} acl key: %s", key)
-		acl.AccessControlList.Add(key, key)
+		set := s.RadixTree.Sets[key]
+		if set == "" {
+			set = acl.DEFAULT_SET
+		}
+		acl.AccessControlList.AddWithExpire(key, set, s.RadixTree.Expires[key])
 	}
 	return nil
 }
 
 func (f *FSM) doNewHttpProxy(data []byte) error {
-	f.ctx.State.ProxyMap.Lock()
-	defer f.ctx.State.ProxyMap.Unlock()
 	l := config.Location{}
 	if err := jsoniter.Unmarshal(data, &l); err != nil {
 		logger.Warnf("{doNewHttpProxy} can't resolve the data: %s", err.Error())
 		return err
 	}
 
-	if _, ok := f.ctx.State.ProxyMap.Relations[l.Pattern]; ok {
+	if _, ok := f.ctx.State.ProxyMap.GetProxy(l.Pattern); ok {
 		logger.Debugf("{doNewHttpProxy} %s already exists in relations", l.Pattern)
 		return nil
 	}
-	logger.Debugf("{doNewHttpProxy} receive new Log: %s, %s", l.Pattern, l)
+	logger.Debugf("{doNewHttpProxy} receive new Log: %s, %v", l.Pattern, l)
 	err := f.ctx.State.ProxyMap.AddProxyWithLocation(l)
 	if err != nil {
 		logger.Warnf("create proxy error: %s", err.Error())
@@ -126,14 +188,12 @@ func (f *FSM) doNewHttpProxy(data []byte) error {
 }
 
 func (f *FSM) doSetRateLimiter(data []byte) error {
-	f.ctx.State.ProxyMap.Lock()
-	defer f.ctx.State.ProxyMap.Unlock()
 	info := reverseproxy.LimiterInfo{}
 	if err := jsoniter.Unmarshal(data, &info); err != nil {
 		logger.Warnf("can't set rate limiter")
 		return err
 	}
-	httpProxy, has := f.ctx.State.ProxyMap.Relations[info.Prefix]
+	httpProxy, has := f.ctx.State.ProxyMap.GetProxy(info.Prefix)
 	if !has {
 		return HttpProxyNotExistsError
 	}
@@ -146,17 +206,7 @@ func (f *FSM) doHandleAcl(data []byte) error {
 		logger.Warnf("can't resolve aclLog")
 		return err
 	}
-	optType, ipNet := aclLog.Pattern, aclLog.IpAddress
-	if optType == 0 {
-		err := acl.AccessControlList.Delete(ipNet)
-		if err != nil {
-			return err
-		}
-	} else if optType == 1 {
-		err := acl.AccessControlList.Add(ipNet, ipNet)
-		return err
-	}
-	return nil
+	return applyAcl(f.ctx.State.ProxyMap, aclLog)
 }
 
 func (f *FSM) doRemoveProxy(data []byte) error {
@@ -180,4 +230,82 @@ func (f *FSM) doAddHost(data []byte) error {
 		return err
 	}
 	return f.ctx.State.ProxyMap.AddProxy(addHostLog.Pattern, addHostLog.Host)
-}
\ No newline at end of file
+}
+func (f *FSM) doHealthVerdict(data []byte) error {
+	healthLog := HealthLog{}
+	if err := jsoniter.Unmarshal(data, &healthLog); err != nil {
+		logger.Warnf("can't resolve HealthLog")
+		return err
+	}
+	httpProxy, has := f.ctx.State.ProxyMap.GetProxy(healthLog.Pattern)
+	if !has {
+		return HttpProxyNotExistsError
+	}
+	httpProxy.ApplyVerdict(healthLog.Host, healthLog.Alive, healthLog.CheckedBy)
+	return nil
+}
+
+func (f *FSM) doSetHostState(data []byte) error {
+	hostStateLog := HostStateLog{}
+	if err := jsoniter.Unmarshal(data, &hostStateLog); err != nil {
+		logger.Warnf("can't resolve HostStateLog")
+		return err
+	}
+	return f.ctx.State.ProxyMap.SetHostState(hostStateLog.Pattern, hostStateLog.Host, hostStateLog.State)
+}
+
+func (f *FSM) doRegisterNode(data []byte) error {
+	nodeLog := NodeLog{}
+	if err := jsoniter.Unmarshal(data, &nodeLog); err != nil {
+		logger.Warnf("can't resolve NodeLog")
+		return err
+	}
+	f.ctx.State.Nodes.Add(nodeLog.RaftAddress, nodeLog.HttpAddress)
+	return nil
+}
+
+func (f *FSM) doSetQuota(data []byte) error {
+	quotaLog := QuotaLog{}
+	if err := jsoniter.Unmarshal(data, &quotaLog); err != nil {
+		logger.Warnf("can't resolve QuotaLog")
+		return err
+	}
+	return quota.Quotas.SetAllowance(quotaLog.Consumer, quotaLog.Period, quotaLog.Limit)
+}
+
+func (f *FSM) doResetQuota(data []byte) error {
+	resetLog := QuotaResetLog{}
+	if err := jsoniter.Unmarshal(data, &resetLog); err != nil {
+		logger.Warnf("can't resolve QuotaResetLog")
+		return err
+	}
+	quota.Quotas.Reset(resetLog.Consumer, resetLog.At)
+	return nil
+}
+
+func (f *FSM) doReplaceIpSet(data []byte) error {
+	ipSetLog := IpSetLog{}
+	if err := jsoniter.Unmarshal(data, &ipSetLog); err != nil {
+		logger.Warnf("can't resolve IpSetLog")
+		return err
+	}
+	return acl.AccessControlList.ReplaceSet(ipSetLog.Name, ipSetLog.Cidrs)
+}
+
+func (f *FSM) doSetFilters(data []byte) error {
+	filterLog := FilterLog{}
+	if err := jsoniter.Unmarshal(data, &filterLog); err != nil {
+		logger.Warnf("can't resolve FilterLog")
+		return err
+	}
+	return f.ctx.State.ProxyMap.SetFilters(filterLog.Pattern, filterLog.Filters)
+}
+
+func (f *FSM) doSetConsumer(data []byte) error {
+	consumerLog := ConsumerLog{}
+	if err := jsoniter.Unmarshal(data, &consumerLog); err != nil {
+		logger.Warnf("can't resolve ConsumerLog")
+		return err
+	}
+	return applyConsumer(consumerLog)
+}
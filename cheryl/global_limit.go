@@ -0,0 +1,116 @@
+package cheryl
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/qiancijun/cheryl/logger"
+	ratelimit "github.com/qiancijun/cheryl/rate_limit"
+)
+
+// 节点与 leader 交换全局限流器使用情况的周期
+var GlobalSyncInterval = time.Second
+
+type globalQuotaReport struct {
+	Node   string                          `json:"node"`
+	Limits map[string]ratelimit.QuotaUsage `json:"limits"`
+}
+
+/**
+*	每个周期将本地全局限流器的请求数量上报给 leader，
+*	并按照 leader 返回的份额调整本地令牌桶。
+*	联系不到 leader 时所有全局限流器退化为本地限流
+ */
+type globalLimitSyncer struct {
+	node     string
+	limiters func() map[string]*ratelimit.GlobalLimiter
+	leader   func() (string, bool)
+	client   *http.Client
+	degraded bool
+}
+
+func newGlobalLimitSyncer(ctx *StateContext, node string) *globalLimitSyncer {
+	return &globalLimitSyncer{
+		node:     node,
+		limiters: func() map[string]*ratelimit.GlobalLimiter { return ctx.State.ProxyMap.GlobalLimiters() },
+		leader:   ctx.leaderHttpAddress,
+		client:   &http.Client{Timeout: GlobalSyncInterval},
+	}
+}
+
+func (s *globalLimitSyncer) run() {
+	ticker := time.NewTicker(GlobalSyncInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.sync()
+	}
+}
+
+func (s *globalLimitSyncer) sync() {
+	limiters := s.limiters()
+	if len(limiters) == 0 {
+		return
+	}
+	report := globalQuotaReport{
+		Node:   s.node,
+		Limits: make(map[string]ratelimit.QuotaUsage, len(limiters)),
+	}
+	for key, limiter := range limiters {
+		report.Limits[key] = limiter.Drain()
+	}
+	shares, err := s.exchange(report)
+	if err != nil {
+		if !s.degraded {
+			logger.Warnf("{globalLimit} can't sync quota with leader, degrade to local limit: %s", err.Error())
+		}
+		s.degraded = true
+		for _, limiter := range limiters {
+			limiter.Degrade()
+		}
+		return
+	}
+	if s.degraded {
+		logger.Infof("{globalLimit} sync quota with leader again")
+	}
+	s.degraded = false
+	for key, limiter := range limiters {
+		if share, has := shares[key]; has {
+			limiter.SetShare(share)
+		} else {
+			limiter.Degrade()
+		}
+	}
+}
+
+func (s *globalLimitSyncer) exchange(report globalQuotaReport) (map[string]float64, error) {
+	address, has := s.leader()
+	if !has {
+		return nil, fmt.Errorf("leader unknown")
+	}
+	data, err := jsoniter.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Post(fmt.Sprintf("http://%s/globalQuota", address), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+		Data struct {
+			Shares map[string]float64 `json:"shares"`
+		} `json:"data"`
+	}
+	if err := jsoniter.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Code != 200 {
+		return nil, fmt.Errorf("%s", res.Msg)
+	}
+	return res.Data.Shares, nil
+}
@@ -0,0 +1,89 @@
+package cheryl
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ratelimit "github.com/qiancijun/cheryl/rate_limit"
+	reverseproxy "github.com/qiancijun/cheryl/reverse_proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobalLimitSync(t *testing.T) {
+	// leader 节点只需要提供 http 管理接口
+	ctx := &StateContext{
+		State: &State{
+			ProxyMap: reverseproxy.NewProxyMap(),
+			Nodes:    newNodeRegistry(),
+		},
+	}
+	h := newHttpServer(ctx)
+	h.SetWriteFlag(true)
+	leader := httptest.NewServer(h.Mux)
+	address := strings.TrimPrefix(leader.URL, "http://")
+
+	key := "/api/hello"
+	limiters := make([]*ratelimit.GlobalLimiter, 3)
+	syncers := make([]*globalLimitSyncer, 3)
+	for i := range syncers {
+		limiter := ratelimit.NewGlobalLimiter(30, 30)
+		limiters[i] = limiter
+		syncers[i] = &globalLimitSyncer{
+			node:     string(rune('a' + i)),
+			limiters: func() map[string]*ratelimit.GlobalLimiter { return map[string]*ratelimit.GlobalLimiter{key: limiter} },
+			leader:   func() (string, bool) { return address, true },
+			client:   leader.Client(),
+		}
+	}
+
+	demands := []int{100, 10, 0}
+	for round := 0; round < 2; round++ {
+		for i, demand := range demands {
+			for j := 0; j < demand; j++ {
+				limiters[i].Take()
+			}
+			syncers[i].sync()
+		}
+	}
+	shares := []float64{limiters[0].GetShare(), limiters[1].GetShare(), limiters[2].GetShare()}
+	assert.Greater(t, shares[0], shares[1])
+	assert.Greater(t, shares[1], shares[2])
+	// 空闲的节点保留保底配额
+	assert.InDelta(t, 1.0, shares[2], 0.001)
+	assert.InDelta(t, 30.0, shares[0]+shares[1]+shares[2], 0.001)
+	for _, s := range syncers {
+		assert.False(t, s.degraded)
+	}
+
+	// leader 不可达时退化为本地限流
+	leader.Close()
+	for i, s := range syncers {
+		s.sync()
+		assert.True(t, s.degraded)
+		assert.Equal(t, 30.0, limiters[i].GetShare())
+	}
+}
+
+func TestGlobalLimitNotLeader(t *testing.T) {
+	ctx := &StateContext{
+		State: &State{
+			ProxyMap: reverseproxy.NewProxyMap(),
+			Nodes:    newNodeRegistry(),
+		},
+	}
+	h := newHttpServer(ctx)
+	follower := httptest.NewServer(h.Mux)
+	defer follower.Close()
+
+	limiter := ratelimit.NewGlobalLimiter(10, 10)
+	s := &globalLimitSyncer{
+		node:     "a",
+		limiters: func() map[string]*ratelimit.GlobalLimiter { return map[string]*ratelimit.GlobalLimiter{"/api/hello": limiter} },
+		leader:   func() (string, bool) { return strings.TrimPrefix(follower.URL, "http://"), true },
+		client:   follower.Client(),
+	}
+	s.sync()
+	assert.True(t, s.degraded)
+	assert.Equal(t, 10.0, limiter.GetShare())
+}
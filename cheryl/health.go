@@ -0,0 +1,60 @@
+package cheryl
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	HEALTH_CHECK_LOCAL   = "local"
+	HEALTH_CHECK_CLUSTER = "cluster"
+)
+
+// 集群模式的健康检查，leader 主动检查后将结果写入 raft 日志
+type clusterHealth struct {
+	ctx  *StateContext
+	name string
+}
+
+func newClusterHealth(ctx *StateContext, name string) *clusterHealth {
+	return &clusterHealth{
+		ctx:  ctx,
+		name: name,
+	}
+}
+
+func (c *clusterHealth) Name() string {
+	return c.name
+}
+
+func (c *clusterHealth) IsLeader() bool {
+	node := c.ctx.State.RaftNode
+	if node == nil {
+		return false
+	}
+	return node.Raft.State() == raft.Leader
+}
+
+// 超过 LeaderCheckTimeout 没有收到 leader 的消息，认为 leader 不可达
+func (c *clusterHealth) LeaderReachable() bool {
+	node := c.ctx.State.RaftNode
+	if node == nil || node.Raft.Leader() == "" {
+		return false
+	}
+	return time.Since(node.Raft.LastContact()) < LeaderCheckTimeout
+}
+
+func (c *clusterHealth) Report(pattern, host string, alive bool) error {
+	data, err := jsoniter.Marshal(HealthLog{
+		Pattern:   pattern,
+		Host:      host,
+		Alive:     alive,
+		CheckedBy: c.name,
+	})
+	if err != nil {
+		return err
+	}
+	return c.ctx.writeLogEntry(7, data)
+}
@@ -9,9 +9,13 @@ import (
 	"github.com/hashicorp/raft"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/qiancijun/cheryl/acl"
+	"github.com/qiancijun/cheryl/auth"
 	"github.com/qiancijun/cheryl/balancer"
 	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/cors"
+	"github.com/qiancijun/cheryl/filter"
 	"github.com/qiancijun/cheryl/logger"
+	"github.com/qiancijun/cheryl/quota"
 	ratelimit "github.com/qiancijun/cheryl/rate_limit"
 	reverseproxy "github.com/qiancijun/cheryl/reverse_proxy"
 )
@@ -28,6 +32,7 @@ type HttpServer struct {
 	Ctx         *StateContext
 	address     []string
 	enableWrite int32
+	quota       *ratelimit.QuotaAggregator
 }
 
 func newHttpServer(ctx *StateContext) *HttpServer {
@@ -37,6 +42,7 @@ func newHttpServer(ctx *StateContext) *HttpServer {
 		Mux:         mux,
 		enableWrite: ENABLE_WRITE_FALSE,
 		address:     make([]string, 0),
+		quota:       ratelimit.NewQuotaAggregator(3 * GlobalSyncInterval),
 	}
 
 	mux.HandleFunc("/ping", s.doPing)
@@ -51,9 +57,21 @@ func newHttpServer(ctx *StateContext) *HttpServer {
 	mux.HandleFunc("/addHost", s.doAddHost)
 	mux.HandleFunc("/acl", s.doHandleAcl)
 	mux.HandleFunc("/getAcl", s.doGetAccessControlList)
+	mux.HandleFunc("/ipSet", s.doReplaceIpSet)
+	mux.HandleFunc("/ipSets", s.doGetIpSets)
+	mux.HandleFunc("/filters", s.doSetFilters)
+	mux.HandleFunc("/getFilters", s.doGetFilters)
 	mux.HandleFunc("/getRateLimiterType", s.doGetRateLimiterType)
 	mux.HandleFunc("/removeProxy", s.doRemoveProxy)
 	mux.HandleFunc("/removeHost", s.doRemoveHost)
+	mux.HandleFunc("/hostState", s.doSetHostState)
+	mux.HandleFunc("/globalQuota", s.doGlobalQuota)
+	mux.HandleFunc("/quota", s.doSetQuota)
+	mux.HandleFunc("/quotaUsage", s.doGetQuotaUsage)
+	mux.HandleFunc("/quotaReset", s.doResetQuota)
+	mux.HandleFunc("/quotaSync", s.doQuotaSync)
+	mux.HandleFunc("/consumer", s.doSetConsumer)
+	mux.HandleFunc("/consumers", s.doGetConsumers)
 	mux.HandleFunc("/balancerMode", s.doGetBalancerMode)
 	mux.HandleFunc("/changeLb", s.doChangeLb)
 	mux.Handle("/", http.FileServer(http.Dir("static")))
@@ -79,6 +97,11 @@ func (h *HttpServer) doJoin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	h.address = append(h.address, peerAddress)
+	if httpAddress := variables.Get("httpAddress"); httpAddress != "" {
+		if err := h.Ctx.registerNode(peerAddress, httpAddress); err != nil {
+			logger.Warnf("can't register node %s: %s", name, err.Error())
+		}
+	}
 	fmt.Fprint(w, "ok")
 }
 
@@ -89,22 +112,26 @@ func (h *HttpServer) doPing(w http.ResponseWriter, r *http.Request) {
 
 // get the all reverse proxy infomation
 func (h *HttpServer) doGetMethods(w http.ResponseWriter, r *http.Request) {
-	relation := h.Ctx.State.ProxyMap.Relations
+	relation := h.Ctx.State.ProxyMap.Proxies()
 
 	type methodsInfo struct {
-		Prefix      string   `json:"prefix"`
-		MethodsPath []string `json:"methodsPath"`
+		Prefix      string                      `json:"prefix"`
+		MethodsPath []string                    `json:"methodsPath"`
+		Queues      map[string]int              `json:"queues"`
+		Observed    []reverseproxy.ObservedPath `json:"observed"`
 	}
 
 	ret := make([]methodsInfo, 0)
 	for prefix, proxy := range relation {
-		methods := proxy.Methods
+		methods := proxy.GetMethods()
 		logger.Debugf("{doGetMethods} find prefix: %s", prefix)
 		tmp := methodsInfo{
 			Prefix:      prefix,
 			MethodsPath: make([]string, 0),
+			Queues:      proxy.QueueDepths(),
+			Observed:    proxy.ObservedPaths(),
 		}
-		for method := range methods {
+		for _, method := range methods {
 			tmp.MethodsPath = append(tmp.MethodsPath, method)
 			logger.Debugf("{doGetMethods} find method: %s%s", prefix, method)
 		}
@@ -146,7 +173,7 @@ func (h *HttpServer) doSetRateLimiter(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// first: write in local, if success, send logEntry to the raft cluster
-	httpProxy, has := h.Ctx.State.ProxyMap.Relations[info.Prefix]
+	httpProxy, has := h.Ctx.State.ProxyMap.GetProxy(info.Prefix)
 	if !has {
 		errMsg := fmt.Sprintf("can't find the httpProxy: %s", info.Prefix)
 		logger.Warn(errMsg)
@@ -201,21 +228,27 @@ func (h *HttpServer) doGetRaftClusterInfo(w http.ResponseWriter, r *http.Request
 
 func (h *HttpServer) doGetInfo(w http.ResponseWriter, r *http.Request) {
 	type Response struct {
-		Name        string `json:"name"`
-		RaftAddress string `json:"raftAddress"`
-		IsLeader    bool   `json:"isLeader"`
-		ProxyPort   int    `json:"proxyPort"`
+		Name            string `json:"name"`
+		RaftAddress     string `json:"raftAddress"`
+		IsLeader        bool   `json:"isLeader"`
+		ProxyPort       int    `json:"proxyPort"`
+		HealthCheckMode string `json:"healthCheckMode"`
 	}
 	conf := config.GetConfig()
 	name := conf.Name
 	address := conf.Raft.RaftTCPAddress
 	leader := h.Ctx.State.RaftNode.Raft.Leader()
 	preoxyPort := conf.Port
+	healthCheckMode := HEALTH_CHECK_LOCAL
+	if conf.HealthCheckMode == HEALTH_CHECK_CLUSTER {
+		healthCheckMode = HEALTH_CHECK_CLUSTER
+	}
 	res := Response{
-		Name:        name,
-		RaftAddress: address,
-		IsLeader:    address == string(leader),
-		ProxyPort:   preoxyPort,
+		Name:            name,
+		RaftAddress:     address,
+		IsLeader:        address == string(leader),
+		ProxyPort:       preoxyPort,
+		HealthCheckMode: healthCheckMode,
 	}
 	w.Write(Ok().Put("info", res).Marshal())
 }
@@ -230,20 +263,25 @@ func (h *HttpServer) doGetInfo(w http.ResponseWriter, r *http.Request) {
 */
 func (h *HttpServer) doGetProxy(w http.ResponseWriter, r *http.Request) {
 	type host struct {
-		Host  string `json:"host"`
-		Alive bool   `json:"alive"`
+		Host      string `json:"host"`
+		Alive     bool   `json:"alive"`
+		CheckedBy string `json:"checkedBy"`
+		State     string `json:"state"`
+		Inflight  int64  `json:"inflight"`
 	}
 	type Response struct {
 		BalancerMode string `json:"balancerMode"`
 		Hosts        []host `json:"hosts"`
 	}
 	data := make(map[string]Response)
-	for k, v := range h.Ctx.State.ProxyMap.Relations {
+	for k, v := range h.Ctx.State.ProxyMap.Proxies() {
 		proxy := Response{}
-		proxy.BalancerMode = v.Lb.Mode()
+		proxy.BalancerMode = v.GetLb().Mode()
 		proxy.Hosts = make([]host, 0)
-		for h := range v.HostMap {
-			proxy.Hosts = append(proxy.Hosts, host{h, v.Alive[h]})
+		for _, h := range v.Hosts() {
+			alive, checkedBy := v.ReadHealth(h)
+			state, inflight := v.ReadHostState(h)
+			proxy.Hosts = append(proxy.Hosts, host{h, alive, checkedBy, state, inflight})
 		}
 		data[k] = proxy
 	}
@@ -264,29 +302,66 @@ func (h *HttpServer) doGetMehtodLimiter(w http.ResponseWriter, r *http.Request)
 		w.Write(ret.Marshal())
 		return
 	}
-	limiter := h.Ctx.State.ProxyMap.Relations[req.Pattern].Methods[req.Method]
+	httpProxy, has := h.Ctx.State.ProxyMap.GetProxy(req.Pattern)
+	if !has {
+		w.Write(Error(404, "没有找到该方法").Marshal())
+		return
+	}
+	// method 为空时返回 location 的自适应并发限流器
+	var limiter ratelimit.RateLimiter
+	if req.Method != "" {
+		limiter = httpProxy.GetLimiter(req.Method)
+	} else if adaptive := httpProxy.GetAdaptive(); adaptive != nil {
+		limiter = adaptive
+	}
 	if limiter == nil {
 		w.Write(Error(404, "没有找到该方法").Marshal())
 		return
 	}
 	type Response struct {
-		Type    string        `json:"type"`
-		Speed   int64         `json:"speed"`
-		Volumn  int           `json:"volumn"`
-		Timeout time.Duration `json:"timeout"`
-	}
-	var tp string
-	switch limiter.(type) {
-	case *ratelimit.QpsRateLimiter:
-		tp = "qps"
-	default:
-		tp = "unknown"
+		Type    string  `json:"type"`
+		Speed   int64   `json:"speed"`
+		Volumn  int     `json:"volumn"`
+		Timeout int64   `json:"timeout"`
+		Window  int64   `json:"window"`
+		KeyBy   string  `json:"keyBy"`
+		Keys    int     `json:"keys"`
+		Global  bool    `json:"global"`
+		Share   float64 `json:"share"`
+		Queued  int     `json:"queued"`
+		Lanes   []int   `json:"lanes"`
+		Limit   int     `json:"limit"`
+		MinRTT  int64   `json:"minRtt"`
+		// 排队限流器决定优先级的请求头
+		PriorityHeader string `json:"priorityHeader"`
 	}
 	res := Response{
-		Type:    tp,
+		Type:    string(limiter.Type()),
 		Speed:   limiter.GetSpeed(),
 		Volumn:  limiter.GetVolumn(),
-		Timeout: limiter.GetTimeout(),
+		Timeout: limiter.GetTimeout().Milliseconds(),
+	}
+	// 按客户端限流时，从内嵌的限流器读取具体类型的配置
+	inner := limiter
+	if keyed, ok := limiter.(*ratelimit.KeyedLimiter); ok {
+		res.KeyBy = keyed.KeyBy
+		res.Keys = keyed.Len()
+		inner = keyed.RateLimiter
+	}
+	if windowLimiter, ok := inner.(ratelimit.WindowLimiter); ok {
+		res.Window = windowLimiter.GetWindow().Milliseconds()
+	}
+	if global, ok := limiter.(*ratelimit.GlobalLimiter); ok {
+		res.Global = true
+		res.Share = global.GetShare()
+	}
+	if queued, lanes, ok := ratelimit.QueueDepth(limiter); ok {
+		res.Queued, res.Lanes = queued, lanes
+		res.PriorityHeader = inner.(*ratelimit.QueueLimiter).PriorityHeader
+	}
+	if adaptive, ok := inner.(*ratelimit.AdaptiveLimiter); ok {
+		res.Limit = adaptive.Limit()
+		res.MinRTT = adaptive.MinRTT().Milliseconds()
 	}
 	w.Write(Ok().Put("method", res).Marshal())
 }
@@ -361,6 +436,15 @@ func (h *HttpServer) doHandleAcl(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(400)
 		return
 	}
+	if req.Ttl < 0 {
+		w.Write(Error(500, "ttl can't be negative").Marshal())
+		return
+	}
+	// 过期时间在写入日志之前确定，所有节点按照同一个时间失效
+	req.Expire = time.Time{}
+	if req.Ttl > 0 {
+		req.Expire = time.Now().Add(time.Duration(req.Ttl) * time.Second)
+	}
 
 	data, err := jsoniter.Marshal(req)
 	if err != nil {
@@ -370,20 +454,10 @@ func (h *HttpServer) doHandleAcl(w http.ResponseWriter, r *http.Request) {
 		w.Write(ret.Marshal())
 		return
 	}
-	logger.Debugf("{doHandleAcl} receive opt type: %d, ipAddress: %s", req.Pattern, req.IpAddress)
-	if req.Pattern == 0 {
-		// delete
-		err = acl.AccessControlList.Delete(req.IpAddress)
-		if err != nil {
-			w.Write(Error(500, err.Error()).Marshal())
-			return
-		}
-	} else {
-		err = acl.AccessControlList.Add(req.IpAddress, req.IpAddress)
-		if err != nil {
-			w.Write(Error(500, err.Error()).Marshal())
-			return
-		}
+	logger.Debugf("{doHandleAcl} receive opt type: %d, ipAddress: %s, scope: %s", req.Pattern, req.IpAddress, req.Scope)
+	if err = applyAcl(h.Ctx.State.ProxyMap, req); err != nil {
+		w.Write(Error(500, err.Error()).Marshal())
+		return
 	}
 	if err := h.Ctx.writeLogEntry(3, data); err != nil {
 		errMsg := fmt.Sprintf("can't apply log entry: %s", err.Error())
@@ -395,9 +469,124 @@ func (h *HttpServer) doHandleAcl(w http.ResponseWriter, r *http.Request) {
 	w.Write(Ok().Marshal())
 }
 
+// list 为全局黑名单，ttl 为有时限的规则剩余的秒数，sets 为黑名单中的地址集合，global 为配置文件中的全局访问控制列表，
+// locations 为每个 location 的访问控制列表
 func (h *HttpServer) doGetAccessControlList(w http.ResponseWriter, r *http.Request) {
 	list := acl.AccessControlList.GetBlackList()
-	w.Write(Ok().Put("list", list).Marshal())
+	ttl := make(map[string]int64)
+	for cidr, remaining := range acl.AccessControlList.GetRemaining() {
+		ttl[cidr] = int64((remaining + time.Second - 1) / time.Second)
+	}
+	ret := Ok().Put("list", list).Put("ttl", ttl).Put("sets", acl.AccessControlList.GetSets()).Put("locations", h.Ctx.State.ProxyMap.AccessLists())
+	if global := acl.GlobalAccessList; global != nil {
+		ret.Put("global", global.Config())
+	}
+	w.Write(ret.Marshal())
+}
+
+/**
+*	替换整个地址集合，format=text 时请求体为每行一个 CIDR 的纯文本，集合名称由 name 参数指定，
+*	否则请求体为 IpSetLog 的 JSON。所有的 CIDR 作为一条 raft 日志写入
+ */
+func (h *HttpServer) doReplaceIpSet(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWritePermission() {
+		w.Write(Error(500, "write method not allowed").Marshal())
+		return
+	}
+	var req IpSetLog
+	if r.URL.Query().Get("format") == "text" {
+		cidrs, err := acl.ParseIpList(r.Body)
+		if err != nil {
+			w.Write(Error(500, fmt.Sprintf("can't read the ip list: %s", err.Error())).Marshal())
+			return
+		}
+		req = IpSetLog{Name: r.URL.Query().Get("name"), Cidrs: cidrs}
+	} else if err := jsoniter.NewDecoder(r.Body).Decode(&req); err != nil {
+		errMsg := fmt.Sprintf("can't receive the json data: %s", err.Error())
+		logger.Warn(errMsg)
+		w.Write(Error(500, errMsg).Marshal())
+		return
+	}
+	// 写入 raft 日志之前规范化，日志中的 CIDR 与导出的结果一致
+	cidrs, err := acl.CanonicalCidrs(req.Cidrs)
+	if err != nil {
+		w.Write(Error(500, err.Error()).Marshal())
+		return
+	}
+	req.Cidrs = cidrs
+	data, err := jsoniter.Marshal(req)
+	if err != nil {
+		errMsg := fmt.Sprintf("can't resolve json data: %s", err.Error())
+		logger.Warn(errMsg)
+		w.Write(Error(500, errMsg).Marshal())
+		return
+	}
+	if err = acl.AccessControlList.ReplaceSet(req.Name, req.Cidrs); err != nil {
+		w.Write(Error(500, err.Error()).Marshal())
+		return
+	}
+	if err = h.Ctx.writeLogEntry(12, data); err != nil {
+		errMsg := fmt.Sprintf("can't apply log entry: %s", err.Error())
+		logger.Warn(errMsg)
+		w.Write(Error(500, errMsg).Marshal())
+		return
+	}
+	w.Write(Ok().Put("name", req.Name).Put("count", len(req.Cidrs)).Marshal())
+}
+
+// 导出地址集合，name 为空时导出所有的集合，format=text 时返回纯文本
+func (h *HttpServer) doGetIpSets(w http.ResponseWriter, r *http.Request) {
+	sets := acl.AccessControlList.GetSets()
+	if name := r.URL.Query().Get("name"); name != "" {
+		sets = map[string][]string{name: sets[name]}
+	}
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := acl.WriteIpSets(w, sets); err != nil {
+			logger.Warnf("{doGetIpSets} can't write ip sets: %s", err.Error())
+		}
+		return
+	}
+	w.Write(Ok().Put("sets", sets).Marshal())
+}
+
+// 替换 location 的过滤器链
+func (h *HttpServer) doSetFilters(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWritePermission() {
+		w.Write(Error(500, "write method not allowed").Marshal())
+		return
+	}
+	var req FilterLog
+	if err := jsoniter.NewDecoder(r.Body).Decode(&req); err != nil {
+		errMsg := fmt.Sprintf("can't receive the json data: %s", err.Error())
+		logger.Warn(errMsg)
+		w.Write(Error(500, errMsg).Marshal())
+		return
+	}
+	data, err := jsoniter.Marshal(req)
+	if err != nil {
+		errMsg := fmt.Sprintf("can't resolve json data: %s", err.Error())
+		logger.Warn(errMsg)
+		w.Write(Error(500, errMsg).Marshal())
+		return
+	}
+	if err = h.Ctx.State.ProxyMap.SetFilters(req.Pattern, req.Filters); err != nil {
+		w.Write(Error(500, err.Error()).Marshal())
+		return
+	}
+	if err = h.Ctx.writeLogEntry(13, data); err != nil {
+		errMsg := fmt.Sprintf("can't apply log entry: %s", err.Error())
+		logger.Warn(errMsg)
+		w.Write(Error(500, errMsg).Marshal())
+		return
+	}
+	w.Write(Ok().Marshal())
+}
+
+// filters 为每个 location 的过滤器链，available 为支持的过滤器
+func (h *HttpServer) doGetFilters(w http.ResponseWriter, r *http.Request) {
+	proxyMap := h.Ctx.State.ProxyMap
+	w.Write(Ok().Put("global", proxyMap.GetGlobalFilters()).Put("filters", proxyMap.Filters()).Put("available", filter.GetFilterNames()).Marshal())
 }
 
 func (h *HttpServer) doGetRateLimiterType(w http.ResponseWriter, r *http.Request) {
@@ -469,6 +658,209 @@ func (h *HttpServer) doRemoveHost(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// 将主机设置为 draining、maintenance 或者恢复为 active
+func (h *HttpServer) doSetHostState(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWritePermission() {
+		w.Write(Error(500, "write method not allowed").Marshal())
+		return
+	}
+	var req HostStateLog
+	if err := jsoniter.NewDecoder(r.Body).Decode(&req); err != nil {
+		r.Body.Close()
+		errMsg := fmt.Sprintf("can't receive the json data: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+	data, err := jsoniter.Marshal(req)
+	if err != nil {
+		errMsg := fmt.Sprintf("can't resolve json data: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+
+	if err = h.Ctx.State.ProxyMap.SetHostState(req.Pattern, req.Host, req.State); err != nil {
+		w.Write(Error(500, err.Error()).Marshal())
+		return
+	}
+	if err = h.Ctx.writeLogEntry(8, data); err != nil {
+		errMsg := fmt.Sprintf("can't apply log entry: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+	w.Write(Ok().Marshal())
+}
+
+func (h *HttpServer) doSetQuota(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWritePermission() {
+		w.Write(Error(500, "write method not allowed").Marshal())
+		return
+	}
+	var req QuotaLog
+	if err := jsoniter.NewDecoder(r.Body).Decode(&req); err != nil {
+		r.Body.Close()
+		errMsg := fmt.Sprintf("can't receive the json data: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+	data, err := jsoniter.Marshal(req)
+	if err != nil {
+		errMsg := fmt.Sprintf("can't resolve json data: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+
+	if err = quota.Quotas.SetAllowance(req.Consumer, req.Period, req.Limit); err != nil {
+		w.Write(Error(500, err.Error()).Marshal())
+		return
+	}
+	if err = h.Ctx.writeLogEntry(10, data); err != nil {
+		errMsg := fmt.Sprintf("can't apply log entry: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+	w.Write(Ok().Marshal())
+}
+
+// used 是最近一次与 leader 同步之后整个集群的使用量，local 是本节点处理的请求数量
+func (h *HttpServer) doGetQuotaUsage(w http.ResponseWriter, r *http.Request) {
+	consumer := r.URL.Query().Get("consumer")
+	if consumer == "" {
+		w.Write(Error(500, quota.InvalidConsumerError.Error()).Marshal())
+		return
+	}
+	w.Write(Ok().Put("consumer", consumer).Put("usage", quota.Quotas.Usage(consumer)).Marshal())
+}
+
+func (h *HttpServer) doSetConsumer(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWritePermission() {
+		w.Write(Error(500, "write method not allowed").Marshal())
+		return
+	}
+	var req consumerRequest
+	if err := jsoniter.NewDecoder(r.Body).Decode(&req); err != nil {
+		errMsg := fmt.Sprintf("can't receive the json data: %s", err.Error())
+		logger.Warn(errMsg)
+		w.Write(Error(500, errMsg).Marshal())
+		return
+	}
+	consumerLog, err := req.toLog()
+	if err != nil {
+		w.Write(Error(500, err.Error()).Marshal())
+		return
+	}
+	data, err := jsoniter.Marshal(consumerLog)
+	if err != nil {
+		errMsg := fmt.Sprintf("can't resolve json data: %s", err.Error())
+		logger.Warn(errMsg)
+		w.Write(Error(500, errMsg).Marshal())
+		return
+	}
+	if err = applyConsumer(consumerLog); err != nil {
+		w.Write(Error(500, err.Error()).Marshal())
+		return
+	}
+	if err = h.Ctx.writeLogEntry(14, data); err != nil {
+		errMsg := fmt.Sprintf("can't apply log entry: %s", err.Error())
+		logger.Warn(errMsg)
+		w.Write(Error(500, errMsg).Marshal())
+		return
+	}
+	w.Write(Ok().Marshal())
+}
+
+// 不返回消费者的凭证，只返回 API Key 的数量和用户名
+func (h *HttpServer) doGetConsumers(w http.ResponseWriter, r *http.Request) {
+	w.Write(Ok().Put("consumers", auth.Consumers.Infos()).Marshal())
+}
+
+func (h *HttpServer) doResetQuota(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWritePermission() {
+		w.Write(Error(500, "write method not allowed").Marshal())
+		return
+	}
+	var req QuotaResetLog
+	if err := jsoniter.NewDecoder(r.Body).Decode(&req); err != nil {
+		r.Body.Close()
+		errMsg := fmt.Sprintf("can't receive the json data: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+	if req.Consumer == "" {
+		w.Write(Error(500, quota.InvalidConsumerError.Error()).Marshal())
+		return
+	}
+	req.At = time.Now()
+	data, err := jsoniter.Marshal(req)
+	if err != nil {
+		errMsg := fmt.Sprintf("can't resolve json data: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+
+	quota.Quotas.Reset(req.Consumer, req.At)
+	if err = h.Ctx.writeLogEntry(11, data); err != nil {
+		errMsg := fmt.Sprintf("can't apply log entry: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+	w.Write(Ok().Marshal())
+}
+
+// 只有 leader 负责分配全局限流器的配额
+func (h *HttpServer) doGlobalQuota(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWritePermission() {
+		w.Write(Error(500, "not leader").Marshal())
+		return
+	}
+	var report globalQuotaReport
+	if err := jsoniter.NewDecoder(r.Body).Decode(&report); err != nil {
+		r.Body.Close()
+		errMsg := fmt.Sprintf("can't receive the json data: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+	shares := h.quota.Report(report.Node, report.Limits)
+	w.Write(Ok().Put("shares", shares).Marshal())
+}
+
+// 只有 leader 负责汇总各个节点的配额使用量
+func (h *HttpServer) doQuotaSync(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWritePermission() {
+		w.Write(Error(500, "not leader").Marshal())
+		return
+	}
+	var report quotaReport
+	if err := jsoniter.NewDecoder(r.Body).Decode(&report); err != nil {
+		r.Body.Close()
+		errMsg := fmt.Sprintf("can't receive the json data: %s", err.Error())
+		logger.Warn(errMsg)
+		ret := Error(500, errMsg)
+		w.Write(ret.Marshal())
+		return
+	}
+	w.Write(Ok().Put("counters", quota.Quotas.Merge(report.Node, report.Counters)).Marshal())
+}
+
 func (h *HttpServer) doGetBalancerMode(w http.ResponseWriter, r *http.Request) {
 	typies := balancer.GetBalancerType()
 	w.Write(Ok().Put("mode", typies).Marshal())
@@ -498,7 +890,12 @@ func (h *HttpServer) doChangeLb(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.Ctx.State.ProxyMap.Relations[req.Prefix].ChangeLb(req.Lb)
+	httpProxy, has := h.Ctx.State.ProxyMap.GetProxy(req.Prefix)
+	if !has {
+		w.Write(Error(500, fmt.Sprintf("can't find the httpProxy: %s", req.Prefix)).Marshal())
+		return
+	}
+	err = httpProxy.ChangeLb(req.Lb)
 	if err != nil {
 		w.Write(Error(500, err.Error()).Marshal())
 		return
@@ -527,5 +924,14 @@ func validLocation(location config.Location) error {
 	if len(proxyPass) == 0 {
 		return fmt.Errorf("can't find any proxy hosts")
 	}
+	if _, err := acl.NewAccessList(location.Acl); err != nil {
+		return fmt.Errorf("invaild acl: %s", err.Error())
+	}
+	if _, err := filter.NewFilterChain(location.Filters); err != nil {
+		return fmt.Errorf("invaild filters: %s", err.Error())
+	}
+	if _, err := cors.NewPolicy(location.Cors); err != nil {
+		return fmt.Errorf("invaild cors: %s", err.Error())
+	}
 	return nil
 }
@@ -53,10 +53,10 @@ func TestGetProxy(t *testing.T) {
 	data := make(map[string]Response)
 	for k, v := range m.Relations {
 		proxy := Response{}
-		proxy.BalancerMode = v.Lb.Mode()
+		proxy.BalancerMode = v.GetLb().Mode()
 		proxy.Hosts = make([]host, 0)
-		for h := range v.HostMap {
-			proxy.Hosts = append(proxy.Hosts, host{h, v.Alive[h]})
+		for _, h := range v.Hosts() {
+			proxy.Hosts = append(proxy.Hosts, host{h, v.ReadAlive(h)})
 		}
 		data[k] = proxy
 	}
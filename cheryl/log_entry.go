@@ -3,6 +3,10 @@ package cheryl
 import (
 	"bytes"
 	"encoding/binary"
+	"time"
+
+	"github.com/qiancijun/cheryl/auth"
+	"github.com/qiancijun/cheryl/config"
 )
 
 type LogEntry struct {
@@ -10,9 +14,39 @@ type LogEntry struct {
 	Data []byte
 }
 
+/**
+*	Pattern: 0 删除，1 添加，2 设置 location 的默认策略
+*	Scope: 为空时修改全局黑名单，否则为 location 的 pattern
+*	Action: location 规则的 allow/deny，或者 location 的默认策略
+*	Index: 添加 location 规则的位置，从 1 开始，为 0 时追加到末尾
+*	Country, Asn: location 按照国家代码或者 ASN 匹配的规则，此时 IpAddress 为空
+*	Ttl: 全局黑名单规则的有效时间（秒），为 0 时永久有效
+*	Expire: 由接收请求的节点根据 Ttl 计算的过期时间，所有节点使用同一个时间
+*	Set: 全局黑名单规则所属的地址集合，为空时为 blacklist
+ */
 type AclLog struct {
 	Pattern   byte
 	IpAddress string
+	Scope     string
+	Action    string
+	Index     int
+	Country   string
+	Asn       uint
+	Ttl       int64
+	Expire    time.Time
+	Set       string
+}
+
+// 使用 Cidrs 替换整个地址集合，Cidrs 为空时删除集合
+type IpSetLog struct {
+	Name  string
+	Cidrs []string
+}
+
+// 使用 Filters 替换 location 的过滤器链，Pattern 为空时替换全局过滤器链，Filters 为空时删除所有的过滤器
+type FilterLog struct {
+	Pattern string
+	Filters []config.FilterConfig
 }
 
 type HostLog struct {
@@ -20,6 +54,43 @@ type HostLog struct {
 	Host    string
 }
 
+type HostStateLog struct {
+	Pattern string `json:"pattern"`
+	Host    string `json:"host"`
+	State   string `json:"state"`
+}
+
+type NodeLog struct {
+	RaftAddress string `json:"raftAddress"`
+	HttpAddress string `json:"httpAddress"`
+}
+
+// limit 小于等于 0 时删除该周期的配额
+type QuotaLog struct {
+	Consumer string `json:"consumer"`
+	Period   string `json:"period"`
+	Limit    int64  `json:"limit"`
+}
+
+// At 是写入日志时的时间，只清空这之前的使用量
+type QuotaResetLog struct {
+	Consumer string    `json:"consumer"`
+	At       time.Time `json:"at"`
+}
+
+// Consumer 为空时删除消费者，否则替换整个消费者，日志中只有凭证的摘要和哈希
+type ConsumerLog struct {
+	Name     string         `json:"name"`
+	Consumer *auth.Consumer `json:"consumer"`
+}
+
+type HealthLog struct {
+	Pattern   string
+	Host      string
+	Alive     bool
+	CheckedBy string
+}
+
 func (l *LogEntry) Encode() ([]byte, error) {
 	buf := new(bytes.Buffer)
 	if err := binary.Write(buf, binary.BigEndian, l.Opt); err != nil {
@@ -0,0 +1,87 @@
+package cheryl
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/qiancijun/cheryl/config"
+)
+
+// 记录集群中每个节点 raft 地址对应的 http 管理地址，通过 raft 同步
+type nodeRegistry struct {
+	sync.RWMutex
+	Nodes map[string]string
+}
+
+func newNodeRegistry() *nodeRegistry {
+	return &nodeRegistry{
+		Nodes: make(map[string]string),
+	}
+}
+
+func (n *nodeRegistry) Add(raftAddress string, httpAddress string) {
+	n.Lock()
+	defer n.Unlock()
+	n.Nodes[raftAddress] = httpAddress
+}
+
+func (n *nodeRegistry) Get(raftAddress string) (string, bool) {
+	n.RLock()
+	defer n.RUnlock()
+	httpAddress, has := n.Nodes[raftAddress]
+	return httpAddress, has
+}
+
+func (n *nodeRegistry) Copy() map[string]string {
+	n.RLock()
+	defer n.RUnlock()
+	res := make(map[string]string, len(n.Nodes))
+	for k, v := range n.Nodes {
+		res[k] = v
+	}
+	return res
+}
+
+// 当前节点对外的 http 管理地址，使用 raft 地址中的主机
+func advertiseHttpAddress(conf *config.CherylConfig) string {
+	host, _, err := net.SplitHostPort(conf.Raft.RaftTCPAddress)
+	if err != nil || host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(conf.HttpPort))
+}
+
+// 返回 leader 的 http 管理地址
+func (ctx *StateContext) leaderHttpAddress() (string, bool) {
+	node := ctx.State.RaftNode
+	if node == nil {
+		return "", false
+	}
+	leader := node.Raft.Leader()
+	if leader == "" {
+		return "", false
+	}
+	if address, has := ctx.State.Nodes.Get(string(leader)); has {
+		return address, true
+	}
+	// 旧版本加入的节点没有登记，使用配置中的 leader 地址
+	if conf := config.GetConfig(); conf != nil && conf.Raft.LeaderAddress != "" {
+		return conf.Raft.LeaderAddress, true
+	}
+	return "", false
+}
+
+// 登记节点的 http 管理地址
+func (ctx *StateContext) registerNode(raftAddress string, httpAddress string) error {
+	data, err := jsoniter.Marshal(NodeLog{
+		RaftAddress: raftAddress,
+		HttpAddress: httpAddress,
+	})
+	if err != nil {
+		return err
+	}
+	ctx.State.Nodes.Add(raftAddress, httpAddress)
+	return ctx.writeLogEntry(9, data)
+}
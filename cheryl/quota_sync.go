@@ -0,0 +1,100 @@
+package cheryl
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/qiancijun/cheryl/logger"
+	"github.com/qiancijun/cheryl/quota"
+)
+
+// 节点与 leader 交换配额使用量的周期
+var QuotaSyncInterval = time.Second
+
+type quotaReport struct {
+	Node     string                   `json:"node"`
+	Counters map[string]quota.Counter `json:"counters"`
+}
+
+/**
+*	每个周期将本节点的配额使用量上报给 leader，并取回其他节点的使用量，
+*	这样每个节点都按照整个集群的使用量判断配额。
+*	联系不到 leader 时保留上一次取回的使用量，两次同步之间其他节点的请求无法感知
+ */
+type quotaSyncer struct {
+	node     string
+	quotas   *quota.QuotaManager
+	leader   func() (string, bool)
+	client   *http.Client
+	degraded bool
+}
+
+func newQuotaSyncer(ctx *StateContext, node string) *quotaSyncer {
+	return &quotaSyncer{
+		node:   node,
+		quotas: quota.Quotas,
+		leader: ctx.leaderHttpAddress,
+		client: &http.Client{Timeout: QuotaSyncInterval},
+	}
+}
+
+func (s *quotaSyncer) run() {
+	ticker := time.NewTicker(QuotaSyncInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.sync()
+	}
+}
+
+func (s *quotaSyncer) sync() {
+	counters := s.quotas.Local()
+	if len(counters) == 0 {
+		return
+	}
+	remote, err := s.exchange(quotaReport{Node: s.node, Counters: counters})
+	if err != nil {
+		if !s.degraded {
+			logger.Warnf("{quotaSync} can't sync quota usage with leader, keep the last known usage: %s", err.Error())
+		}
+		s.degraded = true
+		return
+	}
+	if s.degraded {
+		logger.Infof("{quotaSync} sync quota usage with leader again")
+	}
+	s.degraded = false
+	s.quotas.SetRemote(remote)
+}
+
+func (s *quotaSyncer) exchange(report quotaReport) (map[string]quota.Counter, error) {
+	address, has := s.leader()
+	if !has {
+		return nil, fmt.Errorf("leader unknown")
+	}
+	data, err := jsoniter.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Post(fmt.Sprintf("http://%s/quotaSync", address), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+		Data struct {
+			Counters map[string]quota.Counter `json:"counters"`
+		} `json:"data"`
+	}
+	if err := jsoniter.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Code != 200 {
+		return nil, fmt.Errorf("%s", res.Msg)
+	}
+	return res.Data.Counters, nil
+}
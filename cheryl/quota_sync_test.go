@@ -0,0 +1,79 @@
+package cheryl
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qiancijun/cheryl/quota"
+	reverseproxy "github.com/qiancijun/cheryl/reverse_proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaSync(t *testing.T) {
+	// leader 节点只需要提供 http 管理接口
+	ctx := &StateContext{
+		State: &State{
+			ProxyMap: reverseproxy.NewProxyMap(),
+			Nodes:    newNodeRegistry(),
+		},
+	}
+	h := newHttpServer(ctx)
+	h.SetWriteFlag(true)
+	leader := httptest.NewServer(h.Mux)
+	address := strings.TrimPrefix(leader.URL, "http://")
+
+	consumer := "quota-sync"
+	managers := make([]*quota.QuotaManager, 2)
+	syncers := make([]*quotaSyncer, 2)
+	for i := range syncers {
+		managers[i] = quota.NewQuotaManager()
+		assert.NoError(t, managers[i].SetAllowance(consumer, quota.DAILY, 8))
+		syncers[i] = &quotaSyncer{
+			node:   string(rune('a' + i)),
+			quotas: managers[i],
+			leader: func() (string, bool) { return address, true },
+			client: leader.Client(),
+		}
+	}
+
+	uses := []int{3, 4}
+	for i, n := range uses {
+		for j := 0; j < n; j++ {
+			_, err := managers[i].Use(consumer)
+			assert.NoError(t, err)
+		}
+	}
+	// 重复同步不会重复计算
+	for round := 0; round < 2; round++ {
+		for _, s := range syncers {
+			s.sync()
+		}
+	}
+	for i, m := range managers {
+		usage := m.Usage(consumer)
+		assert.Equal(t, int64(7), usage[0].Used)
+		assert.Equal(t, int64(uses[i]), usage[0].Local)
+		assert.False(t, syncers[i].degraded)
+	}
+
+	// 按照整个集群的使用量判断配额
+	_, err := managers[0].Use(consumer)
+	assert.NoError(t, err)
+	_, err = managers[0].Use(consumer)
+	assert.Equal(t, quota.QuotaExceededError, err)
+
+	// 清空之前上报的使用量不再计入
+	at := time.Now()
+	quota.Quotas.Reset(consumer, at)
+	managers[0].Reset(consumer, at)
+	syncers[0].sync()
+	assert.Equal(t, int64(0), managers[0].Usage(consumer)[0].Used)
+
+	// leader 不可达时保留上一次的使用量
+	leader.Close()
+	syncers[1].sync()
+	assert.True(t, syncers[1].degraded)
+	assert.Equal(t, int64(7), managers[1].Usage(consumer)[0].Used)
+}
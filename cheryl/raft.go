@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
 	"time"
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/qiancijun/cheryl/acl"
+	"github.com/qiancijun/cheryl/ban"
 	"github.com/qiancijun/cheryl/config"
 	"github.com/qiancijun/cheryl/logger"
+	"github.com/qiancijun/cheryl/quota"
 	reverseproxy "github.com/qiancijun/cheryl/reverse_proxy"
 	"github.com/qiancijun/cheryl/utils"
 )
@@ -19,13 +23,18 @@ var (
 	Context *State
 )
 
-func Start(conf *config.CherylConfig) {
+// 配置无效时在启动任何服务之前返回错误，由调用者以非零状态退出
+func Start(conf *config.CherylConfig) error {
+	if err := setupAccess(conf); err != nil {
+		return err
+	}
 
 	proxyMap := reverseproxy.NewProxyMap()
 	logger.Debug("init proxyMap success")
 
 	state := &State{
 		ProxyMap: proxyMap,
+		Nodes:    newNodeRegistry(),
 	}
 	Context = state
 
@@ -48,6 +57,25 @@ func Start(conf *config.CherylConfig) {
 		http.Serve(httpListen, httpServer.Mux)
 	}()
 
+	// 自动封禁异常的客户端
+	ban.AutoBan.Handler = newAutoBanner(stateContext).Ban
+
+	// 消费者配额的使用量保存在 raft 数据目录下
+	if conf.QuotaHeader != "" {
+		quota.Quotas.KeyHeader = conf.QuotaHeader
+	}
+	if err := os.MkdirAll(filepath.Join(conf.Raft.DataDir, conf.Name), 0700); err != nil {
+		logger.Errorf("can't create data dir: %s", err.Error())
+	}
+	if err := quota.Quotas.Open(filepath.Join(conf.Raft.DataDir, conf.Name, "quota.db")); err != nil {
+		logger.Errorf("open quota counters failed: %s", err.Error())
+	}
+
+	// 集群模式下只有 leader 主动进行健康检查
+	if conf.HealthCheckMode == HEALTH_CHECK_CLUSTER {
+		reverseproxy.Coordinator = newClusterHealth(stateContext, conf.Name)
+	}
+
 	// 创建 raft 节点
 	raft, err := createRaftNode(conf, stateContext)
 	if err != nil {
@@ -73,13 +101,48 @@ func Start(conf *config.CherylConfig) {
 				}
 				httpServer.SetWriteFlag(true)
 				logger.Debug("become leader, enable write api")
+				if err := stateContext.registerNode(conf.Raft.RaftTCPAddress, advertiseHttpAddress(conf)); err != nil {
+					logger.Warnf("can't register node %s: %s", conf.Name, err.Error())
+				}
 			} else {
 				logger.Debug("become follower, disable write api")
 				httpServer.SetWriteFlag(false)
 			}
 		}
 	}()
+	go purgeAcl()
+	// 同步集群全局限流器的配额
+	go newGlobalLimitSyncer(stateContext, conf.Name).run()
+	// 同步消费者配额的使用量
+	go newQuotaSyncer(stateContext, conf.Name).run()
 	startRouter(stateContext, conf)
+	return nil
+}
+
+/**
+*	可信代理、GeoIP 数据库、全局访问控制列表以及自动封禁规则
+*	任何一项无效时拒绝启动，否则全局访问控制列表会放行所有的客户端
+ */
+func setupAccess(conf *config.CherylConfig) error {
+	// 只信任来自可信代理的 X-Forwarded-For、Forwarded 以及 PROXY 协议头部
+	if err := utils.SetTrustedProxies(conf.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxies: %s", err.Error())
+	}
+	acl.GeoDB.CountryHeader = conf.GeoIP.CountryHeader
+	if err := acl.GeoDB.Open(conf.GeoIP.Databases); err != nil {
+		return fmt.Errorf("can't open geoip databases: %s", err.Error())
+	}
+	if conf.Acl.Default != "" || len(conf.Acl.Rules) > 0 {
+		global, err := acl.NewAccessList(conf.Acl)
+		if err != nil {
+			return fmt.Errorf("invalid global acl: %s", err.Error())
+		}
+		acl.GlobalAccessList = global
+	}
+	if err := ban.AutoBan.SetRules(conf.AutoBan); err != nil {
+		return fmt.Errorf("invalid auto ban rules: %s", err.Error())
+	}
+	return nil
 }
 
 func createListener(port int) (net.Listener, error) {
@@ -97,6 +160,24 @@ func createProxy(ctx *StateContext, conf *config.CherylConfig) {
 	for _, l := range conf.Location {
 		createProxyWithLocation(ctx, l)
 	}
+	if len(conf.Filters) > 0 {
+		createGlobalFilters(ctx, conf.Filters)
+	}
+}
+
+func createGlobalFilters(ctx *StateContext, filters []config.FilterConfig) {
+	if err := ctx.State.ProxyMap.SetFilters("", filters); err != nil {
+		logger.Errorf("create global filters error: %s", err)
+		return
+	}
+	data, err := jsoniter.Marshal(FilterLog{Filters: filters})
+	if err != nil {
+		logger.Warnf("can't marshal filters: %s", err.Error())
+		return
+	}
+	if err = ctx.writeLogEntry(13, data); err != nil {
+		logger.Warnf("{createGlobalFilters} write logEntry failed: %s", err.Error())
+	}
 }
 
 func createProxyWithLocation(ctx *StateContext, l config.Location) {
@@ -133,6 +214,9 @@ func startRouter(ctx *StateContext, conf *config.CherylConfig) {
 	if err != nil {
 		logger.Errorf("can't create listen on %d", conf.Port)
 	}
+	if conf.ProxyProtocol {
+		l = utils.NewProxyProtocolListener(l)
+	}
 
 	if conf.Schema == "http" {
 		if err := svr.Serve(l); err != nil {
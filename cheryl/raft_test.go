@@ -3,9 +3,12 @@ package cheryl
 import (
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"testing"
 
+	"github.com/qiancijun/cheryl/acl"
 	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,6 +18,7 @@ func TestRaftNode(t *testing.T) {
 	assert.NotNil(t, config)
 	err = config.Validation()
 	assert.NoError(t, err)
+	config.Raft.DataDir = t.TempDir()
 
 	go func() {
 		Start(config)
@@ -34,9 +38,35 @@ func TestRaftCluster(t *testing.T) {
 	assert.NoError(t, err)
 	config2, err := config.ReadConfig("../config2.yaml")
 	assert.NoError(t, err)
+	dataDir := t.TempDir()
+	config1.Raft.DataDir = dataDir
+	config2.Raft.DataDir = dataDir
 	go func() {
 		Start(config1)
 	}()
 	Start(config2)
 
-}
\ No newline at end of file
+}
+func TestSetupAccess(t *testing.T) {
+	before := acl.GlobalAccessList
+	defer func() { acl.GlobalAccessList = before }()
+	defer utils.SetTrustedProxies(nil)
+
+	// 任何一项无效时返回错误，不会留下放行所有客户端的全局访问控制列表
+	invalid := []config.CherylConfig{
+		{TrustedProxies: []string{"not a cidr"}},
+		{GeoIP: config.GeoIP{Databases: []string{filepath.Join(t.TempDir(), "missing.mmdb")}}},
+		{Acl: config.AccessList{Default: "maybe"}},
+		{AutoBan: []config.BanRule{{Event: "teapot", Threshold: 1, Window: 1, BanTime: 1}}},
+	}
+	for _, conf := range invalid {
+		conf := conf
+		assert.Error(t, setupAccess(&conf))
+		assert.Same(t, before, acl.GlobalAccessList)
+	}
+
+	conf := config.CherylConfig{Acl: config.AccessList{Default: "deny", Rules: []config.AclRule{{Action: "allow", Cidr: "10.0.0.0/8"}}}}
+	assert.NoError(t, setupAccess(&conf))
+	assert.True(t, acl.GlobalAccessList.Allow("10.1.2.3"))
+	assert.False(t, acl.GlobalAccessList.Allow("192.168.1.1"))
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 
 	"github.com/qiancijun/cheryl/acl"
+	"github.com/qiancijun/cheryl/auth"
 	reverseproxy "github.com/qiancijun/cheryl/reverse_proxy"
 	"github.com/hashicorp/raft"
 	jsoniter "github.com/json-iterator/go"
@@ -12,6 +13,9 @@ import (
 type snapshot struct {
 	ProxyMap *reverseproxy.ProxyMap
 	RadixTree *acl.RadixTree
+	Nodes map[string]string
+	Quotas map[string]map[string]int64
+	Consumers []auth.Consumer
 }
 
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
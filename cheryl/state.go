@@ -8,6 +8,7 @@ type State struct {
 	ProxyMap  *reverseproxy.ProxyMap
 	RaftNode  *raftNodeInfo
 	Hs        *HttpServer
+	Nodes     *nodeRegistry
 }
 
 type StateContext struct {
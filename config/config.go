@@ -21,27 +21,122 @@ var (
 )
 
 type CherylConfig struct {
-	Name              string      `yaml:"name"`
-	SSLCertificateKey string      `yaml:"ssl_certificate_key"`
-	Location          []Location  `yaml:"location"`
-	Schema            string      `yaml:"schema"`
-	Port              int         `yaml:"port"`
-	HttpPort          int         `yaml:"http_port"`
-	SSLCertificate    string      `yaml:"ssl_certificate"`
-	HealthCheck       bool        `yaml:"tcp_health_check"`
-	LogLevel          string      `yaml:"log_level"`
-	Raft              RaftConfig  `yaml:"raft"`
-	RouterType        string      `yaml:"router_type"`
-	ReadHeaderTimeout int         `yaml:"read_header_timeout"`
-	ReadTimeout       int         `yaml:"read_timeout"`
-	IdleTimeout       int         `yaml:"idle_timeout"`
-	LoadBalance       LoadBalance `yaml:"load_balance"`
+	Name              string         `yaml:"name"`
+	SSLCertificateKey string         `yaml:"ssl_certificate_key"`
+	Location          []Location     `yaml:"location"`
+	Schema            string         `yaml:"schema"`
+	Port              int            `yaml:"port"`
+	HttpPort          int            `yaml:"http_port"`
+	SSLCertificate    string         `yaml:"ssl_certificate"`
+	HealthCheck       bool           `yaml:"tcp_health_check"`
+	HealthCheckMode   string         `yaml:"health_check_mode"`
+	LogLevel          string         `yaml:"log_level"`
+	Raft              RaftConfig     `yaml:"raft"`
+	RouterType        string         `yaml:"router_type"`
+	ReadHeaderTimeout int            `yaml:"read_header_timeout"`
+	ReadTimeout       int            `yaml:"read_timeout"`
+	IdleTimeout       int            `yaml:"idle_timeout"`
+	LoadBalance       LoadBalance    `yaml:"load_balance"`
+	QuotaHeader       string         `yaml:"quota_header"`
+	TrustedProxies    []string       `yaml:"trusted_proxies"`
+	ProxyProtocol     bool           `yaml:"proxy_protocol"`
+	AutoBan           []BanRule      `yaml:"auto_ban"`
+	GeoIP             GeoIP          `yaml:"geoip"`
+	Acl               AccessList     `yaml:"acl"`
+	Filters           []FilterConfig `yaml:"filters"`
 }
 
+/**
+*	rateLimitHeaders: 放行的请求也携带 RateLimit-* 响应头
+*	rejectBody, rejectContentType: 限流拒绝时返回的响应体和类型
+*	acl: location 的访问控制列表
+*	filters: location 的过滤器链
+*	cors: location 的跨域策略
+*	adaptive: location 的自适应并发限流
+ */
 type Location struct {
-	Pattern     string   `yaml:"pattern"`
-	ProxyPass   []string `yaml:"proxy_pass"`
-	BalanceMode string   `yaml:"balance_mode"`
+	Pattern           string         `yaml:"pattern"`
+	ProxyPass         []string       `yaml:"proxy_pass"`
+	BalanceMode       string         `yaml:"balance_mode"`
+	RateLimitHeaders  bool           `yaml:"rate_limit_headers"`
+	RejectBody        string         `yaml:"reject_body"`
+	RejectContentType string         `yaml:"reject_content_type"`
+	Acl               AccessList     `yaml:"acl"`
+	Filters           []FilterConfig `yaml:"filters"`
+	Cors              Cors           `yaml:"cors"`
+	Adaptive          Adaptive       `yaml:"adaptive"`
+}
+
+/**
+*	location 的自适应并发限流，所有转发到这个 location 的请求共用，limit 大于 0 时启用
+*	limit: 初始的并发数量，max_limit: 并发数量的上限，timeout: 超过并发数量时等待的毫秒数
+ */
+type Adaptive struct {
+	Limit    int `yaml:"limit"`
+	MaxLimit int `yaml:"max_limit"`
+	Timeout  int `yaml:"timeout"`
+}
+
+/**
+*	跨域策略，allow_origins 为空时不处理跨域请求
+*	allow_origins: 完整的源（https://app.example.com）、通配符（* 或者 https://*.example.com）或者以 ~ 开头的正则表达式，正则表达式需要匹配整个源
+*	allow_credentials: 不能和 allow_origins 中的 * 同时使用
+*	allow_methods, allow_headers: 为空或者包含 * 时允许预检请求中的所有方法和请求头
+*	expose_headers: 浏览器可以读取的响应头，max_age: 预检结果的缓存时间（秒）
+ */
+type Cors struct {
+	AllowOrigins     []string `yaml:"allow_origins"`
+	AllowMethods     []string `yaml:"allow_methods"`
+	AllowHeaders     []string `yaml:"allow_headers"`
+	ExposeHeaders    []string `yaml:"expose_headers"`
+	AllowCredentials bool     `yaml:"allow_credentials"`
+	MaxAge           int      `yaml:"max_age"`
+}
+
+/**
+*	location 的过滤器，按照配置的顺序执行
+*	name: 过滤器的名称，params: 过滤器的参数
+ */
+type FilterConfig struct {
+	Name   string            `yaml:"name"`
+	Params map[string]string `yaml:"params"`
+}
+
+/**
+*	规则按照顺序匹配，第一条匹配的规则生效，没有匹配的规则时使用默认策略
+*	default: allow 或者 deny，为空时为 allow
+ */
+type AccessList struct {
+	Default string    `yaml:"default"`
+	Rules   []AclRule `yaml:"rules"`
+}
+
+// cidr、country（ISO 国家代码）与 asn 三者只能设置一个
+type AclRule struct {
+	Action  string `yaml:"action"`
+	Cidr    string `yaml:"cidr"`
+	Country string `yaml:"country"`
+	Asn     uint   `yaml:"asn"`
+}
+
+/**
+*	databases: MaxMind 格式的国家、ASN 数据库文件，文件变化之后自动重新加载
+*	country_header: 转发给上游时携带客户端国家代码的请求头
+ */
+type GeoIP struct {
+	Databases     []string `yaml:"databases"`
+	CountryHeader string   `yaml:"country_header"`
+}
+
+/**
+*	自动封禁的规则，同一个客户端在 window 秒内发生 threshold 次 event 时封禁 ban_time 秒
+*	event: unauthorized（上游返回 401/403）、rate_limited（被限流）、not_found（返回 404）
+ */
+type BanRule struct {
+	Event     string `yaml:"event"`
+	Threshold int    `yaml:"threshold"`
+	Window    int    `yaml:"window"`
+	BanTime   int    `yaml:"ban_time"`
 }
 
 type RaftConfig struct {
@@ -106,6 +201,9 @@ func (c *CherylConfig) Validation() error {
 	if c.Schema == "https" && (len(c.SSLCertificate) == 0 || len(c.SSLCertificateKey) == 0) {
 		return errors.New("the https proxy requires ssl_certificate_key and ssl_certificate")
 	}
+	if c.HealthCheckMode != "" && c.HealthCheckMode != "local" && c.HealthCheckMode != "cluster" {
+		return fmt.Errorf("the health_check_mode \"%s\" not supported", c.HealthCheckMode)
+	}
 	return nil
 }
 
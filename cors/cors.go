@@ -0,0 +1,220 @@
+package cors
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/qiancijun/cheryl/config"
+)
+
+const (
+	AllowOrigin      string = "Access-Control-Allow-Origin"
+	AllowMethods     string = "Access-Control-Allow-Methods"
+	AllowHeaders     string = "Access-Control-Allow-Headers"
+	AllowCredentials string = "Access-Control-Allow-Credentials"
+	ExposeHeaders    string = "Access-Control-Expose-Headers"
+	MaxAge           string = "Access-Control-Max-Age"
+	RequestMethod    string = "Access-Control-Request-Method"
+	RequestHeaders   string = "Access-Control-Request-Headers"
+
+	// 以这个前缀开头的源是正则表达式
+	regexpPrefix = "~"
+)
+
+type policyKey struct{}
+
+/**
+*	location 的跨域策略，由 config.Cors 编译而来
+*	anyOrigin: 允许所有的源，返回 *，不能和 credentials 同时开启
+ */
+type Policy struct {
+	origins     map[string]bool
+	patterns    []*regexp.Regexp
+	anyOrigin   bool
+	methods     map[string]bool
+	anyMethod   bool
+	headers     map[string]bool
+	anyHeader   bool
+	expose      string
+	credentials bool
+	maxAge      int
+}
+
+// 通配符 https://*.example.com 转换为正则表达式，* 匹配一段或者多段域名
+func wildcard(origin string) (*regexp.Regexp, error) {
+	parts := strings.Split(origin, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.Compile("^" + strings.Join(parts, `[a-zA-Z0-9.-]+`) + "$")
+}
+
+func toSet(values []string, upper bool) (map[string]bool, bool) {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "*" {
+			return nil, true
+		}
+		if upper {
+			v = strings.ToUpper(v)
+		} else {
+			v = strings.ToLower(v)
+		}
+		set[v] = true
+	}
+	return set, len(set) == 0
+}
+
+// 没有配置 allow_origins 时返回 nil，表示不处理跨域请求
+func NewPolicy(conf config.Cors) (*Policy, error) {
+	if len(conf.AllowOrigins) == 0 {
+		return nil, nil
+	}
+	if conf.MaxAge < 0 {
+		return nil, fmt.Errorf("max_age can't be negative")
+	}
+	p := &Policy{
+		origins:     make(map[string]bool),
+		credentials: conf.AllowCredentials,
+		maxAge:      conf.MaxAge,
+		expose:      strings.Join(conf.ExposeHeaders, ", "),
+	}
+	for _, origin := range conf.AllowOrigins {
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.HasPrefix(origin, regexpPrefix):
+			// 正则表达式需要匹配整个源，避免 https://app.example.com.evil.net 这样的源通过
+			re, err := regexp.Compile("^(?:" + strings.TrimPrefix(origin, regexpPrefix) + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invaild origin %s: %s", origin, err.Error())
+			}
+			p.patterns = append(p.patterns, re)
+		case strings.Contains(origin, "*"):
+			re, err := wildcard(strings.ToLower(origin))
+			if err != nil {
+				return nil, fmt.Errorf("invaild origin %s: %s", origin, err.Error())
+			}
+			p.patterns = append(p.patterns, re)
+		default:
+			p.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+	// 允许所有的源并且携带凭证时，任何站点都可以读取用户的数据
+	if p.anyOrigin && p.credentials {
+		return nil, fmt.Errorf("allow_origins * can't be used with allow_credentials")
+	}
+	p.methods, p.anyMethod = toSet(conf.AllowMethods, true)
+	p.headers, p.anyHeader = toSet(conf.AllowHeaders, false)
+	return p, nil
+}
+
+func (p *Policy) AllowOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if p.anyOrigin || p.origins[strings.ToLower(origin)] {
+		return true
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(origin) || re.MatchString(strings.ToLower(origin)) {
+			return true
+		}
+	}
+	return false
+}
+
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get(RequestMethod) != ""
+}
+
+// 返回的源不是 * 时，响应随着 Origin 变化
+func (p *Policy) varyOrigin() bool {
+	return !p.anyOrigin
+}
+
+func (p *Policy) setOrigin(header http.Header, origin string) {
+	if p.varyOrigin() {
+		header.Set(AllowOrigin, origin)
+	} else {
+		header.Set(AllowOrigin, "*")
+	}
+	if p.credentials {
+		header.Set(AllowCredentials, "true")
+	}
+}
+
+/**
+*	响应预检请求，不转发给上游
+*	源、方法或者请求头不被允许时返回 403，不携带跨域响应头
+ */
+func (p *Policy) Preflight(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	method := strings.ToUpper(r.Header.Get(RequestMethod))
+	requested := make([]string, 0)
+	for _, value := range r.Header.Values(RequestHeaders) {
+		for _, h := range strings.Split(value, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				requested = append(requested, h)
+			}
+		}
+	}
+	allowed := p.AllowOrigin(origin) && (p.anyMethod || p.methods[method])
+	for _, h := range requested {
+		allowed = allowed && (p.anyHeader || p.headers[strings.ToLower(h)])
+	}
+	header := w.Header()
+	header.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	if !allowed {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	p.setOrigin(header, origin)
+	header.Set(AllowMethods, method)
+	if len(requested) > 0 {
+		header.Set(AllowHeaders, strings.Join(requested, ", "))
+	}
+	if p.maxAge > 0 {
+		header.Set(MaxAge, strconv.Itoa(p.maxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 为实际的请求设置跨域响应头，没有携带 Origin 或者源不被允许时只设置 Vary
+func (p *Policy) SetHeaders(header http.Header, origin string) bool {
+	if p.varyOrigin() {
+		header.Add("Vary", "Origin")
+	}
+	if !p.AllowOrigin(origin) {
+		return false
+	}
+	p.setOrigin(header, origin)
+	if p.expose != "" {
+		header.Set(ExposeHeaders, p.expose)
+	}
+	return true
+}
+
+// 删除上游返回的跨域响应头，统一使用网关的策略
+func StripHeaders(header http.Header) {
+	for key := range header {
+		if strings.HasPrefix(key, "Access-Control-") {
+			header.Del(key)
+		}
+	}
+}
+
+// 在转发的请求中记录已经处理过跨域，ModifyResponse 通过 Handled 判断是否删除上游的跨域响应头
+func WithPolicy(r *http.Request, p *Policy) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), policyKey{}, p))
+}
+
+func Handled(r *http.Request) bool {
+	p, _ := r.Context().Value(policyKey{}).(*Policy)
+	return p != nil
+}
@@ -0,0 +1,107 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func preflight(origin, method, headers string) *http.Request {
+	r := httptest.NewRequest(http.MethodOptions, "/api/users", nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set(RequestMethod, method)
+	if headers != "" {
+		r.Header.Set(RequestHeaders, headers)
+	}
+	return r
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := NewPolicy(config.Cors{})
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+	_, err = NewPolicy(config.Cors{AllowOrigins: []string{"~(["}})
+	assert.Error(t, err)
+	// 任意源不能携带凭证
+	_, err = NewPolicy(config.Cors{AllowOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true})
+	assert.Error(t, err)
+
+	p, err = NewPolicy(config.Cors{
+		AllowOrigins:     []string{"https://app.example.com", "https://*.example.org", `~^https://pr-[0-9]+\.preview\.dev$`, `~https://admin\.example\.net`},
+		AllowMethods:     []string{"GET", "post"},
+		AllowHeaders:     []string{"Content-Type", "Authorization"},
+		ExposeHeaders:    []string{"X-Request-Id"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	})
+	assert.NoError(t, err)
+	cases := map[string]bool{
+		"https://app.example.com":       true,
+		"https://APP.example.com":       true,
+		"https://a.b.example.org":       true,
+		"https://example.org":           false,
+		"https://evil.com/.example.org": false,
+		"https://pr-42.preview.dev":     true,
+		"https://pr-x.preview.dev":      false,
+		"http://app.example.com":        false,
+		"":                              false,
+		// 没有锚定的正则表达式也要匹配整个源
+		"https://admin.example.net":                  true,
+		"https://admin.example.net.evil.com":         false,
+		"https://evil.com/https://admin.example.net": false,
+	}
+	for origin, expected := range cases {
+		assert.Equal(t, expected, p.AllowOrigin(origin), origin)
+	}
+
+	w := httptest.NewRecorder()
+	p.Preflight(w, preflight("https://app.example.com", "POST", "content-type, authorization"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get(AllowOrigin))
+	assert.Equal(t, "true", w.Header().Get(AllowCredentials))
+	assert.Equal(t, "POST", w.Header().Get(AllowMethods))
+	assert.Equal(t, "content-type, authorization", w.Header().Get(AllowHeaders))
+	assert.Equal(t, "600", w.Header().Get(MaxAge))
+
+	for _, r := range []*http.Request{
+		preflight("https://evil.com", "GET", ""),
+		preflight("https://app.example.com", "DELETE", ""),
+		preflight("https://app.example.com", "GET", "X-Debug"),
+	} {
+		w := httptest.NewRecorder()
+		p.Preflight(w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, w.Header().Get(AllowOrigin))
+	}
+
+	header := http.Header{}
+	assert.True(t, p.SetHeaders(header, "https://pr-7.preview.dev"))
+	assert.Equal(t, "https://pr-7.preview.dev", header.Get(AllowOrigin))
+	assert.Equal(t, "X-Request-Id", header.Get(ExposeHeaders))
+	assert.Equal(t, "Origin", header.Get("Vary"))
+	header = http.Header{}
+	assert.False(t, p.SetHeaders(header, "https://evil.com"))
+	assert.Empty(t, header.Get(AllowOrigin))
+	assert.Equal(t, "Origin", header.Get("Vary"))
+}
+
+func TestPolicyAnyOrigin(t *testing.T) {
+	p, err := NewPolicy(config.Cors{AllowOrigins: []string{"*"}})
+	assert.NoError(t, err)
+	// 没有限制方法和请求头时允许预检请求中的所有方法和请求头
+	w := httptest.NewRecorder()
+	p.Preflight(w, preflight("https://any.site", "PATCH", "X-Custom"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "*", w.Header().Get(AllowOrigin))
+	assert.Equal(t, "PATCH", w.Header().Get(AllowMethods))
+	assert.Equal(t, "X-Custom", w.Header().Get(AllowHeaders))
+
+	header := http.Header{}
+	assert.True(t, p.SetHeaders(header, "https://any.site"))
+	assert.Equal(t, "*", header.Get(AllowOrigin))
+	assert.Empty(t, header.Get("Vary"))
+	assert.False(t, IsPreflight(httptest.NewRequest(http.MethodOptions, "/", nil)))
+}
@@ -0,0 +1,208 @@
+package filter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/qiancijun/cheryl/config"
+)
+
+const (
+	SET_HEADER    string = "set-header"
+	REMOVE_HEADER string = "remove-header"
+	APPEND_HEADER string = "append-header"
+	REQUEST_ID    string = "request-id"
+	MAX_BODY_SIZE string = "max-body-size"
+	ALLOW_METHODS string = "allow-methods"
+
+	DefaultRequestIDHeader = "X-Request-ID"
+)
+
+var (
+	FilterNotSupportedError = errors.New("filter not supported")
+
+	filterFactories         = make(map[string]FilterFactory)
+	middlewareFactories     = make(map[string]MiddlewareFactory)
+	responseFilterFactories = make(map[string]ResponseFilterFactory)
+)
+
+// 根据配置中的参数创建过滤器
+type FilterFactory func(params map[string]string) (FilterFunc, error)
+
+type MiddlewareFactory func(params map[string]string) (Middleware, error)
+
+type ResponseFilterFactory func(params map[string]string) (ResponseFunc, error)
+
+func init() {
+	RegisterFilter(SET_HEADER, newHeaderFilter(SET_HEADER))
+	RegisterFilter(REMOVE_HEADER, newHeaderFilter(REMOVE_HEADER))
+	RegisterFilter(APPEND_HEADER, newHeaderFilter(APPEND_HEADER))
+	RegisterFilter(REQUEST_ID, newRequestIDFilter)
+	RegisterFilter(MAX_BODY_SIZE, newMaxBodySizeFilter)
+	RegisterFilter(ALLOW_METHODS, newAllowMethodsFilter)
+}
+
+func RegisterFilter(name string, factory FilterFactory) {
+	filterFactories[name] = factory
+}
+
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareFactories[name] = factory
+}
+
+func RegisterResponseFilter(name string, factory ResponseFilterFactory) {
+	responseFilterFactories[name] = factory
+}
+
+func GetFilterNames() []string {
+	res := make([]string, 0, len(filterFactories)+len(middlewareFactories)+len(responseFilterFactories))
+	for name := range filterFactories {
+		res = append(res, name)
+	}
+	for name := range middlewareFactories {
+		res = append(res, name)
+	}
+	for name := range responseFilterFactories {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func newFilter(conf config.FilterConfig) (*Filter, error) {
+	if factory, has := filterFactories[conf.Name]; has {
+		fun, err := factory(conf.Params)
+		if err != nil {
+			return nil, err
+		}
+		return NewFilter(fun), nil
+	}
+	if factory, has := middlewareFactories[conf.Name]; has {
+		fun, err := factory(conf.Params)
+		if err != nil {
+			return nil, err
+		}
+		return NewMiddleware(fun), nil
+	}
+	if factory, has := responseFilterFactories[conf.Name]; has {
+		fun, err := factory(conf.Params)
+		if err != nil {
+			return nil, err
+		}
+		return NewResponseFilter(fun), nil
+	}
+	return nil, FilterNotSupportedError
+}
+
+// 按照配置的顺序创建过滤器链，没有配置过滤器时返回 nil
+func NewFilterChain(confs []config.FilterConfig) (*Filter, error) {
+	var head, tail *Filter
+	for _, conf := range confs {
+		cur, err := newFilter(conf)
+		if err == FilterNotSupportedError {
+			return nil, fmt.Errorf("%w: %s", err, conf.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %s", conf.Name, err.Error())
+		}
+		if head == nil {
+			head = cur
+		} else {
+			tail.next = cur
+		}
+		tail = cur
+	}
+	return head, nil
+}
+
+// 修改转发给上游的请求头，name 为请求头的名称，value 为值
+func newHeaderFilter(op string) FilterFactory {
+	return func(params map[string]string) (FilterFunc, error) {
+		name := http.CanonicalHeaderKey(params["name"])
+		if name == "" {
+			return nil, errors.New("header name can't be empty")
+		}
+		value := params["value"]
+		return func(w http.ResponseWriter, r *http.Request) error {
+			switch op {
+			case SET_HEADER:
+				r.Header.Set(name, value)
+			case REMOVE_HEADER:
+				r.Header.Del(name)
+			case APPEND_HEADER:
+				r.Header.Add(name, value)
+			}
+			return nil
+		}, nil
+	}
+}
+
+/**
+*	请求没有携带 header 时生成一个随机的请求 ID，
+*	同时写入转发给上游的请求以及返回给客户端的响应
+ */
+func newRequestIDFilter(params map[string]string) (FilterFunc, error) {
+	header := http.CanonicalHeaderKey(params["header"])
+	if header == "" {
+		header = DefaultRequestIDHeader
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id := r.Header.Get(header)
+		if id == "" {
+			buf := make([]byte, 16)
+			if _, err := rand.Read(buf); err != nil {
+				return err
+			}
+			id = hex.EncodeToString(buf)
+			r.Header.Set(header, id)
+		}
+		w.Header().Set(header, id)
+		return nil
+	}, nil
+}
+
+// size 为请求体的最大字节数，没有 Content-Length 的请求在读取超过限制时失败
+func newMaxBodySizeFilter(params map[string]string) (FilterFunc, error) {
+	size, err := strconv.ParseInt(params["size"], 10, 64)
+	if err != nil || size < 0 {
+		return nil, errors.New("size must be a non-negative integer")
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if r.ContentLength > size {
+			return Reject(http.StatusRequestEntityTooLarge, "request body too large")
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, size)
+		}
+		return nil
+	}, nil
+}
+
+// methods 为逗号分隔的请求方法
+func newAllowMethodsFilter(params map[string]string) (FilterFunc, error) {
+	allowed := make(map[string]bool)
+	names := make([]string, 0)
+	for _, method := range strings.Split(params["methods"], ",") {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method != "" && !allowed[method] {
+			allowed[method] = true
+			names = append(names, method)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, errors.New("methods can't be empty")
+	}
+	allow := strings.Join(names, ", ")
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if !allowed[r.Method] {
+			return Reject(http.StatusMethodNotAllowed, "method not allowed").WithHeader("Allow", allow)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,138 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/qiancijun/cheryl/auth"
+)
+
+const (
+	CONSUMER_AUTH string = "consumer-auth"
+
+	KEY_AUTH   string = "key"
+	BASIC_AUTH string = "basic"
+
+	ConsumerHeader       = "X-Consumer-Name"
+	ConsumerGroupsHeader = "X-Consumer-Groups"
+)
+
+func init() {
+	RegisterMiddleware(CONSUMER_AUTH, newConsumerAuthFilter)
+}
+
+type consumerAuthFilter struct {
+	key       bool
+	basic     bool
+	keyHeader string
+	keyQuery  string
+	consumers []string
+	groups    []string
+	realm     string
+	hide      bool
+}
+
+/**
+*	使用消费者的 API Key 或者 basic 认证凭证认证请求
+*	methods: key、basic 或者 key,basic（默认），key_header: 携带 API Key 的请求头，默认为 X-API-Key
+*	key_query: 也可以从这个查询参数中读取 API Key；consumers / groups: 只允许这些消费者或者分组访问
+*	hide_credentials: 为 true 时不把凭证转发给上游
+*	通过认证之后 X-Consumer-Name 与 X-Consumer-Groups 转发给上游，客户端携带的同名请求头会被删除
+ */
+func newConsumerAuthFilter(params map[string]string) (Middleware, error) {
+	f := &consumerAuthFilter{
+		keyHeader: http.CanonicalHeaderKey(params["key_header"]),
+		keyQuery:  params["key_query"],
+		consumers: splitList(params["consumers"]),
+		groups:    splitList(params["groups"]),
+		realm:     params["realm"],
+		hide:      params["hide_credentials"] == "true",
+	}
+	methods := splitList(params["methods"])
+	if len(methods) == 0 {
+		methods = []string{KEY_AUTH, BASIC_AUTH}
+	}
+	for _, method := range methods {
+		switch method {
+		case KEY_AUTH:
+			f.key = true
+		case BASIC_AUTH:
+			f.basic = true
+		default:
+			return nil, fmt.Errorf("auth method %s not supported", method)
+		}
+	}
+	if f.keyHeader == "" {
+		f.keyHeader = "X-API-Key"
+	}
+	if f.realm == "" {
+		f.realm = "cheryl"
+	}
+	return f.filter, nil
+}
+
+func (f *consumerAuthFilter) reject(status int) error {
+	err := Reject(status, "")
+	if f.basic && status == http.StatusUnauthorized {
+		err.WithHeader("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", f.realm))
+	}
+	return err
+}
+
+// 按照 API Key、basic 认证的顺序查找凭证对应的消费者
+func (f *consumerAuthFilter) authenticate(r *http.Request) (*auth.Consumer, bool) {
+	if f.key {
+		key := r.Header.Get(f.keyHeader)
+		if key == "" && f.keyQuery != "" {
+			key = r.URL.Query().Get(f.keyQuery)
+		}
+		if key != "" {
+			return auth.Consumers.AuthenticateKey(key)
+		}
+	}
+	if f.basic {
+		if username, password, ok := r.BasicAuth(); ok {
+			return auth.Consumers.AuthenticateBasic(username, password)
+		}
+	}
+	return nil, false
+}
+
+func (f *consumerAuthFilter) allowed(c *auth.Consumer) bool {
+	if len(f.consumers) == 0 && len(f.groups) == 0 {
+		return true
+	}
+	for _, name := range f.consumers {
+		if name == c.Name {
+			return true
+		}
+	}
+	return c.InGroup(f.groups...)
+}
+
+func (f *consumerAuthFilter) filter(w http.ResponseWriter, r *http.Request, next Next) error {
+	r.Header.Del(ConsumerHeader)
+	r.Header.Del(ConsumerGroupsHeader)
+	consumer, ok := f.authenticate(r)
+	if !ok {
+		return f.reject(http.StatusUnauthorized)
+	}
+	if !f.allowed(consumer) {
+		return f.reject(http.StatusForbidden)
+	}
+	if f.hide {
+		r.Header.Del(f.keyHeader)
+		r.Header.Del("Authorization")
+		if f.keyQuery != "" {
+			query := r.URL.Query()
+			query.Del(f.keyQuery)
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+	r.Header.Set(ConsumerHeader, consumer.Name)
+	if len(consumer.Groups) > 0 {
+		r.Header.Set(ConsumerGroupsHeader, strings.Join(consumer.Groups, ","))
+	}
+	return next(w, auth.WithConsumer(r, consumer.Name))
+}
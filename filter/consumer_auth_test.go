@@ -0,0 +1,75 @@
+package filter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qiancijun/cheryl/auth"
+	"github.com/qiancijun/cheryl/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestConsumerAuthFilter(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	auth.Consumers = auth.NewRegistry()
+	defer func() { auth.Consumers = auth.NewRegistry() }()
+	assert.NoError(t, auth.Consumers.Set(auth.Consumer{Name: "alice", Groups: []string{"partners"}, Keys: []string{auth.HashKey("key-1")}}))
+	assert.NoError(t, auth.Consumers.Set(auth.Consumer{Name: "bob", Username: "bob", Password: string(hash)}))
+
+	_, err = NewFilterChain([]config.FilterConfig{{Name: CONSUMER_AUTH, Params: map[string]string{"methods": "oauth"}}})
+	assert.Error(t, err)
+	chain, err := NewFilterChain([]config.FilterConfig{{Name: CONSUMER_AUTH, Params: map[string]string{
+		"key_query":        "apikey",
+		"groups":           "partners",
+		"consumers":        "bob",
+		"hide_credentials": "true",
+	}}})
+	assert.NoError(t, err)
+
+	run := func(setup func(r *http.Request)) (*httptest.ResponseRecorder, *http.Request, error) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/users?page=1", nil)
+		r.Header.Set(ConsumerHeader, "spoofed")
+		setup(r)
+		final, err := serve(chain, w, r)
+		if final == nil {
+			final = r
+		}
+		return w, final, err
+	}
+
+	_, r, err := run(func(r *http.Request) { r.Header.Set("X-API-Key", "key-1") })
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", auth.ConsumerOf(r))
+	assert.Equal(t, "alice", r.Header.Get(ConsumerHeader))
+	assert.Equal(t, "partners", r.Header.Get(ConsumerGroupsHeader))
+	assert.Empty(t, r.Header.Get("X-API-Key"))
+
+	_, r, err = run(func(r *http.Request) { r.URL.RawQuery = "page=1&apikey=key-1" })
+	assert.NoError(t, err)
+	assert.Equal(t, "page=1", r.URL.RawQuery)
+
+	_, r, err = run(func(r *http.Request) { r.SetBasicAuth("bob", "secret") })
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", auth.ConsumerOf(r))
+	assert.Empty(t, r.Header.Get("Authorization"))
+
+	for _, setup := range []func(r *http.Request){
+		func(r *http.Request) {},
+		func(r *http.Request) { r.Header.Set("X-API-Key", "key-2") },
+		func(r *http.Request) { r.SetBasicAuth("bob", "wrong") },
+	} {
+		_, r, err := run(setup)
+		assert.Equal(t, http.StatusUnauthorized, err.(*FilterError).Status)
+		assert.Equal(t, `Basic realm="cheryl"`, err.(*FilterError).Header.Get("WWW-Authenticate"))
+		assert.Empty(t, r.Header.Get(ConsumerHeader))
+	}
+
+	// 不在允许的消费者和分组中
+	assert.NoError(t, auth.Consumers.Set(auth.Consumer{Name: "carol", Keys: []string{auth.HashKey("key-3")}}))
+	_, _, err = run(func(r *http.Request) { r.Header.Set("X-API-Key", "key-3") })
+	assert.Equal(t, http.StatusForbidden, err.(*FilterError).Status)
+}
@@ -1,55 +1,241 @@
 package filter
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"sync/atomic"
+
+	"github.com/qiancijun/cheryl/logger"
 )
 
+// 只在请求阶段执行的过滤器，返回 nil 时继续执行之后的过滤器
 type FilterFunc func(w http.ResponseWriter, r *http.Request) error
 
+// 执行之后的过滤器，最后一个过滤器之后是路由的转发
+type Next func(w http.ResponseWriter, r *http.Request) error
+
+/**
+*	中间件形式的过滤器，可以在 next 的前后执行，也可以把 r.WithContext 之后的请求传给 next，
+*	之后的过滤器和转发都使用新的请求。过滤器的返回值：
+*	调用 next：返回 next 的结果
+*	不调用 next 并且返回 nil：过滤器已经自己写入了响应
+*	不调用 next 并且返回 *FilterError：拒绝请求，由路由按照其中的状态码、响应头和响应体写入响应
+*	其他错误按照 500 处理
+ */
+type Middleware func(w http.ResponseWriter, r *http.Request, next Next) error
+
+// 响应阶段的过滤器，在上游返回响应之后、写回客户端之前执行
+type ResponseFunc func(resp *http.Response) error
+
+// middleware 与 response 分别在请求阶段和响应阶段执行，可以只设置其中一个
 type Filter struct {
-	fun  FilterFunc
-	next *Filter
+	middleware Middleware
+	response   ResponseFunc
+	next       *Filter
 }
 
-var (
-	FilterChain *Filter
-)
+type chainKey struct{}
+
+type valueKey string
+
+// atomic.Value 不能保存 nil，使用结构体包装
+type chainHolder struct {
+	chain *Filter
+}
+
+var globalChain atomic.Value
+
+func init() {
+	globalChain.Store(chainHolder{})
+}
 
 func NewFilter(fun FilterFunc) *Filter {
+	return NewMiddleware(func(w http.ResponseWriter, r *http.Request, next Next) error {
+		if err := fun(w, r); err != nil {
+			return err
+		}
+		return next(w, r)
+	})
+}
+
+func NewMiddleware(fun Middleware) *Filter {
+	return &Filter{
+		middleware: fun,
+	}
+}
+
+func NewResponseFilter(fun ResponseFunc) *Filter {
 	return &Filter{
-		fun: fun,
-		next: nil,
+		response: fun,
 	}
 }
 
-func CreateFilterChain(filters... *Filter) {
-	if len(filters) == 0 {
+// 复制过滤器组成新的链，不会修改传入的过滤器，正在执行的链不受影响
+func Chain(filters ...*Filter) *Filter {
+	var head, tail *Filter
+	for _, f := range filters {
+		for ; f != nil; f = f.next {
+			cur := &Filter{middleware: f.middleware, response: f.response}
+			if head == nil {
+				head = cur
+			} else {
+				tail.next = cur
+			}
+			tail = cur
+		}
+	}
+	return head
+}
+
+func CreateFilterChain(filters ...*Filter) {
+	SetGlobalChain(Chain(filters...))
+}
+
+// 原子地替换全局过滤器链，已经开始执行的请求继续使用旧的链
+func SetGlobalChain(f *Filter) {
+	globalChain.Store(chainHolder{f})
+}
+
+func GlobalChain() *Filter {
+	return globalChain.Load().(chainHolder).chain
+}
+
+// 按照顺序执行过滤器，所有过滤器都调用了 next 时执行 final
+func (f *Filter) Serve(w http.ResponseWriter, r *http.Request, final Next) error {
+	for f != nil && f.middleware == nil {
+		f = f.next
+	}
+	if f == nil {
+		return final(w, r)
+	}
+	next := f.next
+	return f.middleware(w, r, func(w http.ResponseWriter, r *http.Request) error {
+		return next.Serve(w, r, final)
+	})
+}
+
+/**
+*	执行过滤器链并且写入拒绝的响应，final 执行之后过滤器返回的错误只记录日志，
+*	因为响应已经开始写入
+ */
+func (f *Filter) Run(w http.ResponseWriter, r *http.Request, final http.HandlerFunc) {
+	served := false
+	err := f.Serve(w, r, func(w http.ResponseWriter, r *http.Request) error {
+		served = true
+		final(w, r)
+		return nil
+	})
+	if err == nil {
 		return
 	}
-	if len(filters) == 1 {
-		FilterChain = filters[0]
+	if served {
+		logger.Warnf("filter returned an error after the response was written: %s", err.Error())
+		return
 	}
-	head, tail := filters[0], filters[0]
-	for i := 1; i < len(filters); i++ {
-		cur := filters[i]
-		tail.next = cur
-		tail = tail.next
+	WriteError(w, err)
+}
+
+// 按照顺序执行响应阶段的过滤器
+func (f *Filter) ExecuteResponse(resp *http.Response) error {
+	for root := f; root != nil; root = root.next {
+		if root.response == nil {
+			continue
+		}
+		if err := root.response(resp); err != nil {
+			return err
+		}
 	}
-	FilterChain = head
+	return nil
 }
 
-func ExecuteFilterChain(w http.ResponseWriter, r *http.Request) error {
-	if FilterChain == nil {
+/**
+*	在转发的请求中记录执行的过滤器链，ModifyResponse 通过 ExecuteResponse 执行它们的响应阶段
+*	全局过滤器链先记录，location 的过滤器链后记录
+ */
+func WithChain(r *http.Request, f *Filter) *http.Request {
+	if f == nil {
+		return r
+	}
+	chains, _ := r.Context().Value(chainKey{}).([]*Filter)
+	chains = append(chains[:len(chains):len(chains)], f)
+	return r.WithContext(context.WithValue(r.Context(), chainKey{}, chains))
+}
+
+// 响应由内向外经过过滤器链，先执行 location 的过滤器链，再执行全局的过滤器链
+func ExecuteResponse(resp *http.Response) error {
+	if resp.Request == nil {
 		return nil
 	}
-	var err error
-	root := FilterChain
-	for root != nil {
-		err = root.fun(w, r)
-		if err != nil {
+	chains, _ := resp.Request.Context().Value(chainKey{}).([]*Filter)
+	for i := len(chains) - 1; i >= 0; i-- {
+		if err := chains[i].ExecuteResponse(resp); err != nil {
 			return err
 		}
-		root = root.next
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// 过滤器之间传递的值，把返回的请求传给 next 之后，之后的过滤器可以通过 Value 读取
+func WithValue(r *http.Request, key string, value interface{}) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), valueKey(key), value))
+}
+
+func Value(r *http.Request, key string) interface{} {
+	return r.Context().Value(valueKey(key))
+}
+
+/**
+*	过滤器拒绝请求时返回的错误，路由按照 Status、Header 和 Msg 写入响应
+*	Status 为 0 时返回 403，Msg 为空时使用状态码的描述
+ */
+type FilterError struct {
+	Status int
+	Header http.Header
+	Msg    string
+}
+
+func (e *FilterError) Error() string {
+	if e.Msg == "" {
+		return http.StatusText(e.status())
+	}
+	return e.Msg
+}
+
+func (e *FilterError) status() int {
+	if e.Status <= 0 {
+		return http.StatusForbidden
+	}
+	return e.Status
+}
+
+func Reject(status int, msg string) *FilterError {
+	return &FilterError{Status: status, Msg: msg}
+}
+
+func (e *FilterError) WithHeader(key, value string) *FilterError {
+	if e.Header == nil {
+		e.Header = make(http.Header)
+	}
+	e.Header.Set(key, value)
+	return e
+}
+
+// 写入过滤器拒绝请求的响应，不是 FilterError 的错误不把错误信息返回给客户端
+func WriteError(w http.ResponseWriter, err error) {
+	var filterErr *FilterError
+	if !errors.As(err, &filterErr) {
+		logger.Warnf("filter error: %s", err.Error())
+		filterErr = &FilterError{Status: http.StatusInternalServerError}
+	}
+	header := w.Header()
+	for key, values := range filterErr.Header {
+		header[key] = values
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(filterErr.status())
+	w.Write([]byte(filterErr.Error()))
+}
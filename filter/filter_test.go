@@ -0,0 +1,142 @@
+package filter
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 执行过滤器链，返回到达末尾的请求，没有到达末尾时为 nil
+func serve(chain *Filter, w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	var final *http.Request
+	err := chain.Serve(w, r, func(w http.ResponseWriter, r *http.Request) error {
+		final = r
+		return nil
+	})
+	return final, err
+}
+
+func TestFilterChain(t *testing.T) {
+	order := make([]string, 0)
+	trace := func(name string) *Filter {
+		return NewMiddleware(func(w http.ResponseWriter, r *http.Request, next Next) error {
+			order = append(order, name+" before")
+			err := next(w, WithValue(r, name, true))
+			order = append(order, name+" after")
+			return err
+		})
+	}
+	chain := Chain(trace("a"), NewResponseFilter(func(resp *http.Response) error { return nil }), trace("b"))
+	final, err := serve(chain, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a before", "b before", "b after", "a after"}, order)
+	// 之前的过滤器传递的值
+	assert.Equal(t, true, Value(final, "a"))
+	assert.Equal(t, true, Value(final, "b"))
+	assert.Nil(t, Value(final, "c"))
+
+	// 空的过滤器链直接执行 final
+	final, err = serve(nil, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	assert.NotNil(t, final)
+}
+
+func TestFilterRun(t *testing.T) {
+	reject := NewFilter(func(w http.ResponseWriter, r *http.Request) error {
+		if r.URL.Path == "/reject" {
+			return Reject(http.StatusTeapot, "no coffee").WithHeader("Retry-After", "60")
+		}
+		if r.URL.Path == "/fail" {
+			return errors.New("internal detail")
+		}
+		return nil
+	})
+	// 自己写入响应并且不调用 next
+	handled := NewMiddleware(func(w http.ResponseWriter, r *http.Request, next Next) error {
+		if r.URL.Path == "/handled" {
+			w.WriteHeader(http.StatusAccepted)
+			return nil
+		}
+		return next(w, r)
+	})
+	// 在 next 之后返回错误，此时响应已经写入
+	late := NewMiddleware(func(w http.ResponseWriter, r *http.Request, next Next) error {
+		next(w, r)
+		return Reject(http.StatusForbidden, "too late")
+	})
+
+	run := func(chain *Filter, path string) (*httptest.ResponseRecorder, bool) {
+		w := httptest.NewRecorder()
+		served := false
+		chain.Run(w, httptest.NewRequest("GET", path, nil), func(w http.ResponseWriter, r *http.Request) {
+			served = true
+			w.Write([]byte("upstream"))
+		})
+		return w, served
+	}
+	chain := Chain(reject, handled)
+	w, served := run(chain, "/reject")
+	assert.False(t, served)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Equal(t, "no coffee", w.Body.String())
+
+	w, served = run(chain, "/fail")
+	assert.False(t, served)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.False(t, strings.Contains(w.Body.String(), "internal detail"))
+
+	w, served = run(chain, "/handled")
+	assert.False(t, served)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	w, served = run(chain, "/ok")
+	assert.True(t, served)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w, served = run(Chain(late), "/ok")
+	assert.True(t, served)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "upstream", w.Body.String())
+
+	w = httptest.NewRecorder()
+	WriteError(w, &FilterError{})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "Forbidden", w.Body.String())
+}
+
+func TestGlobalChain(t *testing.T) {
+	defer SetGlobalChain(nil)
+	a := NewFilter(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	b := NewFilter(func(w http.ResponseWriter, r *http.Request) error { return Reject(http.StatusForbidden, "") })
+	CreateFilterChain(a, b)
+	// Chain 复制过滤器，不修改传入的过滤器
+	assert.Nil(t, a.next)
+	_, err := serve(GlobalChain(), httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Error(t, err)
+
+	// 并发执行的同时替换全局过滤器链
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if i == 0 {
+					SetGlobalChain(Chain(a))
+					continue
+				}
+				serve(GlobalChain(), httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+		}(i)
+	}
+	wg.Wait()
+	SetGlobalChain(Chain(a))
+	_, err = serve(GlobalChain(), httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,550 @@
+package filter
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	JWT string = "jwt"
+
+	// 过滤器之间传递 JWT 声明的键，值的类型为 map[string]interface{}
+	JWT_CLAIMS = "jwt-claims"
+
+	RS256 string = "RS256"
+	ES256 string = "ES256"
+	HS256 string = "HS256"
+
+	// 针对单个路由的 scope 参数的前缀，例如 "scopes:/admin/**": "admin"
+	routeScopesPrefix = "scopes:"
+)
+
+// 未知的 kid 触发重新加载 JWKS 文件的最小间隔
+var JWKSReloadInterval = 10 * time.Second
+
+var (
+	InvalidTokenError  = errors.New("invalid token")
+	TokenExpiredError  = errors.New("token is expired")
+	NoMatchingKeyError = errors.New("no matching key")
+)
+
+func init() {
+	RegisterMiddleware(JWT, newJWTFilter)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+type verifyKey struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+// 文件中的密钥在遇到未知的 kid 并且文件发生变化时重新加载
+type keySet struct {
+	sync.RWMutex
+	file    string
+	modTime time.Time
+	checked time.Time // 上一次因为未知的 kid 检查文件的时间
+	// 配置中的密钥与文件中的密钥分开保存，重新加载时只替换后者
+	keys     []verifyKey
+	fileKeys []verifyKey
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func parseJWK(jwk jsonWebKey) (verifyKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeSegment(jwk.N)
+		if err != nil {
+			return verifyKey{}, err
+		}
+		e, err := decodeSegment(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return verifyKey{}, errors.New("invalid rsa exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return verifyKey{jwk.Kid, RS256, key}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return verifyKey{}, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeSegment(jwk.X)
+		if err != nil {
+			return verifyKey{}, err
+		}
+		y, err := decodeSegment(jwk.Y)
+		if err != nil {
+			return verifyKey{}, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return verifyKey{}, errors.New("invalid ec point")
+		}
+		return verifyKey{jwk.Kid, ES256, key}, nil
+	case "oct":
+		k, err := decodeSegment(jwk.K)
+		if err != nil || len(k) == 0 {
+			return verifyKey{}, errors.New("invalid symmetric key")
+		}
+		return verifyKey{jwk.Kid, HS256, k}, nil
+	}
+	return verifyKey{}, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+func parseJWKS(data []byte) ([]verifyKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := jsoniter.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make([]verifyKey, 0, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		key, err := parseJWK(jwk)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", jwk.Kid, err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// 检查与替换都在锁内完成，并发的未知 kid 请求只会重新加载一次
+func (s *keySet) load() error {
+	s.Lock()
+	defer s.Unlock()
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	s.fileKeys = keys
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// kid 为空时返回所有算法匹配的密钥
+func (s *keySet) find(kid, alg string) []verifyKey {
+	s.RLock()
+	defer s.RUnlock()
+	res := make([]verifyKey, 0, 1)
+	for _, keys := range [][]verifyKey{s.fileKeys, s.keys} {
+		for _, key := range keys {
+			if key.alg == alg && (kid == "" || key.kid == kid) {
+				res = append(res, key)
+			}
+		}
+	}
+	return res
+}
+
+/**
+*	未知的 kid 在每个 JWKSReloadInterval 内最多触发一次重新加载，其余的请求直接拒绝，
+*	避免随机的 kid 让所有的校验都等待重新加载的锁
+ */
+func (s *keySet) reload() bool {
+	s.RLock()
+	recent := time.Since(s.checked) < JWKSReloadInterval
+	s.RUnlock()
+	if recent {
+		return false
+	}
+	s.Lock()
+	if time.Since(s.checked) < JWKSReloadInterval {
+		s.Unlock()
+		return false
+	}
+	s.checked = time.Now()
+	s.Unlock()
+	return s.load() == nil
+}
+
+func (s *keySet) lookup(kid, alg string) []verifyKey {
+	keys := s.find(kid, alg)
+	if len(keys) == 0 && s.file != "" && s.reload() {
+		keys = s.find(kid, alg)
+	}
+	return keys
+}
+
+func verifySignature(key verifyKey, signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch k := key.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, digest[:], r, s)
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+	return false
+}
+
+// 校验签名并且返回载荷，只接受 RS256、ES256 和 HS256，密钥的类型必须与算法一致
+func (s *keySet) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, InvalidTokenError
+	}
+	headerData, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, InvalidTokenError
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := jsoniter.Unmarshal(headerData, &header); err != nil {
+		return nil, InvalidTokenError
+	}
+	if header.Alg != RS256 && header.Alg != ES256 && header.Alg != HS256 {
+		return nil, fmt.Errorf("unsupported algorithm %s", header.Alg)
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, InvalidTokenError
+	}
+	keys := s.lookup(header.Kid, header.Alg)
+	if len(keys) == 0 {
+		return nil, NoMatchingKeyError
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if verifySignature(key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, InvalidTokenError
+	}
+	claims := make(map[string]interface{})
+	decoder := jsoniter.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, InvalidTokenError
+	}
+	return claims, nil
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool, error) {
+	v, has := claims[name]
+	if !has {
+		return 0, false, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, true, fmt.Errorf("invalid %s claim", name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return 0, true, fmt.Errorf("invalid %s claim", name)
+	}
+	return int64(f), true, nil
+}
+
+// 字符串或者字符串数组形式的声明
+func stringsClaim(v interface{}, sep string) []string {
+	switch value := v.(type) {
+	case string:
+		if sep == "" {
+			return []string{value}
+		}
+		return strings.Fields(value)
+	case []interface{}:
+		res := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+func claimValue(v interface{}) (string, bool) {
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	case []interface{}:
+		return strings.Join(stringsClaim(value, ""), ","), true
+	}
+	return "", false
+}
+
+// 读取 jwt 过滤器校验通过的声明，请求没有经过 jwt 过滤器或者没有这个声明时返回 false
+func JWTClaim(r *http.Request, name string) (string, bool) {
+	claims, ok := Value(r, JWT_CLAIMS).(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	return claimValue(claims[name])
+}
+
+func splitList(s string) []string {
+	res := make([]string, 0)
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		res = append(res, item)
+	}
+	return res
+}
+
+type routeScopes struct {
+	pattern string
+	scopes  []string
+}
+
+// 以 /** 结尾的模式匹配该前缀下所有的路径，否则按照 path.Match 匹配
+func (r routeScopes) match(p string) bool {
+	if strings.HasSuffix(r.pattern, "/**") {
+		prefix := strings.TrimSuffix(r.pattern, "/**")
+		return p == prefix || strings.HasPrefix(p, prefix+"/")
+	}
+	matched, _ := path.Match(r.pattern, p)
+	return matched
+}
+
+type jwtFilter struct {
+	keys      *keySet
+	header    string
+	issuer    string
+	audiences []string
+	scopes    []string
+	routes    []routeScopes
+	claims    map[string]string
+	leeway    time.Duration
+	realm     string
+	now       func() time.Time
+}
+
+/**
+*	校验 Bearer JWT 的认证过滤器
+*	jwks_file / jwks / secret: JWKS 文件、内联的 JWKS 或者 HS256 的密钥，至少配置一个
+*	issuer: 要求的 iss；audience: 逗号分隔，aud 包含其中之一即可
+*	scopes: 所有请求都需要的 scope；scopes:<路径模式>: 匹配该路径的请求额外需要的 scope
+*	claims: 转发给上游的声明，例如 sub=X-User-Id,email=X-User-Email，客户端携带的同名请求头会被删除
+*	leeway: 校验 exp/nbf 时允许的时钟偏差（秒）；realm: WWW-Authenticate 中的 realm
+ */
+func newJWTFilter(params map[string]string) (Middleware, error) {
+	f := &jwtFilter{
+		keys:      &keySet{file: params["jwks_file"]},
+		header:    http.CanonicalHeaderKey(params["header"]),
+		issuer:    params["issuer"],
+		audiences: splitList(params["audience"]),
+		scopes:    splitList(params["scopes"]),
+		claims:    make(map[string]string),
+		realm:     params["realm"],
+		now:       time.Now,
+	}
+	if f.header == "" {
+		f.header = "Authorization"
+	}
+	if f.realm == "" {
+		f.realm = "cheryl"
+	}
+	if f.keys.file != "" {
+		if err := f.keys.load(); err != nil {
+			return nil, fmt.Errorf("can't load jwks file: %s", err.Error())
+		}
+	}
+	if inline := params["jwks"]; inline != "" {
+		keys, err := parseJWKS([]byte(inline))
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwks: %s", err.Error())
+		}
+		f.keys.keys = append(f.keys.keys, keys...)
+	}
+	if secret := params["secret"]; secret != "" {
+		f.keys.keys = append(f.keys.keys, verifyKey{alg: HS256, key: []byte(secret)})
+	}
+	if len(f.keys.keys) == 0 && len(f.keys.fileKeys) == 0 {
+		return nil, errors.New("one of jwks_file, jwks and secret is required")
+	}
+	if leeway := params["leeway"]; leeway != "" {
+		seconds, err := strconv.Atoi(leeway)
+		if err != nil || seconds < 0 {
+			return nil, errors.New("leeway must be a non-negative integer")
+		}
+		f.leeway = time.Duration(seconds) * time.Second
+	}
+	for _, pair := range strings.Split(params["claims"], ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			if pair != "" {
+				return nil, fmt.Errorf("invalid claim mapping %s", pair)
+			}
+			continue
+		}
+		f.claims[kv[0]] = http.CanonicalHeaderKey(kv[1])
+	}
+	for key, value := range params {
+		if strings.HasPrefix(key, routeScopesPrefix) {
+			pattern := strings.TrimPrefix(key, routeScopesPrefix)
+			if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+				return nil, fmt.Errorf("invalid route pattern %s", pattern)
+			}
+			f.routes = append(f.routes, routeScopes{pattern, splitList(value)})
+		}
+	}
+	sort.Slice(f.routes, func(i, j int) bool { return f.routes[i].pattern < f.routes[j].pattern })
+	return f.filter, nil
+}
+
+// RFC 6750：认证失败返回 401，scope 不足返回 403
+func (f *jwtFilter) reject(status int, code, description, scope string) error {
+	challenge := fmt.Sprintf("Bearer realm=%q", f.realm)
+	if code != "" {
+		challenge += fmt.Sprintf(", error=%q, error_description=%q", code, description)
+	}
+	if scope != "" {
+		challenge += fmt.Sprintf(", scope=%q", scope)
+	}
+	return Reject(status, description).WithHeader("WWW-Authenticate", challenge)
+}
+
+func (f *jwtFilter) validate(claims map[string]interface{}) error {
+	now := f.now()
+	exp, has, err := numericClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if has && !now.Before(time.Unix(exp, 0).Add(f.leeway)) {
+		return TokenExpiredError
+	}
+	nbf, has, err := numericClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if has && now.Add(f.leeway).Before(time.Unix(nbf, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if f.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != f.issuer {
+			return errors.New("invalid issuer")
+		}
+	}
+	if len(f.audiences) > 0 {
+		matched := false
+		for _, aud := range stringsClaim(claims["aud"], "") {
+			for _, expected := range f.audiences {
+				if aud == expected {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return errors.New("invalid audience")
+		}
+	}
+	return nil
+}
+
+// scope 声明为空格分隔的字符串，scp 声明为数组或者字符串
+func (f *jwtFilter) missingScopes(claims map[string]interface{}, p string) []string {
+	required := append([]string{}, f.scopes...)
+	for _, route := range f.routes {
+		if route.match(p) {
+			required = append(required, route.scopes...)
+		}
+	}
+	granted := make(map[string]bool)
+	for _, name := range []string{"scope", "scp"} {
+		for _, scope := range stringsClaim(claims[name], " ") {
+			granted[scope] = true
+		}
+	}
+	missing := make([]string, 0)
+	for _, scope := range required {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// 校验通过之后，之后的过滤器可以通过 Value(r, JWT_CLAIMS) 读取令牌的声明
+func (f *jwtFilter) filter(w http.ResponseWriter, r *http.Request, next Next) error {
+	for _, header := range f.claims {
+		r.Header.Del(header)
+	}
+	auth := r.Header.Get(f.header)
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return f.reject(http.StatusUnauthorized, "", "", "")
+	}
+	claims, err := f.keys.verify(strings.TrimSpace(auth[7:]))
+	if err == nil {
+		err = f.validate(claims)
+	}
+	if err != nil {
+		return f.reject(http.StatusUnauthorized, "invalid_token", err.Error(), "")
+	}
+	if missing := f.missingScopes(claims, r.URL.Path); len(missing) > 0 {
+		return f.reject(http.StatusForbidden, "insufficient_scope", "insufficient scope", strings.Join(missing, " "))
+	}
+	for claim, header := range f.claims {
+		if value, ok := claimValue(claims[claim]); ok {
+			r.Header.Set(header, value)
+		}
+	}
+	return next(w, WithValue(r, JWT_CLAIMS, claims))
+}
@@ -0,0 +1,253 @@
+package filter
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/qiancijun/cheryl/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := jsoniter.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := jsoniter.Marshal(claims)
+	signed := encodeSegment(header) + "." + encodeSegment(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		assert.NoError(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + encodeSegment(sig)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) string {
+	return fmt.Sprintf(`{"kty":"RSA","kid":%q,"n":%q,"e":%q}`, kid,
+		encodeSegment(key.N.Bytes()), encodeSegment(big.NewInt(int64(key.E)).Bytes()))
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) string {
+	return fmt.Sprintf(`{"kty":"EC","kid":%q,"crv":"P-256","x":%q,"y":%q}`, kid,
+		encodeSegment(key.X.Bytes()), encodeSegment(key.Y.Bytes()))
+}
+
+func runJWT(chain *Filter, token, path string) (*httptest.ResponseRecorder, *http.Request, error) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("X-User-Id", "spoofed")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	chain.Run(w, r, func(w http.ResponseWriter, final *http.Request) {
+		r = final
+	})
+	if w.Code != http.StatusOK {
+		return w, r, errors.New(w.Body.String())
+	}
+	return w, r, nil
+}
+
+func TestJWTFilter(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	secret := []byte("shared-secret")
+
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"keys":[`+rsaJWK("rsa-1", &rsaKey.PublicKey)+`]}`), 0644))
+
+	chain, err := NewFilterChain([]config.FilterConfig{{Name: JWT, Params: map[string]string{
+		"jwks_file":        file,
+		"jwks":             `{"keys":[` + ecJWK("ec-1", &ecKey.PublicKey) + `]}`,
+		"secret":           string(secret),
+		"issuer":           "https://issuer.example.com",
+		"audience":         "cheryl,other",
+		"scopes":           "read",
+		"scopes:/admin/**": "admin",
+		"claims":           "sub=X-User-Id,groups=X-User-Groups",
+	}}})
+	assert.NoError(t, err)
+
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://issuer.example.com",
+			"aud":    []string{"cheryl"},
+			"sub":    "alice",
+			"groups": []string{"dev", "ops"},
+			"scope":  "read write",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	// 三种算法签发的令牌都可以通过，声明转发给上游并且覆盖客户端的请求头
+	for _, token := range []string{
+		signToken(t, RS256, "rsa-1", rsaKey, claims(nil)),
+		signToken(t, ES256, "ec-1", ecKey, claims(nil)),
+		signToken(t, HS256, "", secret, claims(nil)),
+	} {
+		_, r, err := runJWT(chain, token, "/api/users")
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", r.Header.Get("X-User-Id"))
+		assert.Equal(t, "dev,ops", r.Header.Get("X-User-Groups"))
+		// 之后的过滤器可以读取令牌的声明
+		assert.Equal(t, "alice", Value(r, JWT_CLAIMS).(map[string]interface{})["sub"])
+	}
+
+	// 没有令牌时返回 401，并且不转发伪造的请求头
+	w, r, err := runJWT(chain, "", "/api/users")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer realm="cheryl"`, w.Header().Get("WWW-Authenticate"))
+	assert.Empty(t, r.Header.Get("X-User-Id"))
+
+	invalid := map[string]string{
+		"expired":     signToken(t, RS256, "rsa-1", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})),
+		"not before":  signToken(t, RS256, "rsa-1", rsaKey, claims(map[string]interface{}{"nbf": time.Now().Add(time.Minute).Unix()})),
+		"issuer":      signToken(t, RS256, "rsa-1", rsaKey, claims(map[string]interface{}{"iss": "https://evil.com"})),
+		"audience":    signToken(t, RS256, "rsa-1", rsaKey, claims(map[string]interface{}{"aud": "someone-else"})),
+		"unknown kid": signToken(t, RS256, "rsa-2", rsaKey, claims(nil)),
+		"wrong key":   signToken(t, HS256, "", []byte("guess"), claims(nil)),
+		"malformed":   "not.a.token",
+	}
+	// 使用 RSA 公钥作为 HMAC 密钥的算法混淆攻击
+	publicKey := rsaKey.PublicKey.N.Bytes()
+	invalid["confusion"] = signToken(t, HS256, "rsa-1", publicKey, claims(nil))
+	for name, token := range invalid {
+		w, _, err := runJWT(chain, token, "/api/users")
+		if assert.Error(t, err, name) {
+			assert.Equal(t, http.StatusUnauthorized, w.Code, name)
+			assert.True(t, strings.Contains(w.Header().Get("WWW-Authenticate"), `error="invalid_token"`), name)
+		}
+	}
+
+	// 路由需要额外的 scope
+	token := signToken(t, RS256, "rsa-1", rsaKey, claims(nil))
+	w, _, err = runJWT(chain, token, "/admin/users")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.True(t, strings.Contains(w.Header().Get("WWW-Authenticate"), `scope="admin"`))
+	token = signToken(t, RS256, "rsa-1", rsaKey, claims(map[string]interface{}{"scp": []string{"read", "admin"}, "scope": nil}))
+	_, _, err = runJWT(chain, token, "/admin/users")
+	assert.NoError(t, err)
+
+	// 轮换密钥之后，未知的 kid 触发重新加载 JWKS 文件，上面的 rsa-2 已经检查过一次文件
+	interval := JWKSReloadInterval
+	JWKSReloadInterval = 0
+	defer func() { JWKSReloadInterval = interval }()
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"keys":[`+rsaJWK("rsa-2", &rotated.PublicKey)+`]}`), 0644))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(file, later, later))
+	_, _, err = runJWT(chain, signToken(t, RS256, "rsa-2", rotated, claims(nil)), "/api/users")
+	assert.NoError(t, err)
+	_, _, err = runJWT(chain, signToken(t, HS256, "", secret, claims(nil)), "/api/users")
+	assert.NoError(t, err)
+}
+
+func TestJWTKeyReloadConcurrent(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"keys":[`+rsaJWK("rsa-1", &rsaKey.PublicKey)+`]}`), 0644))
+	set := &keySet{file: file}
+	interval := JWKSReloadInterval
+	JWKSReloadInterval = 0
+	defer func() { JWKSReloadInterval = interval }()
+
+	// 并发的未知 kid 请求同时触发重新加载
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				later := time.Now().Add(time.Duration(i*50+j) * time.Second)
+				os.Chtimes(file, later, later)
+				set.lookup("unknown", RS256)
+			}
+			assert.Len(t, set.lookup("rsa-1", RS256), 1)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestJWTKeyReloadInterval(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"keys":[`+rsaJWK("rsa-1", &rsaKey.PublicKey)+`]}`), 0644))
+	set := &keySet{file: file}
+	assert.NoError(t, set.load())
+	interval := JWKSReloadInterval
+	JWKSReloadInterval = time.Minute
+	defer func() { JWKSReloadInterval = interval }()
+
+	// 第一个未知的 kid 检查文件，之后的未知 kid 在间隔内直接拒绝，不再读取文件
+	assert.Empty(t, set.lookup("random-1", RS256))
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"keys":[`+rsaJWK("rsa-2", &rsaKey.PublicKey)+`]}`), 0644))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(file, later, later))
+	assert.Empty(t, set.lookup("rsa-2", RS256))
+	assert.Len(t, set.lookup("rsa-1", RS256), 1)
+
+	// 间隔过去之后重新加载
+	set.Lock()
+	set.checked = time.Now().Add(-time.Minute)
+	set.Unlock()
+	assert.Len(t, set.lookup("rsa-2", RS256), 1)
+	assert.Empty(t, set.lookup("rsa-1", RS256))
+}
+
+func TestJWTFilterConfig(t *testing.T) {
+	cases := []map[string]string{
+		{},
+		{"secret": "s", "leeway": "-1"},
+		{"secret": "s", "claims": "sub"},
+		{"secret": "s", "scopes:admin": "admin"},
+		{"jwks": `{"keys":[{"kty":"EC","crv":"P-384"}]}`},
+		{"jwks_file": "/not/exists.json"},
+	}
+	for _, params := range cases {
+		_, err := NewFilterChain([]config.FilterConfig{{Name: JWT, Params: params}})
+		assert.Error(t, err, params)
+	}
+}
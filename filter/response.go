@@ -0,0 +1,207 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	SET_RESPONSE_HEADER    string = "set-response-header"
+	REMOVE_RESPONSE_HEADER string = "remove-response-header"
+	SECURITY_HEADERS       string = "security-headers"
+	REWRITE_LOCATION       string = "rewrite-location"
+	REPLACE_BODY           string = "replace-body"
+	SET_STATUS             string = "set-status"
+)
+
+var (
+	// replace-body 默认只处理不超过 1MB 的响应体
+	DefaultMaxBodySize int64 = 1 << 20
+
+	// security-headers 默认添加的响应头，可以通过同名的参数覆盖，参数为空字符串时不添加
+	DefaultSecurityHeaders = map[string]string{
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "no-referrer",
+	}
+)
+
+func init() {
+	RegisterResponseFilter(SET_RESPONSE_HEADER, newSetResponseHeaderFilter)
+	RegisterResponseFilter(REMOVE_RESPONSE_HEADER, newRemoveResponseHeaderFilter)
+	RegisterResponseFilter(SECURITY_HEADERS, newSecurityHeadersFilter)
+	RegisterResponseFilter(REWRITE_LOCATION, newRewriteLocationFilter)
+	RegisterResponseFilter(REPLACE_BODY, newReplaceBodyFilter)
+	RegisterResponseFilter(SET_STATUS, newSetStatusFilter)
+}
+
+func newSetResponseHeaderFilter(params map[string]string) (ResponseFunc, error) {
+	name := http.CanonicalHeaderKey(params["name"])
+	if name == "" {
+		return nil, errors.New("header name can't be empty")
+	}
+	value := params["value"]
+	return func(resp *http.Response) error {
+		resp.Header.Set(name, value)
+		return nil
+	}, nil
+}
+
+// name 可以是逗号分隔的多个响应头，例如 Server,X-Powered-By
+func newRemoveResponseHeaderFilter(params map[string]string) (ResponseFunc, error) {
+	names := make([]string, 0)
+	for _, name := range strings.Split(params["name"], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("header name can't be empty")
+	}
+	return func(resp *http.Response) error {
+		for _, name := range names {
+			resp.Header.Del(name)
+		}
+		return nil
+	}, nil
+}
+
+// 参数的键为响应头的名称，例如 Content-Security-Policy，上游已经设置的响应头保持不变
+func newSecurityHeadersFilter(params map[string]string) (ResponseFunc, error) {
+	headers := make(map[string]string)
+	for name, value := range DefaultSecurityHeaders {
+		headers[name] = value
+	}
+	for name, value := range params {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	return func(resp *http.Response) error {
+		for name, value := range headers {
+			if value != "" && resp.Header.Get(name) == "" {
+				resp.Header.Set(name, value)
+			}
+		}
+		return nil
+	}, nil
+}
+
+/**
+*	将指向上游主机的 Location 改写为网关的地址
+*	host: 改写之后的主机，默认为客户端请求的 Host
+*	scheme: 改写之后的协议，默认保持不变
+*	prefix: 添加在路径之前的前缀，通常是 location 的 pattern，因为转发时去掉了这个前缀
+ */
+func newRewriteLocationFilter(params map[string]string) (ResponseFunc, error) {
+	host, scheme, prefix := params["host"], params["scheme"], strings.TrimSuffix(params["prefix"], "/")
+	if scheme != "" && scheme != "http" && scheme != "https" {
+		return nil, errors.New("scheme must be http or https")
+	}
+	return func(resp *http.Response) error {
+		location := resp.Header.Get("Location")
+		if location == "" || resp.Request == nil {
+			return nil
+		}
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil
+		}
+		// 相对地址同样需要补上前缀
+		if u.Host != "" && !strings.EqualFold(u.Host, resp.Request.URL.Host) {
+			return nil
+		}
+		if u.Host != "" {
+			u.Host = host
+			if u.Host == "" {
+				u.Host = resp.Request.Host
+			}
+			if scheme != "" {
+				u.Scheme = scheme
+			}
+		}
+		if strings.HasPrefix(u.Path, "/") {
+			u.Path = prefix + u.Path
+			if u.RawPath != "" {
+				u.RawPath = prefix + u.RawPath
+			}
+		}
+		resp.Header.Set("Location", u.String())
+		return nil
+	}, nil
+}
+
+/**
+*	替换响应体中的字符串
+*	from, to: 替换前后的字符串
+*	content_type: 只处理指定类型前缀的响应，默认为 text/
+*	max_size: 只处理不超过该大小的响应体，超过时原样返回；压缩过的响应也原样返回
+ */
+func newReplaceBodyFilter(params map[string]string) (ResponseFunc, error) {
+	from, to := []byte(params["from"]), []byte(params["to"])
+	if len(from) == 0 {
+		return nil, errors.New("from can't be empty")
+	}
+	contentType := params["content_type"]
+	if contentType == "" {
+		contentType = "text/"
+	}
+	maxSize := DefaultMaxBodySize
+	if size, has := params["max_size"]; has {
+		parsed, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || parsed <= 0 {
+			return nil, errors.New("max_size must be a positive integer")
+		}
+		maxSize = parsed
+	}
+	return func(resp *http.Response) error {
+		if resp.Body == nil || resp.Header.Get("Content-Encoding") != "" ||
+			!strings.HasPrefix(resp.Header.Get("Content-Type"), contentType) ||
+			resp.ContentLength > maxSize {
+			return nil
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(body)) > maxSize {
+			resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return nil
+		}
+		resp.Body.Close()
+		body = bytes.ReplaceAll(body, from, to)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// 将上游返回的 from 状态码改写为 to，例如隐藏上游的 404 或者 500
+func newSetStatusFilter(params map[string]string) (ResponseFunc, error) {
+	from, err := strconv.Atoi(params["from"])
+	if err != nil || from < 100 || from > 999 {
+		return nil, errors.New("from must be a status code")
+	}
+	to, err := strconv.Atoi(params["to"])
+	if err != nil || to < 100 || to > 999 {
+		return nil, errors.New("to must be a status code")
+	}
+	return func(resp *http.Response) error {
+		if resp.StatusCode == from {
+			resp.StatusCode = to
+			resp.Status = strconv.Itoa(to) + " " + http.StatusText(to)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newResponse(header http.Header, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: -1,
+		Request:       &http.Request{Host: "gateway.example.com", URL: &url.URL{Host: "10.0.0.1:8080"}},
+	}
+}
+
+func TestResponseFilterChain(t *testing.T) {
+	_, err := NewFilterChain([]config.FilterConfig{{Name: REPLACE_BODY}})
+	assert.Error(t, err)
+	_, err = NewFilterChain([]config.FilterConfig{{Name: SET_STATUS, Params: map[string]string{"from": "404"}}})
+	assert.Error(t, err)
+
+	chain, err := NewFilterChain([]config.FilterConfig{
+		{Name: REWRITE_LOCATION, Params: map[string]string{"prefix": "/api/"}},
+		{Name: REPLACE_BODY, Params: map[string]string{"from": "internal", "to": "public", "max_size": "20"}},
+	})
+	assert.NoError(t, err)
+
+	// 指向其他主机的 Location 保持不变，相对地址补上前缀
+	cases := map[string]string{
+		"http://10.0.0.1:8080/users/1": "http://gateway.example.com/api/users/1",
+		"https://other.com/users/1":    "https://other.com/users/1",
+		"/users/1":                     "/api/users/1",
+	}
+	for location, expected := range cases {
+		resp := newResponse(http.Header{"Location": {location}}, "")
+		assert.NoError(t, chain.ExecuteResponse(resp))
+		assert.Equal(t, expected, resp.Header.Get("Location"))
+	}
+
+	resp := newResponse(http.Header{"Content-Type": {"text/plain"}}, "the internal host")
+	assert.NoError(t, chain.ExecuteResponse(resp))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "the public host", string(body))
+	assert.Equal(t, int64(15), resp.ContentLength)
+
+	// 超过大小限制、压缩过或者类型不匹配的响应体原样返回
+	for _, header := range []http.Header{
+		{"Content-Type": {"text/plain"}},
+		{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}},
+		{"Content-Type": {"application/octet-stream"}},
+	} {
+		content := "internal internal internal"
+		if header.Get("Content-Type") != "text/plain" || header.Get("Content-Encoding") != "" {
+			content = "internal"
+		}
+		resp = newResponse(header, content)
+		assert.NoError(t, chain.ExecuteResponse(resp))
+		body, _ = ioutil.ReadAll(resp.Body)
+		assert.Equal(t, content, string(body))
+	}
+}
@@ -44,6 +44,8 @@ func main() {
 
 	// filter.CreateFilterChain(f1, f2, f3)
 
-	cheryl.Start(config)
+	if err := cheryl.Start(config); err != nil {
+		log.Fatalf("start error: %s", err)
+	}
 	// config.StartServer()
 }
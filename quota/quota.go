@@ -0,0 +1,433 @@
+package quota
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/qiancijun/cheryl/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	DAILY   string = "daily"
+	MONTHLY string = "monthly"
+
+	DefaultKeyHeader = "X-API-Key"
+)
+
+var (
+	InvalidPeriodError   = errors.New("quota period must be daily or monthly")
+	InvalidConsumerError = errors.New("consumer can't be empty")
+	QuotaExceededError   = errors.New("quota exceeded")
+
+	// 计数器写入 BoltDB 的间隔
+	FlushInterval = time.Second
+	counterBucket = []byte("quota")
+
+	Quotas *QuotaManager
+)
+
+/**
+*	注册的消费者在每个周期内允许的请求数量，消费者的识别见 reverse_proxy 的 quotaConsumer
+*	KeyHeader: 携带消费者 API Key 的请求头
+*	allowances: 消费者 -> 周期 -> 允许的请求数量，通过 raft 同步
+*	counters: 本节点的使用量，保存在本地的 BoltDB 中
+*	remote: 其他节点的使用量，由 leader 汇总之后返回，配额按照本节点与其他节点的使用量之和判断
+*	reports: leader 上记录的每个节点上报的使用量
+ */
+type QuotaManager struct {
+	sync.Mutex
+	KeyHeader  string
+	allowances map[string]map[string]int64
+	counters   map[string]*Counter
+	remote     map[string]Counter
+	reports    map[string]map[string]Counter
+	dirty      map[string]bool
+	db         *bolt.DB
+	stop       chan struct{}
+	now        func() time.Time
+}
+
+/**
+*	一个消费者在一个周期内的使用量，也用于节点与 leader 之间交换使用量
+*	resetAt: 最近一次清空使用量的时间，重放清空的日志时用来判断是否已经执行过
+ */
+type Counter struct {
+	Window  string    `json:"window"`
+	Used    int64     `json:"used"`
+	ResetAt time.Time `json:"resetAt,omitempty"`
+}
+
+// used: 整个集群的使用量，local: 其中本节点处理的请求数量
+type Usage struct {
+	Period string    `json:"period"`
+	Limit  int64     `json:"limit"`
+	Used   int64     `json:"used"`
+	Local  int64     `json:"local"`
+	Reset  time.Time `json:"reset"`
+}
+
+func init() {
+	Quotas = NewQuotaManager()
+}
+
+func NewQuotaManager() *QuotaManager {
+	return &QuotaManager{
+		KeyHeader:  DefaultKeyHeader,
+		allowances: make(map[string]map[string]int64),
+		counters:   make(map[string]*Counter),
+		remote:     make(map[string]Counter),
+		reports:    make(map[string]map[string]Counter),
+		dirty:      make(map[string]bool),
+		now:        time.Now,
+	}
+}
+
+// 打开保存计数器的数据库并且加载之前的使用量
+func (m *QuotaManager) Open(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	counters := make(map[string]*Counter)
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(counterBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			c := &Counter{}
+			if err := jsoniter.Unmarshal(v, c); err != nil {
+				return err
+			}
+			counters[string(k)] = c
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	m.Lock()
+	m.db = db
+	m.counters = counters
+	m.stop = make(chan struct{})
+	m.Unlock()
+	go m.run(m.stop)
+	return nil
+}
+
+func (m *QuotaManager) run(stop chan struct{}) {
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := m.Flush(); err != nil {
+				logger.Warnf("can't flush quota counters: %s", err.Error())
+			}
+		}
+	}
+}
+
+// 将变化的计数器写入数据库
+func (m *QuotaManager) Flush() error {
+	m.Lock()
+	if m.db == nil || len(m.dirty) == 0 {
+		m.Unlock()
+		return nil
+	}
+	db := m.db
+	values := make(map[string][]byte, len(m.dirty))
+	for key := range m.dirty {
+		c, has := m.counters[key]
+		if !has {
+			values[key] = nil
+			continue
+		}
+		data, err := jsoniter.Marshal(c)
+		if err != nil {
+			m.Unlock()
+			return err
+		}
+		values[key] = data
+	}
+	m.dirty = make(map[string]bool)
+	m.Unlock()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(counterBucket)
+		for key, value := range values {
+			var err error
+			if value == nil {
+				err = bucket.Delete([]byte(key))
+			} else {
+				err = bucket.Put([]byte(key), value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *QuotaManager) Close() error {
+	m.Lock()
+	if m.db == nil {
+		m.Unlock()
+		return nil
+	}
+	close(m.stop)
+	m.Unlock()
+	err := m.Flush()
+	m.Lock()
+	defer m.Unlock()
+	if closeErr := m.db.Close(); err == nil {
+		err = closeErr
+	}
+	m.db = nil
+	return err
+}
+
+func validPeriod(period string) error {
+	if period != DAILY && period != MONTHLY {
+		return InvalidPeriodError
+	}
+	return nil
+}
+
+// 周期的标识以及下一个周期开始的时间，周期按照 UTC 计算
+func window(period string, now time.Time) (string, time.Time) {
+	now = now.UTC()
+	if period == DAILY {
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+	}
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01"), start.AddDate(0, 1, 0)
+}
+
+func windowID(period string, now time.Time) string {
+	id, _ := window(period, now)
+	return id
+}
+
+func counterKey(consumer, period string) string {
+	return consumer + "|" + period
+}
+
+// limit 小于等于 0 时删除该周期的配额
+func (m *QuotaManager) SetAllowance(consumer, period string, limit int64) error {
+	if consumer == "" {
+		return InvalidConsumerError
+	}
+	if err := validPeriod(period); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if limit <= 0 {
+		delete(m.allowances[consumer], period)
+		if len(m.allowances[consumer]) == 0 {
+			delete(m.allowances, consumer)
+		}
+		return nil
+	}
+	if _, has := m.allowances[consumer]; !has {
+		m.allowances[consumer] = make(map[string]int64)
+	}
+	m.allowances[consumer][period] = limit
+	return nil
+}
+
+// 调用者需要持有锁，返回当前周期的计数器
+func (m *QuotaManager) counter(consumer, period string, now time.Time) *Counter {
+	key := counterKey(consumer, period)
+	id, _ := window(period, now)
+	c, has := m.counters[key]
+	if !has || c.Window != id {
+		c = &Counter{Window: id}
+		m.counters[key] = c
+	}
+	return c
+}
+
+// 调用者需要持有锁，返回整个集群在当前周期的使用量
+func (m *QuotaManager) used(consumer, period string, now time.Time) int64 {
+	c := m.counter(consumer, period, now)
+	used := c.Used
+	if r, has := m.remote[counterKey(consumer, period)]; has && r.covers(c) {
+		used += r.Used
+	}
+	return used
+}
+
+// 使用量属于同一个周期，并且在最近一次清空之后
+func (c Counter) covers(local *Counter) bool {
+	return c.Window == local.Window && !c.ResetAt.Before(local.ResetAt)
+}
+
+/**
+*	消耗一次配额，没有配置配额的消费者不做限制
+*	任意一个周期的配额用尽时返回 QuotaExceededError 以及配额恢复的时间
+ */
+func (m *QuotaManager) Use(consumer string) (time.Time, error) {
+	m.Lock()
+	defer m.Unlock()
+	allowances, has := m.allowances[consumer]
+	if !has {
+		return time.Time{}, nil
+	}
+	now := m.now()
+	var reset time.Time
+	for period, limit := range allowances {
+		if m.used(consumer, period, now) < limit {
+			continue
+		}
+		// 多个周期都用尽时，等到最晚恢复的周期
+		if _, next := window(period, now); next.After(reset) {
+			reset = next
+		}
+	}
+	if !reset.IsZero() {
+		return reset, QuotaExceededError
+	}
+	for period := range allowances {
+		m.counter(consumer, period, now).Used++
+		m.dirty[counterKey(consumer, period)] = true
+	}
+	return time.Time{}, nil
+}
+
+// 消费者在每个周期的配额和使用量
+func (m *QuotaManager) Usage(consumer string) []Usage {
+	m.Lock()
+	defer m.Unlock()
+	now := m.now()
+	res := make([]Usage, 0)
+	for period, limit := range m.allowances[consumer] {
+		_, reset := window(period, now)
+		res = append(res, Usage{
+			Period: period,
+			Limit:  limit,
+			Used:   m.used(consumer, period, now),
+			Local:  m.counter(consumer, period, now).Used,
+			Reset:  reset,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Period < res[j].Period })
+	return res
+}
+
+/**
+*	清空消费者在 at 之前的使用量，at 是写入日志时的时间。
+*	节点重启时 raft 会重放快照之后的日志，计数器记录了执行过的清空时间，
+*	已经执行过的清空以及属于更早周期的清空都会被忽略，不会丢失之后的使用量
+ */
+func (m *QuotaManager) Reset(consumer string, at time.Time) {
+	// 旧版本的日志没有记录时间，无法判断是否已经执行过
+	if at.IsZero() {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	now := m.now()
+	for _, period := range []string{DAILY, MONTHLY} {
+		if windowID(period, at) != windowID(period, now) {
+			continue
+		}
+		c := m.counter(consumer, period, now)
+		if !c.ResetAt.Before(at) {
+			continue
+		}
+		c.Used = 0
+		c.ResetAt = at
+		m.dirty[counterKey(consumer, period)] = true
+	}
+}
+
+// 本节点在当前周期的使用量，只包含配置了配额的消费者，用于上报给 leader
+func (m *QuotaManager) Local() map[string]Counter {
+	m.Lock()
+	defer m.Unlock()
+	now := m.now()
+	res := make(map[string]Counter)
+	for consumer, allowances := range m.allowances {
+		for period := range allowances {
+			res[counterKey(consumer, period)] = *m.counter(consumer, period, now)
+		}
+	}
+	return res
+}
+
+/**
+*	leader 记录节点上报的使用量，返回其他节点在当前周期的使用量之和。
+*	节点上报的是完整的使用量而不是增量，重复上报或者 leader 切换之后都不会重复计算。
+*	离开集群的节点的使用量保留到周期结束，清空之前的使用量不会计入
+ */
+func (m *QuotaManager) Merge(node string, report map[string]Counter) map[string]Counter {
+	m.Lock()
+	defer m.Unlock()
+	now := m.now()
+	m.reports[node] = report
+	res := make(map[string]Counter, len(report))
+	for key := range report {
+		idx := strings.LastIndex(key, "|")
+		if idx < 0 || validPeriod(key[idx+1:]) != nil {
+			continue
+		}
+		c := m.counter(key[:idx], key[idx+1:], now)
+		total := Counter{Window: c.Window, ResetAt: c.ResetAt}
+		for other, counters := range m.reports {
+			if other == node {
+				continue
+			}
+			if counter, has := counters[key]; has && counter.covers(c) {
+				total.Used += counter.Used
+			}
+		}
+		res[key] = total
+	}
+	return res
+}
+
+// 使用 leader 汇总的其他节点的使用量
+func (m *QuotaManager) SetRemote(remote map[string]Counter) {
+	m.Lock()
+	defer m.Unlock()
+	m.remote = remote
+}
+
+// 返回配额的副本，用于生成快照
+func (m *QuotaManager) Allowances() map[string]map[string]int64 {
+	m.Lock()
+	defer m.Unlock()
+	res := make(map[string]map[string]int64, len(m.allowances))
+	for consumer, allowances := range m.allowances {
+		res[consumer] = make(map[string]int64, len(allowances))
+		for period, limit := range allowances {
+			res[consumer][period] = limit
+		}
+	}
+	return res
+}
+
+// 使用快照中的配额替换当前的配额，使用量保持不变
+func (m *QuotaManager) Restore(allowances map[string]map[string]int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.allowances = make(map[string]map[string]int64, len(allowances))
+	for consumer, periods := range allowances {
+		m.allowances[consumer] = make(map[string]int64, len(periods))
+		for period, limit := range periods {
+			m.allowances[consumer][period] = limit
+		}
+	}
+}
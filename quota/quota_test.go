@@ -0,0 +1,117 @@
+package quota
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaWindow(t *testing.T) {
+	now := time.Date(2022, 12, 31, 23, 0, 0, 0, time.UTC)
+	id, reset := window(DAILY, now)
+	assert.Equal(t, "2022-12-31", id)
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), reset)
+	id, reset = window(MONTHLY, now)
+	assert.Equal(t, "2022-12", id)
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), reset)
+}
+
+func TestQuotaUse(t *testing.T) {
+	m := NewQuotaManager()
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	assert.Equal(t, InvalidPeriodError, m.SetAllowance("alice", "weekly", 1))
+	assert.NoError(t, m.SetAllowance("alice", DAILY, 2))
+	assert.NoError(t, m.SetAllowance("alice", MONTHLY, 3))
+
+	// 没有配置配额的消费者不做限制
+	_, err := m.Use("bob")
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = m.Use("alice")
+		assert.NoError(t, err)
+	}
+	reset, err := m.Use("alice")
+	assert.Equal(t, QuotaExceededError, err)
+	assert.Equal(t, time.Date(2022, 10, 2, 0, 0, 0, 0, time.UTC), reset)
+
+	// 第二天的日配额恢复，月配额只剩一次
+	now = now.Add(24 * time.Hour)
+	_, err = m.Use("alice")
+	assert.NoError(t, err)
+	reset, err = m.Use("alice")
+	assert.Equal(t, QuotaExceededError, err)
+	assert.Equal(t, time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC), reset)
+
+	usage := m.Usage("alice")
+	assert.Equal(t, 2, len(usage))
+	assert.Equal(t, DAILY, usage[0].Period)
+	assert.Equal(t, int64(1), usage[0].Used)
+	assert.Equal(t, int64(3), usage[1].Used)
+
+	m.Reset("alice", now)
+	_, err = m.Use("alice")
+	assert.NoError(t, err)
+}
+
+func TestQuotaResetReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.db")
+	m := NewQuotaManager()
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	assert.NoError(t, m.Open(path))
+	assert.NoError(t, m.SetAllowance("alice", DAILY, 10))
+	for i := 0; i < 3; i++ {
+		_, err := m.Use("alice")
+		assert.NoError(t, err)
+	}
+	resetAt := now
+	m.Reset("alice", resetAt)
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		_, err := m.Use("alice")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, m.Close())
+
+	// 重启之后 raft 重放清空的日志，不会清空之后的使用量
+	m = NewQuotaManager()
+	m.now = func() time.Time { return now }
+	assert.NoError(t, m.Open(path))
+	defer m.Close()
+	m.Restore(map[string]map[string]int64{"alice": {DAILY: 10}})
+	m.Reset("alice", resetAt)
+	assert.Equal(t, int64(2), m.Usage("alice")[0].Used)
+
+	// 之前周期的清空同样被忽略
+	m.Reset("alice", resetAt.Add(-24*time.Hour))
+	assert.Equal(t, int64(2), m.Usage("alice")[0].Used)
+
+	// 新的清空正常执行
+	m.Reset("alice", now)
+	assert.Equal(t, int64(0), m.Usage("alice")[0].Used)
+}
+
+func TestQuotaPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.db")
+	m := NewQuotaManager()
+	assert.NoError(t, m.Open(path))
+	assert.NoError(t, m.SetAllowance("alice", DAILY, 10))
+	for i := 0; i < 3; i++ {
+		_, err := m.Use("alice")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, m.Close())
+
+	// 重启之后使用量不变，配额由 raft 恢复
+	m = NewQuotaManager()
+	assert.NoError(t, m.Open(path))
+	defer m.Close()
+	m.Restore(map[string]map[string]int64{"alice": {DAILY: 10}})
+	usage := m.Usage("alice")
+	assert.Equal(t, 1, len(usage))
+	assert.Equal(t, int64(3), usage[0].Used)
+}
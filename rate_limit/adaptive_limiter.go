@@ -0,0 +1,197 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultAdaptiveLimit    = 20
+	DefaultAdaptiveMaxLimit = 1000
+	// 延迟超过最小延迟的倍数时认为上游开始排队
+	AdaptiveTolerance = 2.0
+	// 上游排队时并发数量按照比例降低
+	AdaptiveBackoff = 0.9
+	// 最小延迟按照窗口记录，每隔多少个样本切换窗口，基准取最近两个窗口中的最小值，
+	// 上游的延迟整体变化之后最多两个窗口就能感知
+	AdaptiveProbeSamples = 1000
+
+	OverloadError = errors.New("upstream is overloaded")
+)
+
+// 需要根据上游的响应时间调整的限流器，请求结束时在 Done 之前调用
+type LatencyObserver interface {
+	Observe(time.Duration)
+}
+
+/**
+*	自适应并发限流器（AIMD）：记录上游的最小响应延迟作为基准，
+*	响应延迟超过基准的 AdaptiveTolerance 倍时按比例降低允许的并发数量，
+*	否则在并发数量被充分利用时加一。超过并发数量的请求返回 OverloadError。
+*	降低之后的一个响应延迟之内返回的请求都是在降低之前发出的，这段时间内不再降低
+*	minRTT, prevMinRTT: 当前窗口和上一个窗口的最小延迟
+*	holdUntil: 下一次可以降低并发数量的时间
+ */
+type AdaptiveLimiter struct {
+	sync.Mutex
+	limit      float64
+	minLimit   int
+	maxLimit   int
+	inflight   int
+	minRTT     time.Duration
+	prevMinRTT time.Duration
+	samples    int
+	holdUntil  time.Time
+	timeout    time.Duration
+	released   chan struct{}
+}
+
+func init() {
+	rateLimiterFactories[ADAPTIVE] = NewAdaptiveLimiter
+}
+
+func NewAdaptiveLimiter() RateLimiter {
+	return &AdaptiveLimiter{
+		limit:    float64(DefaultAdaptiveLimit),
+		minLimit: 1,
+		maxLimit: DefaultAdaptiveMaxLimit,
+		timeout:  -1,
+		released: make(chan struct{}),
+	}
+}
+
+func (r *AdaptiveLimiter) Take() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.inflight >= int(r.limit) {
+		return OverloadError
+	}
+	r.inflight++
+	return nil
+}
+
+// 等待其他请求结束
+func (r *AdaptiveLimiter) TakeWithTimeout(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		r.Lock()
+		if r.inflight < int(r.limit) {
+			r.inflight++
+			r.Unlock()
+			return nil
+		}
+		released := r.released
+		r.Unlock()
+		select {
+		case <-released:
+		case <-timer.C:
+			return OverloadError
+		}
+	}
+}
+
+func (r *AdaptiveLimiter) Done() {
+	r.Lock()
+	defer r.Unlock()
+	if r.inflight > 0 {
+		r.inflight--
+	}
+	close(r.released)
+	r.released = make(chan struct{})
+}
+
+func (r *AdaptiveLimiter) Observe(rtt time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	r.samples++
+	if r.samples >= AdaptiveProbeSamples {
+		r.samples = 0
+		r.prevMinRTT, r.minRTT = r.minRTT, 0
+	}
+	if r.minRTT == 0 || rtt < r.minRTT {
+		r.minRTT = rtt
+	}
+	if float64(rtt) > float64(r.baseline())*AdaptiveTolerance {
+		if now.Before(r.holdUntil) {
+			return
+		}
+		r.limit *= AdaptiveBackoff
+		if r.limit < float64(r.minLimit) {
+			r.limit = float64(r.minLimit)
+		}
+		r.holdUntil = now.Add(rtt)
+		return
+	}
+	// 并发数量没有被充分利用时，无法判断更高的并发是否安全
+	if r.inflight*2 >= int(r.limit) && int(r.limit) < r.maxLimit {
+		r.limit++
+	}
+}
+
+// 调用者需要持有锁，最近两个窗口中的最小延迟
+func (r *AdaptiveLimiter) baseline() time.Duration {
+	if r.prevMinRTT > 0 && r.prevMinRTT < r.minRTT {
+		return r.prevMinRTT
+	}
+	return r.minRTT
+}
+
+// 当前计算出的并发数量
+func (r *AdaptiveLimiter) Limit() int {
+	r.Lock()
+	defer r.Unlock()
+	return int(r.limit)
+}
+
+func (r *AdaptiveLimiter) MinRTT() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	return r.baseline()
+}
+
+func (r *AdaptiveLimiter) Inflight() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.inflight
+}
+
+// limit：初始的并发数量
+// max：并发数量的上限
+func (r *AdaptiveLimiter) SetRate(limit int, max int64) {
+	r.Lock()
+	defer r.Unlock()
+	if limit <= 0 {
+		limit = DefaultAdaptiveLimit
+	}
+	if max > 0 {
+		r.maxLimit = int(max)
+	}
+	if limit > r.maxLimit {
+		limit = r.maxLimit
+	}
+	r.limit = float64(limit)
+}
+
+func (r *AdaptiveLimiter) GetVolumn() int { return r.Limit() }
+
+func (r *AdaptiveLimiter) GetSpeed() int64 { return -1 }
+
+func (r *AdaptiveLimiter) GetTimeout() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	if r.timeout < 0 {
+		return 0
+	}
+	return r.timeout
+}
+
+func (r *AdaptiveLimiter) SetTimeout(timeout time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.timeout = timeout
+}
+
+func (r *AdaptiveLimiter) Type() LimiterType { return ADAPTIVE }
@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	limiter := NewAdaptiveLimiter().(*AdaptiveLimiter)
+	limiter.SetRate(2, 4)
+	assert.Equal(t, 2, limiter.Limit())
+
+	assert.NoError(t, limiter.Take())
+	assert.NoError(t, limiter.Take())
+	assert.Equal(t, OverloadError, limiter.Take())
+
+	// 延迟稳定并且并发数量被充分利用时提高并发数量
+	limiter.Observe(10 * time.Millisecond)
+	limiter.Done()
+	assert.Equal(t, 3, limiter.Limit())
+	assert.Equal(t, 10*time.Millisecond, limiter.MinRTT())
+	// 并发数量没有被充分利用时不提高
+	limiter.Observe(10 * time.Millisecond)
+	limiter.Done()
+	assert.Equal(t, 3, limiter.Limit())
+
+	// 达到上限之后不再提高
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, limiter.Take())
+	}
+	limiter.Observe(10 * time.Millisecond)
+	assert.Equal(t, 4, limiter.Limit())
+	assert.NoError(t, limiter.Take())
+	limiter.Observe(10 * time.Millisecond)
+	assert.Equal(t, 4, limiter.Limit())
+
+	// 延迟升高时降低并发数量
+	limiter.Observe(50 * time.Millisecond)
+	assert.Equal(t, 3, limiter.Limit())
+	for i := 0; i < 4; i++ {
+		limiter.Done()
+	}
+	assert.Equal(t, 0, limiter.Inflight())
+}
+
+func TestAdaptiveLimiterTimeout(t *testing.T) {
+	limiter := NewAdaptiveLimiter()
+	limiter.SetRate(1, 0)
+	assert.NoError(t, limiter.Take())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		limiter.Done()
+	}()
+	assert.NoError(t, limiter.TakeWithTimeout(time.Second))
+	assert.Equal(t, OverloadError, limiter.TakeWithTimeout(20*time.Millisecond))
+}
+
+func TestAdaptiveLimiterBackoffOncePerWindow(t *testing.T) {
+	limiter := NewAdaptiveLimiter().(*AdaptiveLimiter)
+	limiter.SetRate(100, 100)
+	limiter.Observe(time.Millisecond)
+
+	// 同一批排队的请求只降低一次
+	for i := 0; i < 10; i++ {
+		limiter.Observe(30 * time.Millisecond)
+	}
+	assert.Equal(t, 90, limiter.Limit())
+
+	// 一个响应延迟之后仍然排队时再降低
+	time.Sleep(40 * time.Millisecond)
+	limiter.Observe(30 * time.Millisecond)
+	assert.Equal(t, 81, limiter.Limit())
+}
+
+func TestAdaptiveLimiterMinRTTWindow(t *testing.T) {
+	probe := AdaptiveProbeSamples
+	AdaptiveProbeSamples = 3
+	defer func() { AdaptiveProbeSamples = probe }()
+
+	limiter := NewAdaptiveLimiter().(*AdaptiveLimiter)
+	limiter.Observe(10 * time.Millisecond)
+	limiter.Observe(12 * time.Millisecond)
+	// 切换窗口之后仍然使用上一个窗口的最小延迟，不会把负载下的样本当作基准
+	limiter.Observe(40 * time.Millisecond)
+	assert.Equal(t, 10*time.Millisecond, limiter.MinRTT())
+	limiter.Observe(40 * time.Millisecond)
+	limiter.Observe(40 * time.Millisecond)
+	assert.Equal(t, 10*time.Millisecond, limiter.MinRTT())
+
+	// 连续两个窗口的延迟都升高之后，基准随之调整
+	for i := 0; i < 3; i++ {
+		limiter.Observe(40 * time.Millisecond)
+	}
+	assert.Equal(t, 40*time.Millisecond, limiter.MinRTT())
+}
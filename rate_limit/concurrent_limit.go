@@ -5,40 +5,91 @@ import (
 	"time"
 )
 
-// type RateLimiter interface {
-// 	Take() error
-// 	TakeWithTimeout(time.Duration) error
-// 	SetRate(int, int64) // 设置速率
-// 	GetVolumn() int
-// 	GetSpeed() int64
-// 	GetTimeout() time.Duration
-// 	SetTimeout(time.Duration)
-// }
-
+/**
+*	限制同时处理的请求数量，请求结束之后需要调用 Done 归还。
+*	正在处理的请求数量不随 SetRate 重置，修改并发数量之前获取的配额
+*	同样在 Done 时归还，调低并发数量之后要等到处理中的请求降到新的数量以下才会放行
+ */
 type ConcurrentLimit struct {
-	sync.RWMutex
-	concurrent chan bool
-	volumn int
-	timeout time.Duration
+	sync.Mutex
+	volumn   int
+	inflight int
+	timeout  time.Duration
+	released chan struct{}
 }
 
-func (limiter *ConcurrentLimit) Take() error {
-	return nil	
+func init() {
+	rateLimiterFactories[CONCURRENT] = NewConcurrentLimit
+}
+
+func NewConcurrentLimit() RateLimiter {
+	return &ConcurrentLimit{
+		volumn:   -1,
+		timeout:  -1,
+		released: make(chan struct{}),
+	}
 }
 
-func (limiter *ConcurrentLimit) TakeWithTimeout() error {
+// 调用者需要持有锁，没有配置最大并发数时不做限制，但仍然记录处理中的请求
+func (limiter *ConcurrentLimit) tryTake() bool {
+	if limiter.volumn >= 0 && limiter.inflight >= limiter.volumn {
+		return false
+	}
+	limiter.inflight++
+	return true
+}
+
+func (limiter *ConcurrentLimit) Take() error {
+	limiter.Lock()
+	defer limiter.Unlock()
+	if !limiter.tryTake() {
+		return NoReaminTokenError
+	}
 	return nil
 }
 
+func (limiter *ConcurrentLimit) TakeWithTimeout(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		limiter.Lock()
+		if limiter.tryTake() {
+			limiter.Unlock()
+			return nil
+		}
+		released := limiter.released
+		limiter.Unlock()
+		select {
+		case <-released:
+		case <-timer.C:
+			return NoReaminTokenError
+		}
+	}
+}
+
+func (limiter *ConcurrentLimit) Done() {
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.inflight > 0 {
+		limiter.inflight--
+	}
+	close(limiter.released)
+	limiter.released = make(chan struct{})
+}
+
 func (limiter *ConcurrentLimit) GetVolumn() int {
-	limiter.RLock()
-	limiter.RUnlock()
+	limiter.Lock()
+	defer limiter.Unlock()
 	return limiter.volumn
 }
 
+// -1代表没有配置超时
 func (limiter *ConcurrentLimit) GetTimeout() time.Duration {
-	limiter.RLock()
-	defer limiter.RUnlock()
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.timeout < 0 {
+		return 0
+	}
 	return limiter.timeout
 }
 
@@ -48,9 +99,30 @@ func (limiter *ConcurrentLimit) SetTimeout(timeout time.Duration) {
 	limiter.timeout = timeout
 }
 
+// volume：最大并发数量
 func (limiter *ConcurrentLimit) SetRate(volume int, _ int64) {
 	limiter.Lock()
 	defer limiter.Unlock()
-	limiter.concurrent = make(chan bool, volume)
+	limiter.volumn = volume
+	// 调高并发数量时唤醒等待的请求
+	close(limiter.released)
+	limiter.released = make(chan struct{})
+}
+
+func (limiter *ConcurrentLimit) GetSpeed() int64 { return -1 }
+
+func (limiter *ConcurrentLimit) Type() LimiterType { return CONCURRENT }
+
+// 并发限流器的配额在请求结束时归还，无法预估恢复时间
+func (limiter *ConcurrentLimit) Quota() (int, int, time.Duration) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.volumn < 0 {
+		return -1, -1, 0
+	}
+	remaining := limiter.volumn - limiter.inflight
+	if remaining < 0 {
+		remaining = 0
+	}
+	return limiter.volumn, remaining, 0
 }
-func (limiter *ConcurrentLimit) GetSpeed() int64 { return -1 }
\ No newline at end of file
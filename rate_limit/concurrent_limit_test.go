@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentLimiter(t *testing.T) {
+	limiter, err := Build("concurrent")
+	assert.NoError(t, err)
+	assert.NotNil(t, limiter)
+	limiter.SetRate(2, 0)
+	assert.Equal(t, 2, limiter.GetVolumn())
+
+	assert.NoError(t, limiter.Take())
+	assert.NoError(t, limiter.Take())
+	assert.Equal(t, NoReaminTokenError, limiter.Take())
+
+	// 请求结束之后归还
+	limiter.Done()
+	assert.NoError(t, limiter.Take())
+}
+
+func TestConcurrentLimiterTimeout(t *testing.T) {
+	limiter, err := Build("concurrent")
+	assert.NoError(t, err)
+	limiter.SetRate(1, 0)
+	assert.NoError(t, limiter.Take())
+
+	err = limiter.TakeWithTimeout(100 * time.Millisecond)
+	assert.Error(t, err)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		limiter.Done()
+	}()
+	err = limiter.TakeWithTimeout(time.Second)
+	assert.NoError(t, err)
+}
+
+func TestConcurrentLimiterUnlimited(t *testing.T) {
+	limiter, err := Build("concurrent")
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, limiter.Take())
+	}
+	limiter.Done()
+}
+
+func TestConcurrentLimiterSetRate(t *testing.T) {
+	limiter, err := Build("concurrent")
+	assert.NoError(t, err)
+	limiter.SetRate(2, 0)
+	assert.NoError(t, limiter.Take())
+	assert.NoError(t, limiter.Take())
+
+	// 修改并发数量之前获取的配额仍然计入
+	limiter.SetRate(1, 0)
+	assert.Equal(t, NoReaminTokenError, limiter.Take())
+	limiter.Done()
+	assert.Equal(t, NoReaminTokenError, limiter.Take())
+	limiter.Done()
+	assert.NoError(t, limiter.Take())
+	assert.Equal(t, NoReaminTokenError, limiter.Take())
+
+	// 调高并发数量之后等待的请求可以通过
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		limiter.SetRate(2, 0)
+	}()
+	assert.NoError(t, limiter.TakeWithTimeout(time.Second))
+}
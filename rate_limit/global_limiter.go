@@ -0,0 +1,165 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+/**
+*	集群全局限流器：speed 和 volumn 是整个集群共享的配额，
+*	本地的令牌桶只使用 leader 分配的份额。
+*	联系不到 leader 时退化为本地限流，使用完整的配额
+ */
+type GlobalLimiter struct {
+	*QpsRateLimiter
+	mu     sync.RWMutex
+	speed  int64
+	volumn int
+	share  float64
+	demand int64
+}
+
+// 节点上报的使用情况
+type QuotaUsage struct {
+	Speed  int64 `json:"speed"`
+	Demand int64 `json:"demand"`
+}
+
+func NewGlobalLimiter(volumn int, speed int64) *GlobalLimiter {
+	g := &GlobalLimiter{
+		QpsRateLimiter: NewQpsRateLimiter().(*QpsRateLimiter),
+	}
+	g.SetRate(volumn, speed)
+	return g
+}
+
+func (g *GlobalLimiter) Take() error {
+	atomic.AddInt64(&g.demand, 1)
+	return g.QpsRateLimiter.Take()
+}
+
+func (g *GlobalLimiter) TakeWithTimeout(timeout time.Duration) error {
+	atomic.AddInt64(&g.demand, 1)
+	return g.QpsRateLimiter.TakeWithTimeout(timeout)
+}
+
+// 设置整个集群的配额，在收到分配之前使用完整的配额
+func (g *GlobalLimiter) SetRate(volumn int, speed int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.volumn, g.speed = volumn, speed
+	g.share = float64(speed)
+	if speed > 0 {
+		g.QpsRateLimiter.Limiter = rate.NewLimiter(rate.Limit(speed), volumn)
+	}
+}
+
+func (g *GlobalLimiter) GetSpeed() int64 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.speed
+}
+
+func (g *GlobalLimiter) GetVolumn() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.volumn
+}
+
+// 取出上一个周期内的请求数量
+func (g *GlobalLimiter) Drain() QuotaUsage {
+	return QuotaUsage{
+		Speed:  g.GetSpeed(),
+		Demand: atomic.SwapInt64(&g.demand, 0),
+	}
+}
+
+// 按照分配的速率调整本地令牌桶，容量按相同比例缩放
+func (g *GlobalLimiter) SetShare(share float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.speed <= 0 {
+		return
+	}
+	g.share = share
+	burst := int(float64(g.volumn) * share / float64(g.speed))
+	if burst < 1 {
+		burst = 1
+	}
+	g.QpsRateLimiter.Limiter.SetLimit(rate.Limit(share))
+	g.QpsRateLimiter.Limiter.SetBurst(burst)
+}
+
+func (g *GlobalLimiter) GetShare() float64 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.share
+}
+
+// 退化为本地限流
+func (g *GlobalLimiter) Degrade() {
+	g.SetShare(float64(g.GetSpeed()))
+}
+
+/**
+*	leader 上的配额分配器，每个节点保留一小部分保底配额，
+*	其余的配额按照上一个周期各个节点的请求数量按比例分配
+ */
+type QuotaAggregator struct {
+	sync.Mutex
+	expire  time.Duration
+	reserve float64
+	usage   map[string]map[string]nodeUsage
+}
+
+type nodeUsage struct {
+	QuotaUsage
+	reportAt time.Time
+}
+
+func NewQuotaAggregator(expire time.Duration) *QuotaAggregator {
+	return &QuotaAggregator{
+		expire:  expire,
+		reserve: 0.1,
+		usage:   make(map[string]map[string]nodeUsage),
+	}
+}
+
+// 记录节点上报的使用情况，返回该节点的新份额
+func (a *QuotaAggregator) Report(node string, limits map[string]QuotaUsage) map[string]float64 {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	shares := make(map[string]float64, len(limits))
+	for key, usage := range limits {
+		nodes, has := a.usage[key]
+		if !has {
+			nodes = make(map[string]nodeUsage)
+			a.usage[key] = nodes
+		}
+		nodes[node] = nodeUsage{usage, now}
+		shares[key] = a.allocate(nodes, node, usage.Speed, now)
+	}
+	return shares
+}
+
+// 调用者需要持有锁
+func (a *QuotaAggregator) allocate(nodes map[string]nodeUsage, node string, speed int64, now time.Time) float64 {
+	var total int64
+	for name, u := range nodes {
+		if now.Sub(u.reportAt) > a.expire {
+			delete(nodes, name)
+			continue
+		}
+		total += u.Demand
+	}
+	n := float64(len(nodes))
+	if total == 0 {
+		return float64(speed) / n
+	}
+	reserve := float64(speed) * a.reserve / n
+	return reserve + float64(speed)*(1-a.reserve)*float64(nodes[node].Demand)/float64(total)
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobalLimiterShare(t *testing.T) {
+	limiter := NewGlobalLimiter(10, 10)
+	assert.Equal(t, QPS, limiter.Type())
+	assert.Equal(t, 10.0, limiter.GetShare())
+
+	// 份额减半之后容量也减半
+	limiter.SetShare(5)
+	success := 0
+	for i := 0; i < 10; i++ {
+		if limiter.Take() == nil {
+			success++
+		}
+	}
+	assert.Equal(t, 5, success)
+	usage := limiter.Drain()
+	assert.Equal(t, int64(10), usage.Demand)
+	assert.Equal(t, int64(10), usage.Speed)
+	assert.Equal(t, int64(0), limiter.Drain().Demand)
+
+	limiter.Degrade()
+	assert.Equal(t, 10.0, limiter.GetShare())
+}
+
+func TestQuotaAggregator(t *testing.T) {
+	a := NewQuotaAggregator(50 * time.Millisecond)
+	usage := func(demand int64) map[string]QuotaUsage {
+		return map[string]QuotaUsage{"/api/hello": {Speed: 100, Demand: demand}}
+	}
+	assert.Equal(t, 100.0, a.Report("a", usage(0))["/api/hello"])
+	assert.Equal(t, 50.0, a.Report("b", usage(0))["/api/hello"])
+	share := a.Report("a", usage(30))["/api/hello"]
+	assert.InDelta(t, 95.0, share, 0.001)
+
+	// 长时间没有上报的节点不再参与分配
+	time.Sleep(80 * time.Millisecond)
+	assert.Equal(t, 100.0, a.Report("a", usage(30))["/api/hello"])
+}
@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+var (
+	DefaultMaxKeys     = 10000
+	DefaultIdleTimeout = 10 * time.Minute
+)
+
+/**
+*	为每个客户端维护一个独立的限流器，客户端的数量由 LRU 限制，
+*	长时间没有请求的客户端会被淘汰。无法识别客户端的请求共享内嵌的限流器
+ */
+type KeyedLimiter struct {
+	RateLimiter
+	sync.Mutex
+	KeyBy   string
+	KeyName string
+	build   func() RateLimiter
+	buckets *simplelru.LRU
+	idle    time.Duration
+}
+
+type keyedBucket struct {
+	limiter  RateLimiter
+	lastSeen time.Time
+}
+
+func NewKeyedLimiter(build func() RateLimiter, maxKeys int, idle time.Duration) *KeyedLimiter {
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	buckets, _ := simplelru.NewLRU(maxKeys, nil)
+	return &KeyedLimiter{
+		RateLimiter: build(),
+		build:       build,
+		buckets:     buckets,
+		idle:        idle,
+	}
+}
+
+// 获取客户端对应的限流器，不存在时创建
+func (k *KeyedLimiter) Get(key string) RateLimiter {
+	if key == "" {
+		return k.RateLimiter
+	}
+	k.Lock()
+	defer k.Unlock()
+	now := time.Now()
+	k.evictIdle(now)
+	if v, has := k.buckets.Get(key); has {
+		bucket := v.(*keyedBucket)
+		bucket.lastSeen = now
+		return bucket.limiter
+	}
+	limiter := k.build()
+	k.buckets.Add(key, &keyedBucket{limiter, now})
+	return limiter
+}
+
+// 调用者需要持有锁，LRU 中最久没有访问的客户端在最前面
+func (k *KeyedLimiter) evictIdle(now time.Time) {
+	for {
+		_, v, has := k.buckets.GetOldest()
+		if !has || now.Sub(v.(*keyedBucket).lastSeen) < k.idle {
+			return
+		}
+		k.buckets.RemoveOldest()
+	}
+}
+
+func (k *KeyedLimiter) Len() int {
+	k.Lock()
+	defer k.Unlock()
+	return k.buckets.Len()
+}
+
+// 返回内嵌的限流器以及所有客户端的限流器
+func (k *KeyedLimiter) Limiters() []RateLimiter {
+	k.Lock()
+	defer k.Unlock()
+	res := make([]RateLimiter, 0, k.buckets.Len()+1)
+	res = append(res, k.RateLimiter)
+	for _, key := range k.buckets.Keys() {
+		if v, has := k.buckets.Peek(key); has {
+			res = append(res, v.(*keyedBucket).limiter)
+		}
+	}
+	return res
+}
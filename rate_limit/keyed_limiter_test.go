@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKeyedLimiter(maxKeys int, idle time.Duration) *KeyedLimiter {
+	return NewKeyedLimiter(func() RateLimiter {
+		l, _ := Build("sliding-log")
+		l.SetRate(1, 0)
+		return l
+	}, maxKeys, idle)
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	limiter := newTestKeyedLimiter(10, time.Minute)
+	assert.Equal(t, SLIDING_LOG, limiter.Type())
+
+	// 每个客户端拥有独立的配额
+	assert.NoError(t, limiter.Get("a").Take())
+	assert.Error(t, limiter.Get("a").Take())
+	assert.NoError(t, limiter.Get("b").Take())
+	assert.Equal(t, 2, limiter.Len())
+
+	// 无法识别的客户端共享同一个限流器
+	assert.NoError(t, limiter.Get("").Take())
+	assert.Error(t, limiter.Take())
+}
+
+func TestKeyedLimiterBounded(t *testing.T) {
+	limiter := newTestKeyedLimiter(2, time.Minute)
+	limiter.Get("a")
+	limiter.Get("b")
+	limiter.Get("c")
+	assert.Equal(t, 2, limiter.Len())
+}
+
+func TestKeyedLimiterIdle(t *testing.T) {
+	limiter := newTestKeyedLimiter(10, 50*time.Millisecond)
+	assert.NoError(t, limiter.Get("a").Take())
+	time.Sleep(80 * time.Millisecond)
+	// 空闲的客户端被淘汰之后重新创建
+	assert.NoError(t, limiter.Get("b").Take())
+	assert.Equal(t, 1, limiter.Len())
+	assert.NoError(t, limiter.Get("a").Take())
+}
@@ -2,6 +2,7 @@ package ratelimit
 
 import (
 	"context"
+	"math"
 	"sync"
 	"time"
 
@@ -15,7 +16,7 @@ type QpsRateLimiter struct {
 }
 
 func init() {
-	rateLimiterFactories["qps"] = NewQpsRateLimiter
+	rateLimiterFactories[QPS] = NewQpsRateLimiter
 }
 
 func NewQpsRateLimiter() RateLimiter {
@@ -44,6 +45,9 @@ func (r *QpsRateLimiter) TakeWithTimeout(timeout time.Duration) error {
 	return nil
 }
 
+// 令牌取走之后不需要归还
+func (r *QpsRateLimiter) Done() {}
+
 // init：初始化的个数
 // speed：一秒生成多少个 token
 func (r *QpsRateLimiter) SetRate(init int, speed int64) {
@@ -63,11 +67,39 @@ func (r *QpsRateLimiter) GetSpeed() int64 {
 func (r *QpsRateLimiter) GetTimeout() time.Duration {
 	r.RLock()
 	defer r.RUnlock()
-	return time.Duration(r.Timeout.Milliseconds())
+	if r.Timeout < 0 {
+		return 0
+	}
+	return r.Timeout
 }
 
 func (r *QpsRateLimiter) SetTimeout(time time.Duration) {
 	r.Lock()
 	defer r.Unlock()
 	r.Timeout = time
+}
+
+func (r *QpsRateLimiter) Type() LimiterType { return QPS }
+
+func (r *QpsRateLimiter) Quota() (int, int, time.Duration) {
+	limiter := r.Limiter
+	limit := limiter.Limit()
+	if limit == rate.Inf {
+		return -1, -1, 0
+	}
+	burst := limiter.Burst()
+	tokens := limiter.Tokens()
+	if tokens < 0 {
+		tokens = 0
+	}
+	remaining := int(math.Floor(tokens))
+	if limit <= 0 {
+		return burst, remaining, 0
+	}
+	// 配额用尽时等待下一个令牌，否则等待令牌桶装满
+	need := float64(burst) - tokens
+	if remaining == 0 {
+		need = 1 - tokens
+	}
+	return burst, remaining, time.Duration(need / float64(limit) * float64(time.Second))
 }
\ No newline at end of file
@@ -56,4 +56,20 @@ func TestQpsLimiterTimeout(t *testing.T) {
 	limiter.SetRate(0, 1)
 	err = limiter.TakeWithTimeout(500 * time.Millisecond)
 	assert.Error(t, err)
-}
\ No newline at end of file
+}
+func TestQpsLimiterQuota(t *testing.T) {
+	limiter, err := Build("qps")
+	assert.NoError(t, err)
+	limit, _, _ := limiter.(QuotaReporter).Quota()
+	assert.Equal(t, -1, limit)
+
+	limiter.SetRate(2, 1)
+	assert.NoError(t, limiter.Take())
+	limit, remaining, _ := limiter.(QuotaReporter).Quota()
+	assert.Equal(t, 2, limit)
+	assert.Equal(t, 1, remaining)
+	assert.NoError(t, limiter.Take())
+	_, remaining, reset := limiter.(QuotaReporter).Quota()
+	assert.Equal(t, 0, remaining)
+	assert.True(t, reset > 0 && reset <= time.Second)
+}
@@ -0,0 +1,273 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 没有配置超时时间时，请求在队列中最多等待的时间
+var DefaultQueueTimeout = 10 * time.Second
+
+/**
+*	漏桶限流器：超过速率的请求不会立即拒绝，而是进入等待队列，按照配置的速率依次放行。
+*	队列按照优先级分为多个通道，高优先级的通道先放行，同一个通道内先进先出。
+*	队列已满或者预计等待时间超过超时时间的请求会被拒绝
+*	PriorityHeader: 决定优先级的请求头
+*	Lanes: 请求头的取值，按照优先级从高到低排列，其余的取值进入最低优先级的通道
+ */
+type QueueLimiter struct {
+	sync.Mutex
+	PriorityHeader string
+	Lanes          []string
+	lanes          [][]*queueWaiter
+	queued         int
+	size           int
+	speed          int64
+	interval       time.Duration
+	next           time.Time // 下一个请求可以放行的时间
+	timer          *time.Timer
+	timeout        time.Duration
+}
+
+type queueWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func init() {
+	rateLimiterFactories[QUEUE] = NewQueueLimiter
+}
+
+func NewQueueLimiter() RateLimiter {
+	return &QueueLimiter{
+		lanes:   make([][]*queueWaiter, 1),
+		size:    -1,
+		timeout: -1,
+	}
+}
+
+// 请求头的取值对应的通道，0 的优先级最高
+func (r *QueueLimiter) Lane(value string) int {
+	for idx, lane := range r.Lanes {
+		if lane == value {
+			return idx
+		}
+	}
+	return len(r.Lanes)
+}
+
+func (r *QueueLimiter) Take() error {
+	return r.TakeWithPriority(context.Background(), r.Lane(""), r.GetTimeout())
+}
+
+func (r *QueueLimiter) TakeWithTimeout(timeout time.Duration) error {
+	return r.TakeWithPriority(context.Background(), r.Lane(""), timeout)
+}
+
+// 在指定的通道中排队，超时时间为 0 时使用默认的超时时间。
+// ctx 结束时（客户端断开连接）离开队列并返回 ctx.Err()，不占用放行的名额
+func (r *QueueLimiter) TakeWithPriority(ctx context.Context, lane int, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultQueueTimeout
+	}
+	r.Lock()
+	if r.interval <= 0 {
+		r.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if r.queued == 0 && !now.Before(r.next) {
+		r.next = now.Add(r.interval)
+		r.Unlock()
+		return nil
+	}
+	if r.queued >= r.size {
+		r.Unlock()
+		return NoReaminTokenError
+	}
+	if lane >= len(r.lanes) {
+		lane = len(r.lanes) - 1
+	}
+	// 排在前面的请求放行之前无法通过，预计等待时间超过超时时间时直接拒绝
+	ahead := 0
+	for idx := 0; idx <= lane; idx++ {
+		ahead += len(r.lanes[idx])
+	}
+	if r.next.Sub(now)+time.Duration(ahead)*r.interval > timeout {
+		r.Unlock()
+		return NoReaminTokenError
+	}
+	waiter := &queueWaiter{ready: make(chan struct{})}
+	r.lanes[lane] = append(r.lanes[lane], waiter)
+	r.queued++
+	r.schedule(now)
+	r.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	err := NoReaminTokenError
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	r.Lock()
+	defer r.Unlock()
+	// 超时的同时被放行
+	if waiter.granted {
+		return nil
+	}
+	r.remove(lane, waiter)
+	return err
+}
+
+// 调用者需要持有锁，队列不为空时在下一个请求可以放行的时间唤醒
+func (r *QueueLimiter) schedule(now time.Time) {
+	if r.timer != nil || r.queued == 0 {
+		return
+	}
+	r.timer = time.AfterFunc(r.next.Sub(now), r.dispatch)
+}
+
+func (r *QueueLimiter) dispatch() {
+	r.Lock()
+	defer r.Unlock()
+	r.timer = nil
+	now := time.Now()
+	for r.queued > 0 && (r.interval <= 0 || !now.Before(r.next)) {
+		waiter := r.pop()
+		waiter.granted = true
+		close(waiter.ready)
+		if r.next.Before(now) {
+			r.next = now
+		}
+		r.next = r.next.Add(r.interval)
+	}
+	r.schedule(now)
+}
+
+// 调用者需要持有锁，取出优先级最高的请求
+func (r *QueueLimiter) pop() *queueWaiter {
+	for idx, lane := range r.lanes {
+		if len(lane) == 0 {
+			continue
+		}
+		waiter := lane[0]
+		r.lanes[idx] = lane[1:]
+		r.queued--
+		return waiter
+	}
+	return nil
+}
+
+// 调用者需要持有锁
+func (r *QueueLimiter) remove(lane int, waiter *queueWaiter) {
+	waiters := r.lanes[lane]
+	for idx, w := range waiters {
+		if w == waiter {
+			r.lanes[lane] = append(waiters[:idx:idx], waiters[idx+1:]...)
+			r.queued--
+			return
+		}
+	}
+}
+
+func (r *QueueLimiter) Done() {}
+
+// size：队列的最大长度
+// speed：一秒放行多少个请求
+func (r *QueueLimiter) SetRate(size int, speed int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.size = size
+	r.speed = speed
+	r.interval = 0
+	if speed > 0 {
+		r.interval = time.Second / time.Duration(speed)
+	}
+}
+
+// 设置优先级通道，需要在限流器开始使用之前调用
+func (r *QueueLimiter) SetLanes(header string, lanes []string) {
+	r.Lock()
+	defer r.Unlock()
+	r.PriorityHeader = header
+	r.Lanes = lanes
+	r.lanes = make([][]*queueWaiter, len(lanes)+1)
+}
+
+// 当前每个通道中排队的请求数量，按照优先级从高到低排列
+func (r *QueueLimiter) Depth() []int {
+	r.Lock()
+	defer r.Unlock()
+	res := make([]int, len(r.lanes))
+	for idx, lane := range r.lanes {
+		res[idx] = len(lane)
+	}
+	return res
+}
+
+func (r *QueueLimiter) Queued() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.queued
+}
+
+/**
+*	汇总排队限流器中正在排队的请求数量以及每个通道的数量
+*	按客户端限流时汇总所有客户端的队列，不是排队限流器时返回 false
+ */
+func QueueDepth(limiter RateLimiter) (int, []int, bool) {
+	limiters := []RateLimiter{limiter}
+	if keyed, ok := limiter.(*KeyedLimiter); ok {
+		limiters = keyed.Limiters()
+	}
+	queued, lanes, found := 0, []int(nil), false
+	for _, l := range limiters {
+		queue, ok := l.(*QueueLimiter)
+		if !ok {
+			continue
+		}
+		found = true
+		queued += queue.Queued()
+		for idx, depth := range queue.Depth() {
+			if idx == len(lanes) {
+				lanes = append(lanes, 0)
+			}
+			lanes[idx] += depth
+		}
+	}
+	return queued, lanes, found
+}
+
+func (r *QueueLimiter) GetVolumn() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.size
+}
+
+func (r *QueueLimiter) GetSpeed() int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.speed
+}
+
+func (r *QueueLimiter) GetTimeout() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	if r.timeout < 0 {
+		return 0
+	}
+	return r.timeout
+}
+
+func (r *QueueLimiter) SetTimeout(timeout time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.timeout = timeout
+}
+
+func (r *QueueLimiter) Type() LimiterType { return QUEUE }
@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueLimiter(t *testing.T) {
+	limiter, err := Build("queue")
+	assert.NoError(t, err)
+	// 每 100ms 放行一个请求，最多排队 2 个
+	limiter.SetRate(2, 10)
+
+	start := time.Now()
+	assert.NoError(t, limiter.Take())
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, limiter.TakeWithTimeout(time.Second))
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 2, limiter.(*QueueLimiter).Queued())
+	// 队列已满
+	assert.Equal(t, NoReaminTokenError, limiter.TakeWithTimeout(time.Second))
+	wg.Wait()
+	assert.True(t, time.Since(start) >= 150*time.Millisecond)
+	assert.Equal(t, 0, limiter.(*QueueLimiter).Queued())
+}
+
+func TestQueueLimiterTimeout(t *testing.T) {
+	limiter, err := Build("queue")
+	assert.NoError(t, err)
+	limiter.SetRate(10, 1)
+	assert.NoError(t, limiter.Take())
+	// 预计等待时间超过超时时间，直接拒绝
+	assert.Equal(t, NoReaminTokenError, limiter.TakeWithTimeout(100*time.Millisecond))
+	assert.Equal(t, 0, limiter.(*QueueLimiter).Queued())
+}
+
+func TestQueueLimiterPriority(t *testing.T) {
+	limiter := NewQueueLimiter().(*QueueLimiter)
+	limiter.SetRate(10, 10)
+	limiter.SetLanes("X-Priority", []string{"high"})
+	assert.Equal(t, 0, limiter.Lane("high"))
+	assert.Equal(t, 1, limiter.Lane("low"))
+
+	assert.NoError(t, limiter.Take())
+	order := make(chan string, 2)
+	go func() {
+		assert.NoError(t, limiter.TakeWithPriority(context.Background(), limiter.Lane("low"), time.Second))
+		order <- "low"
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		assert.NoError(t, limiter.TakeWithPriority(context.Background(), limiter.Lane("high"), time.Second))
+		order <- "high"
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []int{1, 1}, limiter.Depth())
+	assert.Equal(t, "high", <-order)
+	assert.Equal(t, "low", <-order)
+}
+
+func TestQueueLimiterCancel(t *testing.T) {
+	limiter := NewQueueLimiter().(*QueueLimiter)
+	limiter.SetRate(10, 10)
+	assert.NoError(t, limiter.Take())
+
+	// 客户端断开连接之后离开队列
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- limiter.TakeWithPriority(ctx, limiter.Lane(""), time.Second)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, limiter.Queued())
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, 0, limiter.Queued())
+
+	// 离开队列的请求不占用放行的名额
+	start := time.Now()
+	assert.NoError(t, limiter.TakeWithTimeout(time.Second))
+	assert.Less(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestQueueDepthKeyed(t *testing.T) {
+	keyed := NewKeyedLimiter(func() RateLimiter {
+		l := NewQueueLimiter().(*QueueLimiter)
+		l.SetRate(10, 10)
+		l.SetLanes("X-Priority", []string{"high"})
+		return l
+	}, 10, time.Minute)
+	_, _, ok := QueueDepth(newTestKeyedLimiter(10, time.Minute))
+	assert.False(t, ok)
+
+	// 每个客户端各有一个请求在排队，汇总所有客户端的队列
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, key := range []string{"a", "b"} {
+		queue := keyed.Get(key).(*QueueLimiter)
+		assert.NoError(t, queue.Take())
+		go queue.TakeWithPriority(ctx, queue.Lane(key), time.Second)
+	}
+	assert.Eventually(t, func() bool {
+		queued, _, _ := QueueDepth(keyed)
+		return queued == 2
+	}, time.Second, 10*time.Millisecond)
+	queued, lanes, ok := QueueDepth(keyed)
+	assert.True(t, ok)
+	assert.Equal(t, 2, queued)
+	assert.Equal(t, []int{0, 2}, lanes)
+}
@@ -7,17 +7,39 @@ import (
 
 type LimiterType string
 
+const (
+	QPS            LimiterType = "qps"
+	CONCURRENT     LimiterType = "concurrent"
+	SLIDING_LOG    LimiterType = "sliding-log"
+	SLIDING_WINDOW LimiterType = "sliding-window"
+	QUEUE          LimiterType = "queue"
+	ADAPTIVE       LimiterType = "adaptive"
+)
+
 /**
 限流器在整个程序内部中会被频繁创建，由此采用工厂设计模式
+Take 成功之后，请求结束时需要调用 Done
 */
 type RateLimiter interface {
 	Take() error
 	TakeWithTimeout(time.Duration) error
+	Done()
 	SetRate(int, int64) // 设置速率
 	GetVolumn() int
 	GetSpeed() int64
 	GetTimeout() time.Duration
 	SetTimeout(time.Duration)
+	Type() LimiterType
+}
+
+/**
+*	限流器当前的配额，用于生成 RateLimit-* 响应头
+*	limit：窗口内允许的请求数量，小于 0 代表没有限制
+*	remaining：剩余的请求数量
+*	reset：配额用尽时为下一次请求可以通过的等待时间，否则为配额完全恢复的时间
+ */
+type QuotaReporter interface {
+	Quota() (limit int, remaining int, reset time.Duration)
 }
 
 type RateLimiterFactory func() RateLimiter
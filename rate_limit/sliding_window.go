@@ -0,0 +1,301 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// 默认的窗口长度
+var DefaultWindow = time.Minute
+
+// 按时间窗口计数的限流器，例如每分钟 1000 次请求
+type WindowLimiter interface {
+	SetWindow(time.Duration)
+	GetWindow() time.Duration
+}
+
+/**
+*	滑动日志：记录窗口内每一次请求的时间，精确但是内存占用与 limit 成正比
+ */
+type SlidingLogLimiter struct {
+	sync.Mutex
+	logs    []time.Time
+	limit   int
+	window  time.Duration
+	timeout time.Duration
+}
+
+/**
+*	滑动窗口计数：只记录当前窗口和上一个窗口的请求数量，
+*	按照上一个窗口与滑动窗口重叠的比例估算请求数量
+ */
+type SlidingWindowLimiter struct {
+	sync.Mutex
+	start   time.Time
+	curr    int
+	prev    int
+	limit   int
+	window  time.Duration
+	timeout time.Duration
+}
+
+func init() {
+	rateLimiterFactories[SLIDING_LOG] = NewSlidingLogLimiter
+	rateLimiterFactories[SLIDING_WINDOW] = NewSlidingWindowLimiter
+}
+
+func NewSlidingLogLimiter() RateLimiter {
+	return &SlidingLogLimiter{
+		logs:    make([]time.Time, 0),
+		limit:   -1,
+		window:  DefaultWindow,
+		timeout: -1,
+	}
+}
+
+func (r *SlidingLogLimiter) Take() error {
+	_, err := r.take(time.Now())
+	return err
+}
+
+// 返回下一次可能获取成功需要等待的时间
+func (r *SlidingLogLimiter) take(now time.Time) (time.Duration, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.limit < 0 {
+		return 0, nil
+	}
+	r.evict(now)
+	if len(r.logs) < r.limit {
+		r.logs = append(r.logs, now)
+		return 0, nil
+	}
+	if len(r.logs) == 0 {
+		return r.window, NoReaminTokenError
+	}
+	return r.logs[0].Add(r.window).Sub(now), NoReaminTokenError
+}
+
+// 调用者需要持有锁
+func (r *SlidingLogLimiter) evict(now time.Time) {
+	boundary := now.Add(-r.window)
+	idx := 0
+	for idx < len(r.logs) && !r.logs[idx].After(boundary) {
+		idx++
+	}
+	r.logs = r.logs[idx:]
+}
+
+func (r *SlidingLogLimiter) TakeWithTimeout(timeout time.Duration) error {
+	return waitUntil(timeout, r.take)
+}
+
+func (r *SlidingLogLimiter) Done() {}
+
+func (r *SlidingLogLimiter) SetRate(limit int, _ int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.limit = limit
+	r.logs = make([]time.Time, 0, limit)
+}
+
+func (r *SlidingLogLimiter) GetVolumn() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.limit
+}
+
+func (r *SlidingLogLimiter) GetSpeed() int64 { return -1 }
+
+func (r *SlidingLogLimiter) GetTimeout() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	if r.timeout < 0 {
+		return 0
+	}
+	return r.timeout
+}
+
+func (r *SlidingLogLimiter) SetTimeout(timeout time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.timeout = timeout
+}
+
+func (r *SlidingLogLimiter) SetWindow(window time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.window = window
+}
+
+func (r *SlidingLogLimiter) GetWindow() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	return r.window
+}
+
+func (r *SlidingLogLimiter) Type() LimiterType { return SLIDING_LOG }
+
+func (r *SlidingLogLimiter) Quota() (int, int, time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	if r.limit < 0 {
+		return -1, -1, 0
+	}
+	now := time.Now()
+	r.evict(now)
+	remaining := r.limit - len(r.logs)
+	if remaining < 0 {
+		remaining = 0
+	}
+	if len(r.logs) == 0 {
+		return r.limit, remaining, 0
+	}
+	// 配额用尽时等待最早的请求滑出窗口，否则等待所有请求滑出窗口
+	reset := r.logs[len(r.logs)-1].Add(r.window).Sub(now)
+	if remaining == 0 {
+		reset = r.logs[0].Add(r.window).Sub(now)
+	}
+	return r.limit, remaining, reset
+}
+
+func NewSlidingWindowLimiter() RateLimiter {
+	return &SlidingWindowLimiter{
+		start:   time.Now(),
+		limit:   -1,
+		window:  DefaultWindow,
+		timeout: -1,
+	}
+}
+
+func (r *SlidingWindowLimiter) Take() error {
+	_, err := r.take(time.Now())
+	return err
+}
+
+func (r *SlidingWindowLimiter) take(now time.Time) (time.Duration, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.limit < 0 {
+		return 0, nil
+	}
+	r.advance(now)
+	elapsed := now.Sub(r.start)
+	weight := float64(r.window-elapsed) / float64(r.window)
+	if float64(r.prev)*weight+float64(r.curr) < float64(r.limit) {
+		r.curr++
+		return 0, nil
+	}
+	// 当前窗口已满时只能等到下一个窗口，否则等待上一个窗口的权重降低
+	if r.curr >= r.limit || r.prev == 0 {
+		return r.window - elapsed, NoReaminTokenError
+	}
+	// prev * (window - elapsed) / window + curr < limit
+	wait := time.Duration(float64(r.window)*(1-float64(r.limit-r.curr)/float64(r.prev))) - elapsed
+	if wait <= 0 {
+		wait = time.Millisecond
+	}
+	return wait, NoReaminTokenError
+}
+
+// 调用者需要持有锁，根据当前时间滚动窗口
+func (r *SlidingWindowLimiter) advance(now time.Time) {
+	elapsed := now.Sub(r.start)
+	if elapsed < r.window {
+		return
+	}
+	windows := elapsed / r.window
+	if windows == 1 {
+		r.prev = r.curr
+	} else {
+		r.prev = 0
+	}
+	r.curr = 0
+	r.start = r.start.Add(windows * r.window)
+}
+
+func (r *SlidingWindowLimiter) TakeWithTimeout(timeout time.Duration) error {
+	return waitUntil(timeout, r.take)
+}
+
+func (r *SlidingWindowLimiter) Done() {}
+
+func (r *SlidingWindowLimiter) SetRate(limit int, _ int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.limit = limit
+}
+
+func (r *SlidingWindowLimiter) GetVolumn() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.limit
+}
+
+func (r *SlidingWindowLimiter) GetSpeed() int64 { return -1 }
+
+func (r *SlidingWindowLimiter) GetTimeout() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	if r.timeout < 0 {
+		return 0
+	}
+	return r.timeout
+}
+
+func (r *SlidingWindowLimiter) SetTimeout(timeout time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.timeout = timeout
+}
+
+func (r *SlidingWindowLimiter) SetWindow(window time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.window = window
+	r.start = time.Now()
+	r.prev, r.curr = 0, 0
+}
+
+func (r *SlidingWindowLimiter) GetWindow() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	return r.window
+}
+
+func (r *SlidingWindowLimiter) Type() LimiterType { return SLIDING_WINDOW }
+
+// 滑动窗口计数只能估算剩余数量，恢复时间取当前窗口结束的时间
+func (r *SlidingWindowLimiter) Quota() (int, int, time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	if r.limit < 0 {
+		return -1, -1, 0
+	}
+	now := time.Now()
+	r.advance(now)
+	elapsed := now.Sub(r.start)
+	weight := float64(r.window-elapsed) / float64(r.window)
+	remaining := int(math.Floor(float64(r.limit) - float64(r.prev)*weight - float64(r.curr)))
+	if remaining < 0 {
+		remaining = 0
+	}
+	return r.limit, remaining, r.window - elapsed
+}
+
+// 在超时时间内不断尝试获取，每次等待到下一次可能成功的时间
+func waitUntil(timeout time.Duration, take func(time.Time) (time.Duration, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		now := time.Now()
+		wait, err := take(now)
+		if err == nil {
+			return nil
+		}
+		if now.Add(wait).After(deadline) {
+			return NoReaminTokenError
+		}
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlidingLogLimiter(t *testing.T) {
+	limiter, err := Build("sliding-log")
+	assert.NoError(t, err)
+	assert.Equal(t, SLIDING_LOG, limiter.Type())
+	limiter.SetRate(3, 0)
+	limiter.(WindowLimiter).SetWindow(200 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, limiter.Take())
+	}
+	assert.Error(t, limiter.Take())
+	time.Sleep(220 * time.Millisecond)
+	assert.NoError(t, limiter.Take())
+}
+
+func TestSlidingLogLimiterTimeout(t *testing.T) {
+	limiter, err := Build("sliding-log")
+	assert.NoError(t, err)
+	limiter.SetRate(1, 0)
+	limiter.(WindowLimiter).SetWindow(200 * time.Millisecond)
+	assert.NoError(t, limiter.Take())
+	assert.Error(t, limiter.TakeWithTimeout(50*time.Millisecond))
+	assert.NoError(t, limiter.TakeWithTimeout(300*time.Millisecond))
+}
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	limiter, err := Build("sliding-window")
+	assert.NoError(t, err)
+	assert.Equal(t, SLIDING_WINDOW, limiter.Type())
+	limiter.SetRate(4, 0)
+	limiter.(WindowLimiter).SetWindow(200 * time.Millisecond)
+	assert.Equal(t, 200*time.Millisecond, limiter.(WindowLimiter).GetWindow())
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, limiter.Take())
+	}
+	assert.Error(t, limiter.Take())
+
+	// 进入下一个窗口之后，上一个窗口的请求按照重叠比例计算
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, limiter.Take())
+	assert.NoError(t, limiter.Take())
+	success := 0
+	for i := 0; i < 2; i++ {
+		if limiter.Take() == nil {
+			success++
+		}
+	}
+	assert.Less(t, success, 2)
+}
+
+func TestSlidingWindowLimiterTimeout(t *testing.T) {
+	limiter, err := Build("sliding-window")
+	assert.NoError(t, err)
+	limiter.SetRate(1, 0)
+	limiter.(WindowLimiter).SetWindow(100 * time.Millisecond)
+	assert.NoError(t, limiter.Take())
+	assert.Error(t, limiter.TakeWithTimeout(10*time.Millisecond))
+	assert.NoError(t, limiter.TakeWithTimeout(500*time.Millisecond))
+}
+
+func TestWindowLimiterUnlimited(t *testing.T) {
+	for _, tp := range []LimiterType{SLIDING_LOG, SLIDING_WINDOW} {
+		limiter, err := Build(tp)
+		assert.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, limiter.Take())
+		}
+	}
+}
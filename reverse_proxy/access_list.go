@@ -0,0 +1,63 @@
+package reverseproxy
+
+import (
+	"fmt"
+
+	"github.com/qiancijun/cheryl/acl"
+	"github.com/qiancijun/cheryl/config"
+)
+
+// 修改 location 的访问控制列表，并且记录到 Locations 中用于快照恢复
+func (proxyMap *ProxyMap) updateAccessList(pattern string, update func(*acl.AccessList) error) error {
+	httpProxy, has := proxyMap.GetProxy(pattern)
+	if !has {
+		return fmt.Errorf("can't find the reverseproxy with the pattern %s", pattern)
+	}
+	access := httpProxy.getAccessList()
+	if access == nil {
+		return fmt.Errorf("the acl of location %s is invaild", pattern)
+	}
+	if err := update(access); err != nil {
+		return err
+	}
+	conf := access.Config()
+	httpProxy.Lock()
+	httpProxy.location.Acl = conf
+	httpProxy.Unlock()
+
+	proxyMap.Lock()
+	defer proxyMap.Unlock()
+	location := proxyMap.Locations[pattern]
+	location.Acl = conf
+	proxyMap.Locations[pattern] = location
+	return nil
+}
+
+func (proxyMap *ProxyMap) AddAccessRule(pattern string, rule config.AclRule, index int) error {
+	return proxyMap.updateAccessList(pattern, func(access *acl.AccessList) error {
+		return access.AddRule(rule, index)
+	})
+}
+
+func (proxyMap *ProxyMap) DeleteAccessRule(pattern string, rule config.AclRule) error {
+	return proxyMap.updateAccessList(pattern, func(access *acl.AccessList) error {
+		return access.DeleteRule(rule)
+	})
+}
+
+func (proxyMap *ProxyMap) SetAccessDefault(pattern string, policy string) error {
+	return proxyMap.updateAccessList(pattern, func(access *acl.AccessList) error {
+		return access.SetDefault(policy)
+	})
+}
+
+// 每个 location 的访问控制列表
+func (proxyMap *ProxyMap) AccessLists() map[string]config.AccessList {
+	res := make(map[string]config.AccessList)
+	for pattern, httpProxy := range proxyMap.Proxies() {
+		if access := httpProxy.getAccessList(); access != nil {
+			res[pattern] = access.Config()
+		}
+	}
+	return res
+}
@@ -0,0 +1,61 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qiancijun/cheryl/acl"
+	"github.com/qiancijun/cheryl/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationAccessList(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	defer m.Close()
+	assert.Error(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/invalid",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+		Acl:         config.AccessList{Default: "maybe"},
+	}))
+	assert.NoError(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/admin",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+		Acl: config.AccessList{
+			Default: acl.DENY,
+			Rules:   []config.AclRule{{Action: acl.ALLOW, Cidr: "10.0.0.0/8"}},
+		},
+	}))
+	assert.NoError(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/public",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+	}))
+
+	request := func(path, remoteAddr string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		RouterSingleton.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, request("/admin/users", "10.0.0.1:1234"))
+	assert.Equal(t, http.StatusForbidden, request("/admin/users", "192.0.2.1:1234"))
+	assert.Equal(t, http.StatusOK, request("/public/users", "192.0.2.1:1234"))
+
+	// 修改之后记录到 Locations 中，用于快照恢复
+	assert.NoError(t, m.AddAccessRule("/admin", config.AclRule{Action: acl.ALLOW, Cidr: "192.0.2.0/24"}, 0))
+	assert.Equal(t, http.StatusOK, request("/admin/users", "192.0.2.1:1234"))
+	assert.Equal(t, 2, len(m.Locations["/admin"].Acl.Rules))
+	assert.NoError(t, m.SetAccessDefault("/public", acl.DENY))
+	assert.Equal(t, http.StatusForbidden, request("/public/users", "192.0.2.1:1234"))
+	assert.Equal(t, acl.DENY, m.AccessLists()["/public"].Default)
+	assert.Error(t, m.SetAccessDefault("/missing", acl.DENY))
+}
@@ -0,0 +1,78 @@
+package reverseproxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/qiancijun/cheryl/config"
+	ratelimit "github.com/qiancijun/cheryl/rate_limit"
+)
+
+// 按照 location 的配置创建自适应并发限流器，没有启用时返回 nil
+func newLocationAdaptive(conf config.Adaptive) *ratelimit.AdaptiveLimiter {
+	if conf.Limit <= 0 {
+		return nil
+	}
+	limiter := ratelimit.NewAdaptiveLimiter().(*ratelimit.AdaptiveLimiter)
+	limiter.SetRate(conf.Limit, int64(conf.MaxLimit))
+	if conf.Timeout > 0 {
+		limiter.SetTimeout(time.Duration(conf.Timeout) * time.Millisecond)
+	}
+	return limiter
+}
+
+// location 的自适应并发限流器，没有启用时返回 nil
+func (h *HTTPProxy) GetAdaptive() *ratelimit.AdaptiveLimiter {
+	h.RLock()
+	defer h.RUnlock()
+	return h.adaptive
+}
+
+/**
+*	获取 location 的自适应并发限流的配额，超过并发数量时返回 OverloadError。
+*	返回的函数在请求结束时调用，传入上游的响应时间，没有转发到上游时传入 0
+ */
+func (h *HTTPProxy) takeAdaptive() (func(time.Duration), error) {
+	adaptive := h.GetAdaptive()
+	if adaptive == nil {
+		return func(time.Duration) {}, nil
+	}
+	var err error
+	if timeout := adaptive.GetTimeout(); timeout == 0 {
+		err = adaptive.Take()
+	} else {
+		err = adaptive.TakeWithTimeout(timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func(rtt time.Duration) {
+		if rtt > 0 {
+			adaptive.Observe(rtt)
+		}
+		adaptive.Done()
+	}, nil
+}
+
+type roundTripKey struct{}
+
+// 上游的往返时间，只在 ModifyResponse 中记录，连接失败等转发错误不会经过这里
+type roundTrip struct {
+	start time.Time
+	rtt   time.Duration
+}
+
+func withRoundTrip(req *http.Request) (*http.Request, *roundTrip) {
+	trip := &roundTrip{start: time.Now()}
+	return req.WithContext(context.WithValue(req.Context(), roundTripKey{}, trip)), trip
+}
+
+// 上游返回 5xx 时不记录，快速失败的响应会拉低最小响应时间并且错误地缩小并发数量
+func recordRoundTrip(resp *http.Response) {
+	trip, ok := resp.Request.Context().Value(roundTripKey{}).(*roundTrip)
+	if !ok || resp.StatusCode >= http.StatusInternalServerError {
+		return
+	}
+	trip.rtt = time.Since(trip.start)
+}
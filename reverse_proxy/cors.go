@@ -0,0 +1,30 @@
+package reverseproxy
+
+import (
+	"net/http"
+
+	"github.com/qiancijun/cheryl/cors"
+)
+
+func (h *HTTPProxy) getCors() *cors.Policy {
+	h.RLock()
+	defer h.RUnlock()
+	return h.corsPolicy
+}
+
+/**
+*	处理 location 的跨域策略，预检请求直接响应并且返回 true
+*	其他请求先在响应中设置跨域响应头，网关自己返回的错误也可以被浏览器读取
+ */
+func (h *HTTPProxy) handleCors(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	policy := h.getCors()
+	if policy == nil {
+		return r, false
+	}
+	if cors.IsPreflight(r) {
+		policy.Preflight(w, r)
+		return r, true
+	}
+	policy.SetHeaders(w.Header(), r.Header.Get("Origin"))
+	return cors.WithPolicy(r, policy), false
+}
@@ -0,0 +1,128 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/cors"
+	"github.com/qiancijun/cheryl/filter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationCors(t *testing.T) {
+	var hits int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set(cors.AllowOrigin, "*")
+		w.Header().Set(cors.AllowMethods, "GET, PUT, DELETE")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	defer m.Close()
+	assert.Error(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/invalid",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+		Cors:        config.Cors{AllowOrigins: []string{"~(["}},
+	}))
+	assert.NoError(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/spa",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+		Cors: config.Cors{
+			AllowOrigins:     []string{"https://app.example.com"},
+			AllowMethods:     []string{"GET", "PUT"},
+			AllowCredentials: true,
+		},
+	}))
+	httpProxy, _ := m.GetProxy("/spa")
+	assert.NoError(t, httpProxy.SetRateLimiter(LimiterInfo{
+		PathName:    "/users",
+		LimiterType: "sliding-log",
+		Volumn:      1,
+		Window:      60000,
+	}))
+
+	request := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/spa/users", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		RouterSingleton.ServeHTTP(w, req)
+		return w
+	}
+
+	// 预检请求由网关响应，不转发给上游也不消耗令牌
+	for i := 0; i < 3; i++ {
+		w := request(http.MethodOptions, map[string]string{"Origin": "https://app.example.com", cors.RequestMethod: "PUT"})
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "https://app.example.com", w.Header().Get(cors.AllowOrigin))
+		assert.Equal(t, "PUT", w.Header().Get(cors.AllowMethods))
+	}
+	assert.Equal(t, int64(0), atomic.LoadInt64(&hits))
+
+	// 上游的跨域响应头被替换为 location 的策略
+	w := request(http.MethodPut, map[string]string{"Origin": "https://app.example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"https://app.example.com"}, w.Header().Values(cors.AllowOrigin))
+	assert.Equal(t, "true", w.Header().Get(cors.AllowCredentials))
+	assert.Empty(t, w.Header().Get(cors.AllowMethods))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&hits))
+
+	// 网关返回的错误也携带跨域响应头
+	w = request(http.MethodGet, map[string]string{"Origin": "https://app.example.com"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get(cors.AllowOrigin))
+
+	w = request(http.MethodOptions, map[string]string{"Origin": "https://evil.com", cors.RequestMethod: "GET"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&hits))
+}
+
+func TestPreflightBeforeGlobalFilters(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	defer m.Close()
+	defer filter.SetGlobalChain(nil)
+	assert.NoError(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/cors-auth",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+		Cors:        config.Cors{AllowOrigins: []string{"https://app.example.com"}},
+	}))
+	assert.NoError(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/no-cors",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+	}))
+	assert.NoError(t, m.SetFilters("", []config.FilterConfig{{Name: filter.CONSUMER_AUTH}}))
+
+	preflight := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set(cors.RequestMethod, "GET")
+		w := httptest.NewRecorder()
+		RouterSingleton.ServeHTTP(w, req)
+		return w
+	}
+	// 预检请求不携带凭证，不会被全局的认证过滤器拒绝
+	w := preflight("/cors-auth/users")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get(cors.AllowOrigin))
+
+	// 实际的请求和没有跨域策略的 location 仍然需要认证
+	w = httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cors-auth/users", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, preflight("/no-cors/users").Code)
+}
@@ -4,10 +4,15 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/qiancijun/cheryl/acl"
+	"github.com/qiancijun/cheryl/ban"
+	"github.com/qiancijun/cheryl/cors"
 	"github.com/qiancijun/cheryl/filter"
 	"github.com/qiancijun/cheryl/logger"
+	"github.com/qiancijun/cheryl/quota"
+	ratelimit "github.com/qiancijun/cheryl/rate_limit"
 	"github.com/qiancijun/cheryl/utils"
 )
 
@@ -36,42 +41,111 @@ func (r *DefaultRouter) HasPrefix(p string) bool {
 	return has
 }
 
+func (r *DefaultRouter) get(p string) *HTTPProxy {
+	r.RLock()
+	defer r.RUnlock()
+	return r.hosts[p]
+}
+
 /*
 	执行方法的顺序：
 	1. 判断 ip 是否在黑名单内 （acl）
-	2. 执行一遍 FilterChain 的方法 
-	3. 根据 path 找到反向代理
-	4. 限流
-	5. 根据反向代理中的主机路径，进行负载均衡
-	6. 找出一个转发的主机，转发请求
+	2. 跨域预检请求由匹配的 location 直接响应
+	3. 执行全局的过滤器链，所有过滤器放行之后继续
+	4. 根据 path 找到反向代理，检查 location 的访问控制列表，设置跨域响应头，执行 location 的过滤器链
+	5. 限流
+	6. 根据反向代理中的主机路径，进行负载均衡
+	7. 检查消费者的配额
+	8. 找出一个转发的主机，转发请求
 */
 func (r *DefaultRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	
 	logger.Infof("%s can't catch any path", req.URL)
 	defer req.Body.Close()
+	// 解析客户端的真实地址，之后的访问控制、限流和负载均衡都使用同一个地址
+	req = utils.WithClientIP(req)
 	// accessControlList
-	isDeny := acl.AccessControlList.AccessControl(utils.RemoteIp(req))
+	_, isDeny := acl.AccessControlList.AccessControl(utils.RemoteIp(req))
+	if global := acl.GlobalAccessList; !isDeny && global != nil {
+		isDeny = !global.Allow(utils.RemoteIp(req))
+	}
 	if isDeny {
 		w.WriteHeader(403)
 		return
 	}
 
-	// filterChain
-	err := filter.ExecuteFilterChain(w, req)
-	if err != nil {
-		w.Write([]byte(err.Error()))
+	// 预检请求不携带凭证，在全局过滤器链之前响应，避免被认证过滤器拒绝
+	if cors.IsPreflight(req) && r.preflight(w, req) {
 		return
 	}
 
+	// filterChain，同一个请求始终使用开始时的全局过滤器链
+	chain := filter.GlobalChain()
+	chain.Run(w, filter.WithChain(req, chain), r.serve)
+}
+
+// 由匹配的 location 响应预检请求，location 没有跨域策略时返回 false，按照普通请求处理
+func (r *DefaultRouter) preflight(w http.ResponseWriter, req *http.Request) bool {
+	httpProxy, _ := r.Route(w, req)
+	if httpProxy == nil || httpProxy.getCors() == nil {
+		return false
+	}
+	if access := httpProxy.getAccessList(); access != nil && !access.Allow(utils.RemoteIp(req)) {
+		w.WriteHeader(403)
+		return true
+	}
+	_, handled := httpProxy.handleCors(w, req)
+	return handled
+}
+
+func (r *DefaultRouter) serve(w http.ResponseWriter, req *http.Request) {
 	// route
 	httpProxy, Realpath := r.Route(w, req)
 	if httpProxy == nil {
+		ban.AutoBan.Record(utils.RemoteIp(req), ban.NOT_FOUND)
 		w.WriteHeader(404)
 		return
 	}
 
+	// location 的访问控制列表
+	if access := httpProxy.getAccessList(); access != nil && !access.Allow(utils.RemoteIp(req)) {
+		w.WriteHeader(403)
+		return
+	}
+
+	// 跨域：设置跨域响应头，预检请求通常已经在全局过滤器链之前响应
+	req, preflight := httpProxy.handleCors(w, req)
+	if preflight {
+		return
+	}
+
+	// location 的过滤器链，响应阶段在 ModifyResponse 中执行
+	filters := httpProxy.getFilters()
+	filters.Run(w, filter.WithChain(req, filters), func(w http.ResponseWriter, req *http.Request) {
+		r.forward(w, req, httpProxy, Realpath)
+	})
+}
+
+func (r *DefaultRouter) forward(w http.ResponseWriter, req *http.Request, httpProxy *HTTPProxy, Realpath string) {
 	// Rate Limit
-	err = httpProxy.invaildToken(Realpath)
+	limiter, err := httpProxy.invaildToken(req, Realpath)
+	if err == ratelimit.NoReaminTokenError {
+		logger.Debugf("%s has been limited", req.URL)
+		ban.AutoBan.Record(utils.RemoteIp(req), ban.RATE_LIMITED)
+		httpProxy.rejectRequest(w, limiter)
+		return
+	}
+	if err == ratelimit.OverloadError {
+		logger.Debugf("%s has been shed: %s", req.URL, err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil && req.Context().Err() != nil {
+		// 客户端在排队时断开了连接
+		logger.Debugf("%s has been canceled while queueing", req.URL)
+		return
+	}
 	if err != nil {
 		errMsg := fmt.Sprintf("route error: %s", err.Error())
 		logger.Debug(errMsg)
@@ -79,21 +153,61 @@ func (r *DefaultRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte(errMsg))
 		return
 	}
+	if limiter != nil {
+		defer limiter.Done()
+		if httpProxy.GetLocation().RateLimitHeaders {
+			setRateLimitHeaders(w.Header(), limiter)
+		}
+	}
+
+	// location 的自适应并发限流，所有请求共用
+	finish, err := httpProxy.takeAdaptive()
+	if err != nil {
+		logger.Debugf("%s has been shed: %s", req.URL, err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var rtt time.Duration
+	defer func() { finish(rtt) }()
 
 	// LoadBalance
-	host, err := httpProxy.Lb.Balance(utils.GetIP(req.RemoteAddr))
+	host, release, err := httpProxy.pickHost(utils.RemoteIp(req))
 	if err != nil {
 		w.WriteHeader(http.StatusBadGateway)
 		errMsg := fmt.Sprintf("balancer error: %s", err.Error())
 		w.Write([]byte(errMsg))
 		return
 	}
-	httpProxy.Lb.Inc(host)
-	defer httpProxy.Lb.Done(host)
+	defer release()
+	// 主机可能在负载均衡之后被移除
+	proxy := httpProxy.getReverseProxy(host)
+	if proxy == nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	// Quota，只计入通过认证的消费者，在选中主机之后扣除，网关拒绝或者没有可用主机的请求不消耗配额
+	if consumer := quotaConsumer(req); consumer != "" {
+		if reset, err := quota.Quotas.Use(consumer); err != nil {
+			logger.Debugf("consumer %s has used up the quota", consumer)
+			httpProxy.rejectQuota(w, reset)
+			return
+		}
+	}
+	lb := httpProxy.GetLb()
+	lb.Inc(host)
+	defer lb.Done(host)
 
 	// redirect
 	req.URL.Path = Realpath
-	httpProxy.HostMap[host].ServeHTTP(w, req)
+	req, trip := withRoundTrip(req)
+	proxy.ServeHTTP(w, req)
+	rtt = trip.rtt
+	// 自适应限流器根据上游成功响应的时间调整并发数量
+	if observer, ok := limiter.(ratelimit.LatencyObserver); ok && rtt > 0 {
+		observer.Observe(rtt)
+	}
 }
 
 // 具体路由选择的算法
@@ -109,8 +223,7 @@ func (r *DefaultRouter) Route(w http.ResponseWriter, req *http.Request) (*HTTPPr
 			nextPath = path[:i]
 			logger.Debugf("debug: %s try to catch path", nextPath)
 			// 找到了最长匹配的前缀路由，负载均衡转发请求
-			if r.HasPrefix(nextPath) {
-				httpProxy = r.hosts[nextPath]
+			if httpProxy = r.get(nextPath); httpProxy != nil {
 				logger.Debugf("debug: DefaultRouter has found the longest path: %s", nextPath)
 
 				// 将前缀覆盖重写
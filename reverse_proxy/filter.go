@@ -0,0 +1,58 @@
+package reverseproxy
+
+import (
+	"fmt"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/filter"
+)
+
+/**
+*	替换 location 的过滤器链，并且记录到 Locations 中用于快照恢复
+*	pattern 为空时原子地替换全局过滤器链，记录到 GlobalFilters 中
+ */
+func (proxyMap *ProxyMap) SetFilters(pattern string, filters []config.FilterConfig) error {
+	chain, err := filter.NewFilterChain(filters)
+	if err != nil {
+		return err
+	}
+	if pattern == "" {
+		proxyMap.Lock()
+		defer proxyMap.Unlock()
+		proxyMap.GlobalFilters = filters
+		filter.SetGlobalChain(chain)
+		return nil
+	}
+	httpProxy, has := proxyMap.GetProxy(pattern)
+	if !has {
+		return fmt.Errorf("can't find the reverseproxy with the pattern %s", pattern)
+	}
+	httpProxy.Lock()
+	httpProxy.location.Filters = filters
+	httpProxy.filters = chain
+	httpProxy.Unlock()
+
+	proxyMap.Lock()
+	defer proxyMap.Unlock()
+	location := proxyMap.Locations[pattern]
+	location.Filters = filters
+	proxyMap.Locations[pattern] = location
+	return nil
+}
+
+func (proxyMap *ProxyMap) GetGlobalFilters() []config.FilterConfig {
+	proxyMap.RLock()
+	defer proxyMap.RUnlock()
+	return proxyMap.GlobalFilters
+}
+
+// 每个 location 的过滤器配置
+func (proxyMap *ProxyMap) Filters() map[string][]config.FilterConfig {
+	res := make(map[string][]config.FilterConfig)
+	for pattern, httpProxy := range proxyMap.Proxies() {
+		if filters := httpProxy.GetLocation().Filters; len(filters) > 0 {
+			res[pattern] = filters
+		}
+	}
+	return res
+}
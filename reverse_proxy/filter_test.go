@@ -0,0 +1,172 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/filter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationFilters(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Tenant", r.Header.Get("X-Tenant"))
+		w.Header().Set("X-Seen-Debug", r.Header.Get("X-Debug"))
+		w.Header().Set("X-Seen-Request-Id", r.Header.Get("X-Request-Id"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	defer m.Close()
+	assert.ErrorIs(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/invalid",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+		Filters:     []config.FilterConfig{{Name: "teapot"}},
+	}), filter.FilterNotSupportedError)
+	assert.NoError(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/api",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+		Filters: []config.FilterConfig{
+			{Name: filter.ALLOW_METHODS, Params: map[string]string{"methods": "GET, POST"}},
+			{Name: filter.MAX_BODY_SIZE, Params: map[string]string{"size": "8"}},
+			{Name: filter.SET_HEADER, Params: map[string]string{"name": "x-tenant", "value": "acme"}},
+			{Name: filter.REMOVE_HEADER, Params: map[string]string{"name": "X-Debug"}},
+			{Name: filter.REQUEST_ID},
+		},
+	}))
+
+	request := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/users", strings.NewReader(body))
+		req.Header.Set("X-Tenant", "evil")
+		req.Header.Set("X-Debug", "1")
+		w := httptest.NewRecorder()
+		RouterSingleton.ServeHTTP(w, req)
+		return w
+	}
+	w := request("GET", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "acme", w.Header().Get("X-Seen-Tenant"))
+	assert.Equal(t, "", w.Header().Get("X-Seen-Debug"))
+	assert.Len(t, w.Header().Get("X-Request-Id"), 32)
+	assert.Equal(t, w.Header().Get("X-Request-Id"), w.Header().Get("X-Seen-Request-Id"))
+
+	w = request("DELETE", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, POST", w.Header().Get("Allow"))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, request("POST", "0123456789").Code)
+
+	// 替换之后记录到 Locations 中，用于快照恢复
+	assert.Error(t, m.SetFilters("/api", []config.FilterConfig{{Name: filter.MAX_BODY_SIZE, Params: map[string]string{"size": "-1"}}}))
+	assert.NoError(t, m.SetFilters("/api", []config.FilterConfig{{Name: filter.APPEND_HEADER, Params: map[string]string{"name": "X-Tenant", "value": "acme"}}}))
+	assert.Equal(t, http.StatusOK, request("DELETE", "").Code)
+	assert.Equal(t, "evil", request("GET", "").Header().Get("X-Seen-Tenant"))
+	assert.Len(t, m.Locations["/api"].Filters, 1)
+	assert.Len(t, m.Filters()["/api"], 1)
+	assert.Error(t, m.SetFilters("/missing", nil))
+}
+
+func TestResponseFilters(t *testing.T) {
+	var backend *httptest.Server
+	backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.0")
+		w.Header().Set("X-Powered-By", "PHP/5.2")
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/login" {
+			w.Header().Set("Location", backend.URL+"/home?from=login")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("served by " + backend.URL))
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	defer m.Close()
+	assert.NoError(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/shop",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+		Filters: []config.FilterConfig{
+			{Name: filter.REMOVE_RESPONSE_HEADER, Params: map[string]string{"name": "Server, X-Powered-By"}},
+			{Name: filter.SECURITY_HEADERS, Params: map[string]string{"Content-Security-Policy": "default-src 'self'", "X-Frame-Options": ""}},
+			{Name: filter.REWRITE_LOCATION, Params: map[string]string{"scheme": "https", "prefix": "/shop"}},
+			{Name: filter.REPLACE_BODY, Params: map[string]string{"from": backend.URL, "to": "https://example.com/shop"}},
+			{Name: filter.SET_STATUS, Params: map[string]string{"from": "404", "to": "410"}},
+		},
+	}))
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		w := httptest.NewRecorder()
+		RouterSingleton.ServeHTTP(w, req)
+		return w
+	}
+	w := request("/shop/index")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("Server"))
+	assert.Equal(t, "", w.Header().Get("X-Powered-By"))
+	assert.Equal(t, "max-age=31536000; includeSubDomains", w.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "default-src 'self'", w.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "", w.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "served by https://example.com/shop", w.Body.String())
+
+	w = request("/shop/login")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://example.com/shop/home?from=login", w.Header().Get("Location"))
+
+	assert.Equal(t, http.StatusGone, request("/shop/missing").Code)
+}
+
+func TestGlobalFilters(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Gateway", r.Header.Get("X-Gateway"))
+		w.Header().Set("Server", "nginx/1.0")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	defer m.Close()
+	defer filter.SetGlobalChain(nil)
+	assert.NoError(t, m.AddProxyWithLocation(config.Location{
+		Pattern:     "/global",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+	}))
+
+	request := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		RouterSingleton.ServeHTTP(w, httptest.NewRequest(method, "/global/users", nil))
+		return w
+	}
+	assert.Error(t, m.SetFilters("", []config.FilterConfig{{Name: "teapot"}}))
+	assert.NoError(t, m.SetFilters("", []config.FilterConfig{
+		{Name: filter.ALLOW_METHODS, Params: map[string]string{"methods": "GET"}},
+		{Name: filter.SET_HEADER, Params: map[string]string{"name": "X-Gateway", "value": "cheryl"}},
+		{Name: filter.REMOVE_RESPONSE_HEADER, Params: map[string]string{"name": "Server"}},
+	}))
+	// 全局过滤器的拒绝按照其中的状态码返回，响应阶段同样执行
+	w := request("POST")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET", w.Header().Get("Allow"))
+	w = request("GET")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "cheryl", w.Header().Get("X-Seen-Gateway"))
+	assert.Equal(t, "", w.Header().Get("Server"))
+	assert.Len(t, m.GetGlobalFilters(), 3)
+
+	// 替换之后立即生效
+	assert.NoError(t, m.SetFilters("", nil))
+	assert.Equal(t, http.StatusOK, request("POST").Code)
+	assert.Nil(t, filter.GlobalChain())
+}
@@ -1,14 +1,36 @@
 package reverseproxy
 
 import (
+	"context"
 	"time"
 
+	"github.com/qiancijun/cheryl/config"
 	"github.com/qiancijun/cheryl/logger"
 	"github.com/qiancijun/cheryl/utils"
 )
 
 var HealthCheckTimeout = 5 * time.Second
 
+/**
+*	集群模式下的健康检查协调器，由 leader 负责主动检查并通过 raft 同步检查结果，
+*	从节点只接收结果，联系不到 leader 时退化为本地检查
+ */
+type HealthCoordinator interface {
+	Name() string
+	IsLeader() bool
+	LeaderReachable() bool
+	Report(pattern, host string, alive bool) error
+}
+
+// 为 nil 时每个节点独立进行健康检查
+var Coordinator HealthCoordinator
+
+// leader 同步过来的检查结果
+type HealthVerdict struct {
+	Alive     bool   `json:"alive"`
+	CheckedBy string `json:"checkedBy"`
+}
+
 func (h *HTTPProxy) ReadAlive(url string) bool {
 	h.RLock()
 	defer h.RUnlock()
@@ -21,29 +43,115 @@ func (h *HTTPProxy) SetAlive(url string, alive bool) {
 	h.Alive[url] = alive
 }
 
+// 返回主机的健康状态以及做出该判断的节点
+func (h *HTTPProxy) ReadHealth(url string) (bool, string) {
+	h.RLock()
+	defer h.RUnlock()
+	return h.Alive[url], h.CheckedBy[url]
+}
+
+// 更新主机的健康状态，状态发生变化时同步到负载均衡器
+func (h *HTTPProxy) setHealth(host string, alive bool, checkedBy string) {
+	h.Lock()
+	defer h.Unlock()
+	if _, has := h.HostMap[host]; !has {
+		return
+	}
+	h.CheckedBy[host] = checkedBy
+	if h.Alive[host] == alive {
+		return
+	}
+	before := h.serviceable(host)
+	h.Alive[host] = alive
+	after := h.serviceable(host)
+	if alive {
+		logger.Warnf("Site reachable, add %s to load balancer. (checked by %s)", host, checkedBy)
+	} else {
+		logger.Warnf("Site unreachable, remove %s from load balancer. (checked by %s)", host, checkedBy)
+	}
+	// 处于维护或者排空状态的主机不会被重新加入
+	if !before && after {
+		h.Lb.Add(host)
+	} else if before && !after {
+		h.Lb.Remove(host)
+	}
+}
+
+// 应用 leader 通过 raft 同步过来的检查结果
+func (h *HTTPProxy) ApplyVerdict(host string, alive bool, checkedBy string) {
+	h.Lock()
+	h.verdicts[host] = HealthVerdict{alive, checkedBy}
+	h.Unlock()
+	h.setHealth(host, alive, checkedBy)
+}
+
+func (h *HTTPProxy) readVerdict(host string) (HealthVerdict, bool) {
+	h.RLock()
+	defer h.RUnlock()
+	v, has := h.verdicts[host]
+	return v, has
+}
+
 func (h *HTTPProxy) HealthCheck() {
+	h.Lock()
+	defer h.Unlock()
 	for host := range h.HostMap {
-		go h.healthCheck(host)
+		h.startHealthCheck(host)
 	}
 }
 
-func (h *HTTPProxy) healthCheck(host string) {
-	ticker := time.Tick(HealthCheckTimeout)
+// 调用者需要持有写锁
+func (h *HTTPProxy) startHealthCheck(host string) {
+	if _, has := h.hostCancel[host]; has {
+		return
+	}
+	ctx, cancel := context.WithCancel(h.ctx)
+	h.hostCancel[host] = cancel
+	go h.healthCheck(ctx, host)
+}
+
+func (h *HTTPProxy) healthCheck(ctx context.Context, host string) {
+	ticker := time.NewTicker(HealthCheckTimeout)
+	defer ticker.Stop()
 	for {
 		select {
-		case <- ticker:
-			if !utils.IsBackendAlive(host) && h.ReadAlive(host) {
-				logger.Warnf("Site unreachable, remove %s from load balancer.", host)
-				h.SetAlive(host, false)
-				h.Lb.Remove(host)
-			} else if utils.IsBackendAlive(host) && !h.ReadAlive(host) {
-				logger.Warnf("Site reachable, add %s to load balancer.", host)
-				h.SetAlive(host, true)
-				h.Lb.Add(host)
-			}
-		case <- h.HostsShutDown[host]:
+		case <-ticker.C:
+			h.checkOnce(host)
+		case <-ctx.Done():
 			logger.Infof("target host %s shutdown", host)
 			return
 		}
 	}
 }
+
+func (h *HTTPProxy) checkOnce(host string) {
+	coordinator := Coordinator
+	switch {
+	case coordinator == nil:
+		h.setHealth(host, utils.IsBackendAlive(host), localNodeName())
+	case coordinator.IsLeader():
+		// 只有检查结果与集群中记录的不一致时才写入日志
+		alive := utils.IsBackendAlive(host)
+		if v, has := h.readVerdict(host); has && v.Alive == alive {
+			return
+		}
+		if err := coordinator.Report(h.Pattern, host, alive); err != nil {
+			logger.Warnf("{healthCheck} can't report %s%s: %s", h.Pattern, host, err.Error())
+		}
+	case !coordinator.LeaderReachable():
+		logger.Debugf("{healthCheck} leader unreachable, check %s locally", host)
+		h.setHealth(host, utils.IsBackendAlive(host), coordinator.Name())
+	default:
+		// leader 恢复之后，以集群中记录的结果为准
+		if v, has := h.readVerdict(host); has {
+			h.setHealth(host, v.Alive, v.CheckedBy)
+		}
+	}
+}
+
+func localNodeName() string {
+	if cfg := config.GetConfig(); cfg != nil {
+		return cfg.Name
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package reverseproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCoordinator struct {
+	leader    bool
+	reachable bool
+	reports   []HealthVerdict
+}
+
+func (c *fakeCoordinator) Name() string          { return "node2" }
+func (c *fakeCoordinator) IsLeader() bool        { return c.leader }
+func (c *fakeCoordinator) LeaderReachable() bool { return c.reachable }
+func (c *fakeCoordinator) Report(pattern, host string, alive bool) error {
+	c.reports = append(c.reports, HealthVerdict{alive, c.Name()})
+	return nil
+}
+
+func TestClusterHealthCheck(t *testing.T) {
+	defer func() { Coordinator = nil }()
+	// 不可达的主机
+	host := "127.0.0.1:1"
+	httpProxy, err := NewHTTPProxy("/health", []string{"http://" + host}, "round-robin")
+	assert.NoError(t, err)
+
+	// leader 负责检查，结果写入日志而不是直接修改本地状态
+	c := &fakeCoordinator{leader: true, reachable: true}
+	Coordinator = c
+	httpProxy.checkOnce(host)
+	assert.Equal(t, 1, len(c.reports))
+	assert.False(t, c.reports[0].Alive)
+	assert.True(t, httpProxy.ReadAlive(host))
+
+	// 结果同步到所有节点之后，不再重复写入
+	httpProxy.ApplyVerdict(host, false, "node1")
+	httpProxy.checkOnce(host)
+	assert.Equal(t, 1, len(c.reports))
+	alive, checkedBy := httpProxy.ReadHealth(host)
+	assert.False(t, alive)
+	assert.Equal(t, "node1", checkedBy)
+
+	// 从节点以 leader 的结果为准
+	c.leader = false
+	httpProxy.setHealth(host, true, "node2")
+	httpProxy.checkOnce(host)
+	alive, checkedBy = httpProxy.ReadHealth(host)
+	assert.False(t, alive)
+	assert.Equal(t, "node1", checkedBy)
+
+	// leader 不可达时退化为本地检查
+	c.reachable = false
+	httpProxy.checkOnce(host)
+	alive, checkedBy = httpProxy.ReadHealth(host)
+	assert.False(t, alive)
+	assert.Equal(t, "node2", checkedBy)
+	assert.Equal(t, 0, httpProxy.Lb.Len())
+}
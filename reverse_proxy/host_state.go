@@ -0,0 +1,158 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/qiancijun/cheryl/logger"
+)
+
+/**
+*	主机的管理状态，与健康检查互相独立：
+*	active: 正常接收请求
+*	draining: 不再接收新的请求，正在处理的请求结束之后变为 down
+*	down: 排空完成
+*	maintenance: 维护中，无论健康检查结果如何都不接收请求
+ */
+const (
+	HOST_ACTIVE      = "active"
+	HOST_DRAINING    = "draining"
+	HOST_DOWN        = "down"
+	HOST_MAINTENANCE = "maintenance"
+)
+
+// 选择主机的最大次数
+const maxPickAttempts = 3
+
+func validHostState(state string) bool {
+	return state == HOST_ACTIVE || state == HOST_DRAINING || state == HOST_MAINTENANCE
+}
+
+// 调用者需要持有锁
+func (h *HTTPProxy) hostState(host string) string {
+	if state, has := h.HostStates[host]; has {
+		return state
+	}
+	return HOST_ACTIVE
+}
+
+// 健康且处于 active 状态的主机才会加入负载均衡器
+func (h *HTTPProxy) serviceable(host string) bool {
+	return h.Alive[host] && h.hostState(host) == HOST_ACTIVE
+}
+
+func (h *HTTPProxy) ReadHostState(host string) (string, int64) {
+	h.RLock()
+	defer h.RUnlock()
+	var inflight int64
+	if counter, has := h.inflight[host]; has {
+		inflight = atomic.LoadInt64(counter)
+	}
+	return h.hostState(host), inflight
+}
+
+// 修改主机的管理状态，保留主机的健康检查记录
+func (h *HTTPProxy) SetHostState(host string, state string) error {
+	if !validHostState(state) {
+		return fmt.Errorf("host state %s not supported", state)
+	}
+	h.Lock()
+	defer h.Unlock()
+	if _, has := h.HostMap[host]; !has {
+		return fmt.Errorf("can't find the host %s in %s", host, h.Pattern)
+	}
+	before := h.serviceable(host)
+	if state == HOST_ACTIVE {
+		delete(h.HostStates, host)
+	} else {
+		h.HostStates[host] = state
+	}
+	if state == HOST_DRAINING && atomic.LoadInt64(h.inflight[host]) == 0 {
+		h.HostStates[host] = HOST_DOWN
+	}
+	after := h.serviceable(host)
+	if before && !after {
+		h.Lb.Remove(host)
+	} else if !before && after {
+		h.Lb.Add(host)
+	}
+	logger.Infof("{SetHostState} %s%s is %s now", h.Pattern, host, h.hostState(host))
+	return nil
+}
+
+// 记录转发到主机上的请求，返回的函数在请求结束时调用。
+// 检查和计数都在读锁中完成，与排空时持有写锁的 finishDrain 和 SetHostState 互斥，
+// 负载均衡之后主机可能已经不可用，此时返回 false
+func (h *HTTPProxy) acquire(host string) (func(), bool) {
+	h.RLock()
+	defer h.RUnlock()
+	counter, has := h.inflight[host]
+	if !has || !h.serviceable(host) {
+		return nil, false
+	}
+	atomic.AddInt64(counter, 1)
+	return func() {
+		if atomic.AddInt64(counter, -1) == 0 {
+			h.finishDrain(host)
+		}
+	}, true
+}
+
+// 选择可用的主机，选中的主机在登记之前不可用时重新选择
+func (h *HTTPProxy) pickHost(ip string) (string, func(), error) {
+	lb := h.GetLb()
+	for i := 0; i < maxPickAttempts; i++ {
+		host, err := lb.Balance(ip)
+		if err != nil {
+			return "", nil, err
+		}
+		if release, ok := h.acquire(host); ok {
+			return host, release, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no serviceable host in %s", h.Pattern)
+}
+
+func (h *HTTPProxy) finishDrain(host string) {
+	h.RLock()
+	draining := h.hostState(host) == HOST_DRAINING
+	h.RUnlock()
+	if !draining {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	counter, has := h.inflight[host]
+	if !has || atomic.LoadInt64(counter) != 0 {
+		return
+	}
+	if h.hostState(host) == HOST_DRAINING {
+		h.HostStates[host] = HOST_DOWN
+		logger.Infof("{finishDrain} %s%s has been drained", h.Pattern, host)
+	}
+}
+
+// 修改主机状态并记录到 ProxyMap 中，用于快照恢复
+func (proxyMap *ProxyMap) SetHostState(pattern string, host string, state string) error {
+	httpProxy, has := proxyMap.GetProxy(pattern)
+	if !has {
+		return fmt.Errorf("can't find the reverseproxy with the pattern %s", pattern)
+	}
+	if err := httpProxy.SetHostState(host, state); err != nil {
+		return err
+	}
+	proxyMap.Lock()
+	defer proxyMap.Unlock()
+	states, has := proxyMap.HostStates[pattern]
+	if !has {
+		states = make(map[string]string)
+		proxyMap.HostStates[pattern] = states
+	}
+	// 排空完成的主机仍然记录为 draining，从快照恢复时会直接变为 down
+	if state == HOST_ACTIVE {
+		delete(states, host)
+	} else {
+		states[host] = state
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package reverseproxy
+
+import (
+	"testing"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainHost(t *testing.T) {
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/drain",
+		ProxyPass:   []string{"http://localhost:8080", "http://localhost:8081"},
+		BalanceMode: "round-robin",
+	})
+	assert.NoError(t, err)
+	httpProxy, _ := m.GetProxy("/drain")
+	host := "localhost:8080"
+
+	// 模拟一个正在处理的请求
+	release, ok := httpProxy.acquire(host)
+	assert.True(t, ok)
+	assert.NoError(t, m.SetHostState("/drain", host, HOST_DRAINING))
+	state, inflight := httpProxy.ReadHostState(host)
+	assert.Equal(t, HOST_DRAINING, state)
+	assert.Equal(t, int64(1), inflight)
+	assert.Equal(t, 1, httpProxy.GetLb().Len())
+
+	// 请求结束之后排空完成
+	release()
+	state, _ = httpProxy.ReadHostState(host)
+	assert.Equal(t, HOST_DOWN, state)
+	assert.Equal(t, HOST_DRAINING, m.HostStates["/drain"][host])
+
+	// 排空完成之后，负载均衡之前选中的主机不能再登记请求
+	_, ok = httpProxy.acquire(host)
+	assert.False(t, ok)
+	for i := 0; i < 4; i++ {
+		picked, release, err := httpProxy.pickHost("127.0.0.1")
+		assert.NoError(t, err)
+		assert.Equal(t, "localhost:8081", picked)
+		release()
+	}
+
+	assert.NoError(t, m.SetHostState("/drain", host, HOST_ACTIVE))
+	state, _ = httpProxy.ReadHostState(host)
+	assert.Equal(t, HOST_ACTIVE, state)
+	assert.Equal(t, 2, httpProxy.GetLb().Len())
+	assert.Equal(t, 0, len(m.HostStates["/drain"]))
+}
+
+func TestMaintenanceHost(t *testing.T) {
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/maintenance",
+		ProxyPass:   []string{"http://localhost:8080", "http://localhost:8081"},
+		BalanceMode: "round-robin",
+	})
+	assert.NoError(t, err)
+	httpProxy, _ := m.GetProxy("/maintenance")
+	host := "localhost:8080"
+
+	assert.NoError(t, m.SetHostState("/maintenance", host, HOST_MAINTENANCE))
+	assert.Equal(t, 1, httpProxy.GetLb().Len())
+
+	// 健康检查不会把维护中的主机加回负载均衡器
+	httpProxy.setHealth(host, false, "node1")
+	httpProxy.setHealth(host, true, "node1")
+	assert.Equal(t, 1, httpProxy.GetLb().Len())
+	alive, _ := httpProxy.ReadHealth(host)
+	assert.True(t, alive)
+
+	assert.Error(t, m.SetHostState("/maintenance", host, "unknown"))
+	assert.Error(t, m.SetHostState("/maintenance", "localhost:9999", HOST_MAINTENANCE))
+
+	// 移除主机时清理状态
+	assert.NoError(t, m.RemoveHost("/maintenance", host))
+	_, has := m.HostStates["/maintenance"][host]
+	assert.False(t, has)
+}
@@ -1,6 +1,7 @@
 package reverseproxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -9,8 +10,13 @@ import (
 	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/qiancijun/cheryl/acl"
+	"github.com/qiancijun/cheryl/ban"
 	"github.com/qiancijun/cheryl/balancer"
+	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/cors"
+	"github.com/qiancijun/cheryl/filter"
 	"github.com/qiancijun/cheryl/logger"
 	ratelimit "github.com/qiancijun/cheryl/rate_limit"
 	"github.com/qiancijun/cheryl/utils"
@@ -22,53 +28,65 @@ const (
 	ReverseProxy string = "Balancer-Reverse-Proxy"
 )
 
+var (
+	ProxyClosedError = errors.New("reverse proxy has been closed")
+)
+
 /**
 *	hostMap: 主机对反向代理的映射，其中的键值表示我们需要反向代理的主机
 *	lb: 负载均衡器
 * 	alive: 反向代理的主机是否处于健康状态
+*	checkedBy: 当前生效的健康检查结果来自哪个节点
+*	hostStates: 主机的管理状态，见 host_state.go
+*	inflight: 每个主机正在处理的请求数量
+*	ctx: 反向代理的生命周期，每个主机的健康检查都派生自它
+*	location: 创建反向代理的配置，限流拒绝时的响应等按照它处理
+*	access: location 的访问控制列表
+*	filters: location 的过滤器链
+*	corsPolicy: location 的跨域策略，为空时不处理跨域请求
+*	adaptive: location 的自适应并发限流器，为空时不限制
+*	rules: 限流规则的路径模式对应的限流器，按照匹配的优先级排列，查询限流器时同样从这里读取
+*	observed: 访问过的路径，见 limiter_rule.go
  */
 type HTTPProxy struct {
-	HostMap       map[string]*httputil.ReverseProxy
-	Pattern       string
-	Lb            balancer.Balancer
-	Alive         map[string]bool
-	Methods       map[string]ratelimit.RateLimiter
-	HostsShutDown map[string]chan bool
-	ShutDown      chan bool
-	ProxyMap      *ProxyMap
+	HostMap    map[string]*httputil.ReverseProxy
+	Pattern    string
+	Lb         balancer.Balancer
+	Alive      map[string]bool
+	CheckedBy  map[string]string
+	HostStates map[string]string
+	ProxyMap   *ProxyMap
+	verdicts   map[string]HealthVerdict
+	inflight   map[string]*int64
+	ctx        context.Context
+	cancel     context.CancelFunc
+	hostCancel map[string]context.CancelFunc
+	location   config.Location
+	access     *acl.AccessList
+	filters    *filter.Filter
+	corsPolicy *cors.Policy
+	adaptive   *ratelimit.AdaptiveLimiter
+	rules      []*limiterRule
+	observed   *lru.Cache
 	sync.RWMutex
 }
 
-
-
 // 对每一个 URL 创建反向代理并且记录到 URL 树中
 func NewHTTPProxy(pattern string, targetHosts []string, algo balancer.Algorithm) (*HTTPProxy, error) {
 	hostMap := make(map[string]*httputil.ReverseProxy)
 	alive := make(map[string]bool)
-	methods := make(map[string]ratelimit.RateLimiter)
-	hostsShutDown := make(map[string]chan bool)
+	inflight := make(map[string]*int64)
 
 	hosts := make([]string, 0)
 	for _, targetHost := range targetHosts {
-		url, err := url.Parse(targetHost)
+		host, proxy, err := newReverseProxy(targetHost)
 		if err != nil {
 			return nil, err
 		}
-		logger.Debugf("%s has been created reverse proxy", url)
-		proxy := httputil.NewSingleHostReverseProxy(url)
-
-		originDirector := proxy.Director
-		proxy.Director = func(r *http.Request) {
-			originDirector(r)
-			r.Header.Set(XProxy, ReverseProxy)
-			r.Header.Set(XRealIP, utils.GetIP(r.RemoteAddr))
-		}
-
-		host := utils.GetHost(url)
 		alive[host] = true
+		inflight[host] = new(int64)
 		hostMap[host] = proxy
 		hosts = append(hosts, host)
-		hostsShutDown[host] = make(chan bool, 0)
 		logger.Debugf("success create reverproxy %s", host)
 	}
 
@@ -78,145 +96,342 @@ func NewHTTPProxy(pattern string, targetHosts []string, algo balancer.Algorithm)
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	httpProxy := &HTTPProxy{
-		HostMap: hostMap,
-		Lb:      lb,
-		Alive:   alive,
-		Pattern: pattern,
-		Methods: methods,
-		ShutDown: make(chan bool),
-		HostsShutDown: hostsShutDown,
+		HostMap:    hostMap,
+		Lb:         lb,
+		Alive:      alive,
+		CheckedBy:  make(map[string]string),
+		HostStates: make(map[string]string),
+		verdicts:   make(map[string]HealthVerdict),
+		inflight:   inflight,
+		Pattern:    pattern,
+		observed:   newObservedPaths(),
+		ctx:        ctx,
+		cancel:     cancel,
+		hostCancel: make(map[string]context.CancelFunc),
 	}
+	return httpProxy, nil
+}
 
-	// 监听是否收到Shutdown
-	go httpProxy.shutDownCheck()
+func newReverseProxy(targetHost string) (string, *httputil.ReverseProxy, error) {
+	url, err := url.Parse(targetHost)
+	if err != nil {
+		return "", nil, err
+	}
+	logger.Debugf("%s has been created reverse proxy", url)
+	proxy := httputil.NewSingleHostReverseProxy(url)
 
-	return httpProxy, nil
+	originDirector := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		originDirector(r)
+		r.Header.Set(XProxy, ReverseProxy)
+		r.Header.Set(XRealIP, utils.RemoteIp(r))
+		// 覆盖客户端自己携带的同名请求头，避免伪造
+		if header := acl.GeoDB.CountryHeader; header != "" {
+			r.Header.Del(header)
+			if ip := utils.ParseIP(utils.RemoteIp(r)); ip != nil {
+				if geo, ok := acl.GeoDB.Lookup(ip); ok && geo.Country != "" {
+					r.Header.Set(header, geo.Country)
+				}
+			}
+		}
+	}
+	// 转发的请求保留了客户端地址，上游的 401/403/404 计入自动封禁的事件，
+	// 网关处理了跨域时删除上游的跨域响应头，之后执行 location 过滤器链的响应阶段
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		recordRoundTrip(resp)
+		ban.AutoBan.RecordStatus(utils.RemoteIp(resp.Request), resp.StatusCode)
+		if cors.Handled(resp.Request) {
+			cors.StripHeaders(resp.Header)
+		}
+		return filter.ExecuteResponse(resp)
+	}
+	return utils.GetHost(url), proxy, nil
+}
+
+func (h *HTTPProxy) GetLb() balancer.Balancer {
+	h.RLock()
+	defer h.RUnlock()
+	return h.Lb
 }
 
+func (h *HTTPProxy) GetLocation() config.Location {
+	h.RLock()
+	defer h.RUnlock()
+	return h.location
+}
 
-func (h *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !h.accessControl(utils.RemoteIp(r)) {
-		w.WriteHeader(403)
-		return
+// 访问控制列表需要在调用之前校验，见 AddProxyWithLocation
+func (h *HTTPProxy) setLocation(location config.Location) {
+	access, err := acl.NewAccessList(location.Acl)
+	if err != nil {
+		logger.Warnf("invaild acl of location %s: %s", location.Pattern, err.Error())
 	}
-	host, err := h.Lb.Balance(utils.GetIP(r.RemoteAddr))
+	filters, err := filter.NewFilterChain(location.Filters)
 	if err != nil {
-		w.WriteHeader(http.StatusBadGateway)
-		errMsg := fmt.Sprintf("balancer error: %s", err.Error())
-		w.Write([]byte(errMsg))
-		return
+		logger.Warnf("invaild filters of location %s: %s", location.Pattern, err.Error())
 	}
+	policy, err := cors.NewPolicy(location.Cors)
+	if err != nil {
+		logger.Warnf("invaild cors of location %s: %s", location.Pattern, err.Error())
+	}
+	h.Lock()
+	defer h.Unlock()
+	// 配置没有变化时保留已经调整过的并发数量
+	if h.adaptive == nil || location.Adaptive != h.location.Adaptive {
+		h.adaptive = newLocationAdaptive(location.Adaptive)
+	}
+	h.location = location
+	h.access = access
+	h.filters = filters
+	h.corsPolicy = policy
+}
 
-	h.Lb.Inc(host)
-	defer h.Lb.Done(host)
-	h.HostMap[host].ServeHTTP(w, r)
+func (h *HTTPProxy) getFilters() *filter.Filter {
+	h.RLock()
+	defer h.RUnlock()
+	return h.filters
 }
 
-func (h *HTTPProxy) accessControl(ip string) bool {
-	logger.Debugf("%s will access the system", ip)
-	radixTree := acl.AccessControlList
-	ret := radixTree.Search(ip)
-	return ret == ""
+func (h *HTTPProxy) getAccessList() *acl.AccessList {
+	h.RLock()
+	defer h.RUnlock()
+	return h.access
 }
 
-func (httpProxy *HTTPProxy) SetRateLimiter(info LimiterInfo) error {
-	logger.Debugf("{SetRateLimiter} pathName: %s limiterType: %s volumn: %d speed: %d maxThread: %d", info.PathName, info.LimiterType, info.Volumn, info.Speed, info.MaxThread)
-	methods := httpProxy.Methods
-	httpProxy.Lock()
-	defer httpProxy.Unlock()
+func (h *HTTPProxy) getReverseProxy(host string) *httputil.ReverseProxy {
+	h.RLock()
+	defer h.RUnlock()
+	return h.HostMap[host]
+}
 
-	limiter, err := ratelimit.Build(ratelimit.LimiterType(info.LimiterType))
+// 返回当前所有主机，用于遍历时不持有锁
+func (h *HTTPProxy) Hosts() []string {
+	h.RLock()
+	defer h.RUnlock()
+	hosts := make([]string, 0, len(h.HostMap))
+	for host := range h.HostMap {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// 添加一个新的主机，并开始对它进行健康检查
+func (h *HTTPProxy) AddHost(targetHost string) error {
+	host, proxy, err := newReverseProxy(targetHost)
 	if err != nil {
 		return err
 	}
-	if info.Speed != 0 {
-		limiter.SetRate(info.Volumn, info.Speed)
+	h.Lock()
+	defer h.Unlock()
+	if h.ctx.Err() != nil {
+		return ProxyClosedError
 	}
-	if info.Duration != 0 {
-		limiter.SetTimeout(time.Duration(info.Duration) * time.Millisecond)
+	if _, has := h.HostMap[host]; has {
+		return fmt.Errorf("host %s already exists in %s", host, h.Pattern)
 	}
-	methods[info.PathName] = limiter
-	// 在 ProxyMap 中记录
-	limiters := httpProxy.ProxyMap.Limiters
-	limiters[httpProxy.Pattern] = append(limiters[httpProxy.Pattern], info)
+	h.HostMap[host] = proxy
+	h.Alive[host] = true
+	h.inflight[host] = new(int64)
+	h.Lb.Add(host)
+	h.startHealthCheck(host)
 	return nil
 }
 
-func (httpProxy *HTTPProxy) invaildToken(api string) error {
-	methods := httpProxy.Methods
-	limiter := methods[api]
-	// 还未配置限流器，经过第一次访问之后，默认创建一个 qps 限流器
-	if limiter == nil {
-		httpProxy.Lock()
-		err := httpProxy.configRate(api)
-		httpProxy.Unlock()
-		return err
+// 移除主机，停止健康检查并清理负载均衡器中的记录，不会阻塞
+func (h *HTTPProxy) RemoveHost(host string) error {
+	h.Lock()
+	defer h.Unlock()
+	if _, has := h.HostMap[host]; !has {
+		return fmt.Errorf("can't find the host %s in %s", host, h.Pattern)
 	}
-	logger.Debugf("{invaildToken} method: %s 's limiter info: volumn: %d speed: %d", api, limiter.GetVolumn(), limiter.GetVolumn())
-	timeout := limiter.GetTimeout()
-
-	var err error
-	if timeout == 0 {
-		err = limiter.Take()
-	} else {
-		err = limiter.TakeWithTimeout(timeout)
+	if cancel, has := h.hostCancel[host]; has {
+		cancel()
 	}
-	return err
+	delete(h.hostCancel, host)
+	delete(h.HostMap, host)
+	delete(h.Alive, host)
+	delete(h.CheckedBy, host)
+	delete(h.verdicts, host)
+	delete(h.HostStates, host)
+	delete(h.inflight, host)
+	h.Lb.Remove(host)
+	return nil
 }
 
-// 将此次接口访问记录到反向代理器中，用于配置限流
-func (httpProxy *HTTPProxy) configRate(path string) error {
-	if httpProxy == nil {
-		errMsg := "default_router can't find the httpProxy"
-		return errors.New(errMsg)
+// 关闭反向代理，停止所有主机的健康检查
+func (h *HTTPProxy) Close() {
+	h.Lock()
+	defer h.Unlock()
+	h.cancel()
+	h.hostCancel = make(map[string]context.CancelFunc)
+}
+
+func (httpProxy *HTTPProxy) SetRateLimiter(info LimiterInfo) error {
+	logger.Debugf("{SetRateLimiter} pathName: %s limiterType: %s volumn: %d speed: %d maxThread: %d keyBy: %s", info.PathName, info.LimiterType, info.Volumn, info.Speed, info.MaxThread, info.KeyBy)
+	if err := validKeyBy(info.KeyBy); err != nil {
+		return err
+	}
+	if info.Global && (ratelimit.LimiterType(info.LimiterType) != ratelimit.QPS || info.KeyBy != "") {
+		return errors.New("global limiter only supports qps limiter without keyBy")
+	}
+	// location 的自适应并发限流和自适应限流规则会观察同样的响应时间，同时开启会重复降低并发数量
+	if ratelimit.LimiterType(info.LimiterType) == ratelimit.ADAPTIVE && httpProxy.GetAdaptive() != nil {
+		return fmt.Errorf("location %s already has an adaptive limit", httpProxy.Pattern)
 	}
-	methods := httpProxy.Methods
-	_, has := methods[path]
-	if !has {
+	limiter, err := newRateLimiter(info)
+	if err != nil {
+		return err
+	}
+	// 按客户端限流时，每个客户端都按照同样的配置创建一个限流器
+	if info.KeyBy != "" {
+		keyed := ratelimit.NewKeyedLimiter(func() ratelimit.RateLimiter {
+			l, _ := newRateLimiter(info)
+			return l
+		}, info.MaxKeys, time.Duration(info.IdleTimeout)*time.Millisecond)
+		keyed.KeyBy, keyed.KeyName = info.KeyBy, info.KeyName
+		limiter = keyed
+	}
+	rule, err := newLimiterRule(info.PathName, limiter)
+	if err != nil {
+		return err
+	}
+	httpProxy.Lock()
+	httpProxy.addRule(rule)
+	httpProxy.Unlock()
+	// 在 ProxyMap 中记录
+	httpProxy.ProxyMap.recordLimiter(httpProxy.Pattern, info)
+	return nil
+}
 
-		// 默认创建一个 qps 限流器
-		limiter, err := ratelimit.Build("qps")
-		if err != nil {
-			errMsg := "can't find qps limiter"
-			return errors.New(errMsg)
+func newRateLimiter(info LimiterInfo) (ratelimit.RateLimiter, error) {
+	if info.Global {
+		limiter := ratelimit.NewGlobalLimiter(info.Volumn, info.Speed)
+		if info.Duration > 0 {
+			limiter.SetTimeout(time.Duration(info.Duration) * time.Millisecond)
 		}
-		methods[path] = limiter
-		// 在 ProxyMap 中记录
-		proxyMap := httpProxy.ProxyMap
-		limiters := proxyMap.Limiters
-		limiters[httpProxy.Pattern] = append(limiters[httpProxy.Pattern], LimiterInfo{
-			PathName:    path,
-			LimiterType: "qps",
-			Volumn:      -1,
-			Speed:       0,
-			MaxThread:   -1,
-			Duration:    0,
-		})
+		return limiter, nil
+	}
+	limiter, err := ratelimit.Build(ratelimit.LimiterType(info.LimiterType))
+	if err != nil {
+		return nil, err
+	}
+	switch ratelimit.LimiterType(info.LimiterType) {
+	case ratelimit.CONCURRENT:
+		// 并发限流器的容量就是最大并发数量
+		if info.MaxThread > 0 {
+			limiter.SetRate(info.MaxThread, 0)
+		}
+	case ratelimit.SLIDING_LOG, ratelimit.SLIDING_WINDOW:
+		// 窗口内允许的请求数量
+		if info.Volumn > 0 {
+			limiter.SetRate(info.Volumn, 0)
+		}
+	case ratelimit.ADAPTIVE:
+		// 容量是初始的并发数量，最大并发数量是调整的上限
+		limiter.SetRate(info.Volumn, int64(info.MaxThread))
+	case ratelimit.QUEUE:
+		// 容量是队列的最大长度，速率是每秒放行的请求数量
+		limiter.SetRate(info.Volumn, info.Speed)
+		if info.PriorityHeader != "" {
+			limiter.(*ratelimit.QueueLimiter).SetLanes(info.PriorityHeader, info.Lanes)
+		}
+	default:
+		if info.Speed != 0 {
+			limiter.SetRate(info.Volumn, info.Speed)
+		}
+	}
+	if windowLimiter, ok := limiter.(ratelimit.WindowLimiter); ok && info.Window > 0 {
+		windowLimiter.SetWindow(time.Duration(info.Window) * time.Millisecond)
+	}
+	if info.Duration > 0 {
+		limiter.SetTimeout(time.Duration(info.Duration) * time.Millisecond)
+	}
+	return limiter, nil
+}
 
-	} else {
-		return ratelimit.LimiterAlreadyExists
+// 返回路径模式为 api 的规则的限流器
+func (httpProxy *HTTPProxy) GetLimiter(api string) ratelimit.RateLimiter {
+	httpProxy.RLock()
+	defer httpProxy.RUnlock()
+	for _, rule := range httpProxy.rules {
+		if rule.pattern == api {
+			return rule.limiter
+		}
 	}
 	return nil
 }
 
-func (httpProxy *HTTPProxy) shutDownCheck() {
-	select {
-	case <- httpProxy.ShutDown: 
-		// 关闭所有与 host 的心跳链接
-		for k, c := range httpProxy.HostsShutDown {
-			logger.Debugf("ready to close heartbeat for %s", k)
-			c <- true
-			logger.Debugf("close heatbeat for %s success", k)
+// 返回每个规则的路径模式对应的限流器
+func (httpProxy *HTTPProxy) Limiters() map[string]ratelimit.RateLimiter {
+	httpProxy.RLock()
+	defer httpProxy.RUnlock()
+	res := make(map[string]ratelimit.RateLimiter, len(httpProxy.rules))
+	for _, rule := range httpProxy.rules {
+		res[rule.pattern] = rule.limiter
+	}
+	return res
+}
+
+// 返回每个排队限流器中正在排队的请求数量，按客户端限流时是所有客户端的总和
+func (httpProxy *HTTPProxy) QueueDepths() map[string]int {
+	res := make(map[string]int)
+	for method, limiter := range httpProxy.Limiters() {
+		if queued, _, ok := ratelimit.QueueDepth(limiter); ok {
+			res[method] = queued
 		}
 	}
+	return res
+}
+
+// 返回所有限流规则的路径模式，按照匹配的优先级排列
+func (httpProxy *HTTPProxy) GetMethods() []string {
+	httpProxy.RLock()
+	defer httpProxy.RUnlock()
+	res := make([]string, 0, len(httpProxy.rules))
+	for _, rule := range httpProxy.rules {
+		res = append(res, rule.pattern)
+	}
+	return res
+}
+
+// 返回实际生效的限流器，没有匹配的规则时返回 nil，获取令牌成功之后需要在请求结束时调用它的 Done
+// 获取失败时同样返回限流器，用于生成 RateLimit-* 响应头
+func (httpProxy *HTTPProxy) invaildToken(req *http.Request, api string) (ratelimit.RateLimiter, error) {
+	httpProxy.observe(api)
+	pattern, limiter := httpProxy.matchLimiter(api)
+	// 没有匹配的限流规则，不做限制
+	if limiter == nil {
+		return nil, nil
+	}
+	if keyed, ok := limiter.(*ratelimit.KeyedLimiter); ok {
+		limiter = keyed.Get(limiterKey(req, keyed.KeyBy, keyed.KeyName))
+	}
+	logger.Debugf("{invaildToken} method: %s matches rule: %s, limiter info: volumn: %d speed: %d", api, pattern, limiter.GetVolumn(), limiter.GetSpeed())
+	timeout := limiter.GetTimeout()
+
+	var err error
+	if queue, ok := limiter.(*ratelimit.QueueLimiter); ok {
+		// 按照请求头决定排队的通道
+		err = queue.TakeWithPriority(req.Context(), queue.Lane(req.Header.Get(queue.PriorityHeader)), timeout)
+	} else if timeout == 0 {
+		err = limiter.Take()
+	} else {
+		err = limiter.TakeWithTimeout(timeout)
+	}
+	return limiter, err
 }
 
 func (httpProxy *HTTPProxy) ChangeLb(mode string) error {
+	httpProxy.Lock()
+	defer httpProxy.Unlock()
+	// 不健康或者不处于 active 状态的主机不加入新的负载均衡器
 	hosts := make([]string, 0)
 	for k := range httpProxy.HostMap {
-		hosts = append(hosts, k)
+		if httpProxy.serviceable(k) {
+			hosts = append(hosts, k)
+		}
 	}
 	lb, err := balancer.Build(balancer.Algorithm(mode), hosts)
 	if err != nil {
@@ -0,0 +1,65 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/qiancijun/cheryl/auth"
+	"github.com/qiancijun/cheryl/filter"
+	"github.com/qiancijun/cheryl/utils"
+)
+
+/**
+*	限流器的客户端识别方式：
+*	ip: 客户端 ip
+*	header: 请求头，例如 X-API-Key
+*	jwt: jwt 过滤器校验通过的令牌中的某个 claim，没有经过校验的令牌不会被识别
+*	cookie: 某个 cookie 的值
+*	consumer: consumer-auth 过滤器认证的消费者
+ */
+const (
+	KEY_BY_IP       = "ip"
+	KEY_BY_HEADER   = "header"
+	KEY_BY_JWT      = "jwt"
+	KEY_BY_COOKIE   = "cookie"
+	KEY_BY_CONSUMER = "consumer"
+)
+
+var defaultKeyName = map[string]string{
+	KEY_BY_HEADER: "X-API-Key",
+	KEY_BY_JWT:    "sub",
+	KEY_BY_COOKIE: "session",
+}
+
+func validKeyBy(keyBy string) error {
+	switch keyBy {
+	case "", KEY_BY_IP, KEY_BY_HEADER, KEY_BY_JWT, KEY_BY_COOKIE, KEY_BY_CONSUMER:
+		return nil
+	}
+	return fmt.Errorf("limiter key %s not supported", keyBy)
+}
+
+// 返回请求对应的客户端标识，无法识别时返回空字符串
+func limiterKey(req *http.Request, keyBy string, keyName string) string {
+	if keyName == "" {
+		keyName = defaultKeyName[keyBy]
+	}
+	switch keyBy {
+	case KEY_BY_IP:
+		return utils.RemoteIp(req)
+	case KEY_BY_HEADER:
+		return req.Header.Get(keyName)
+	case KEY_BY_COOKIE:
+		cookie, err := req.Cookie(keyName)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	case KEY_BY_JWT:
+		claim, _ := filter.JWTClaim(req, keyName)
+		return claim
+	case KEY_BY_CONSUMER:
+		return auth.ConsumerOf(req)
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+package reverseproxy
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	lru "github.com/hashicorp/golang-lru"
+	ratelimit "github.com/qiancijun/cheryl/rate_limit"
+)
+
+// 每个反向代理最多记录的访问过的路径数量
+var MaxObservedPaths = 1000
+
+var InvalidLimiterPatternError = errors.New("invalid limiter path pattern")
+
+/**
+*	限流规则的路径模式，按照 / 分段匹配
+*	/users/list      精确匹配
+*	/users/:id       :id 或者 {id} 匹配任意一个分段
+*	/users/*.json    分段内支持 path.Match 的通配符
+*	/users/**        匹配剩余的所有分段，包括 /users 本身
+*	多个规则都能匹配时，精确匹配优先，其次是不以 /** 结尾、分段更多、字面分段更多的规则
+ */
+type limiterRule struct {
+	pattern  string
+	segments []string
+	exact    bool
+	tail     bool
+	literals int
+	limiter  ratelimit.RateLimiter
+}
+
+func newLimiterRule(pattern string, limiter ratelimit.RateLimiter) (*limiterRule, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, InvalidLimiterPatternError
+	}
+	rule := &limiterRule{
+		pattern: pattern,
+		exact:   true,
+		limiter: limiter,
+	}
+	segments := splitPath(pattern)
+	if len(segments) > 0 && segments[len(segments)-1] == "**" {
+		rule.tail, rule.exact = true, false
+		segments = segments[:len(segments)-1]
+	}
+	for idx, segment := range segments {
+		if strings.HasPrefix(segment, ":") || (strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")) {
+			segments[idx] = "*"
+			rule.exact = false
+			continue
+		}
+		if segment == "**" {
+			return nil, InvalidLimiterPatternError
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, InvalidLimiterPatternError
+		}
+		if strings.ContainsAny(segment, `*?[\`) {
+			rule.exact = false
+			continue
+		}
+		rule.literals++
+	}
+	rule.segments = segments
+	return rule, nil
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+func (rule *limiterRule) match(p string) bool {
+	if rule.exact {
+		return rule.pattern == p
+	}
+	segments := splitPath(p)
+	if len(segments) < len(rule.segments) || (!rule.tail && len(segments) != len(rule.segments)) {
+		return false
+	}
+	for idx, segment := range rule.segments {
+		if matched, _ := path.Match(segment, segments[idx]); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// 规则的优先级是否比 other 更高
+func (rule *limiterRule) before(other *limiterRule) bool {
+	if rule.exact != other.exact {
+		return rule.exact
+	}
+	if rule.tail != other.tail {
+		return !rule.tail
+	}
+	if len(rule.segments) != len(other.segments) {
+		return len(rule.segments) > len(other.segments)
+	}
+	if rule.literals != other.literals {
+		return rule.literals > other.literals
+	}
+	return rule.pattern < other.pattern
+}
+
+// 调用者需要持有锁，相同模式的规则会被替换
+func (httpProxy *HTTPProxy) addRule(rule *limiterRule) {
+	rules := make([]*limiterRule, 0, len(httpProxy.rules)+1)
+	for _, r := range httpProxy.rules {
+		if r.pattern != rule.pattern {
+			rules = append(rules, r)
+		}
+	}
+	rules = append(rules, rule)
+	sort.Slice(rules, func(i, j int) bool { return rules[i].before(rules[j]) })
+	httpProxy.rules = rules
+}
+
+// 返回匹配请求路径的规则和限流器，没有匹配的规则时不做限制
+func (httpProxy *HTTPProxy) matchLimiter(p string) (string, ratelimit.RateLimiter) {
+	httpProxy.RLock()
+	defer httpProxy.RUnlock()
+	for _, rule := range httpProxy.rules {
+		if rule.match(p) {
+			return rule.pattern, rule.limiter
+		}
+	}
+	return "", nil
+}
+
+/**
+*	访问过的路径，只用于在管理界面中选择需要限流的路径，
+*	数量由 LRU 限制，不会写入 raft 日志和快照
+ */
+type ObservedPath struct {
+	Path string `json:"path"`
+	Hits int64  `json:"hits"`
+	Rule string `json:"rule"`
+}
+
+func newObservedPaths() *lru.Cache {
+	cache, _ := lru.New(MaxObservedPaths)
+	return cache
+}
+
+func (httpProxy *HTTPProxy) observe(p string) {
+	if v, has := httpProxy.observed.Get(p); has {
+		atomic.AddInt64(v.(*int64), 1)
+		return
+	}
+	hits := int64(1)
+	httpProxy.observed.ContainsOrAdd(p, &hits)
+}
+
+// 按照访问次数从多到少返回访问过的路径以及匹配的规则
+func (httpProxy *HTTPProxy) ObservedPaths() []ObservedPath {
+	res := make([]ObservedPath, 0, httpProxy.observed.Len())
+	for _, key := range httpProxy.observed.Keys() {
+		v, has := httpProxy.observed.Peek(key)
+		if !has {
+			continue
+		}
+		p := key.(string)
+		rule, _ := httpProxy.matchLimiter(p)
+		res = append(res, ObservedPath{
+			Path: p,
+			Hits: atomic.LoadInt64(v.(*int64)),
+			Rule: rule,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Hits > res[j].Hits })
+	return res
+}
@@ -0,0 +1,126 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qiancijun/cheryl/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterRuleMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/users/list", "/users/list", true},
+		{"/users/list", "/users/list/1", false},
+		{"/users/:id", "/users/1", true},
+		{"/users/{id}/orders", "/users/1/orders", true},
+		{"/users/:id", "/users/1/orders", false},
+		{"/files/*.json", "/files/a.json", true},
+		{"/files/*.json", "/files/a.xml", false},
+		{"/files/**", "/files", true},
+		{"/files/**", "/files/a/b/c", true},
+		{"/**", "/anything/at/all", true},
+	}
+	for _, c := range cases {
+		rule, err := newLimiterRule(c.pattern, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, c.match, rule.match(c.path), fmt.Sprintf("%s %s", c.pattern, c.path))
+	}
+
+	for _, pattern := range []string{"users", "/a/**/b", "/a/[b"} {
+		_, err := newLimiterRule(pattern, nil)
+		assert.Equal(t, InvalidLimiterPatternError, err, pattern)
+	}
+}
+
+func TestLimiterRulePriority(t *testing.T) {
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/rules",
+		ProxyPass:   []string{"http://localhost:8080"},
+		BalanceMode: "round-robin",
+	})
+	assert.NoError(t, err)
+	defer m.Close()
+	httpProxy, _ := m.GetProxy("/rules")
+	for _, pattern := range []string{"/**", "/users/**", "/users/:id", "/users/me"} {
+		assert.NoError(t, httpProxy.SetRateLimiter(LimiterInfo{
+			PathName:    pattern,
+			LimiterType: "qps",
+			Volumn:      10,
+			Speed:       10,
+		}))
+	}
+	for path, expected := range map[string]string{
+		"/users/me":       "/users/me",
+		"/users/1":        "/users/:id",
+		"/users/1/orders": "/users/**",
+		"/orders":         "/**",
+	} {
+		rule, limiter := httpProxy.matchLimiter(path)
+		assert.Equal(t, expected, rule)
+		assert.NotNil(t, limiter)
+		// 管理接口查询到的限流器就是匹配时使用的限流器
+		assert.Same(t, limiter, httpProxy.GetLimiter(rule))
+	}
+	assert.Equal(t, []string{"/users/me", "/users/:id", "/users/**", "/**"}, httpProxy.GetMethods())
+
+	// 替换同一个路径模式的规则
+	assert.NoError(t, httpProxy.SetRateLimiter(LimiterInfo{
+		PathName:    "/users/:id",
+		LimiterType: "sliding-log",
+		Volumn:      10,
+	}))
+	_, limiter := httpProxy.matchLimiter("/users/1")
+	assert.Same(t, limiter, httpProxy.GetLimiter("/users/:id"))
+	assert.Equal(t, 4, len(httpProxy.Limiters()))
+	assert.Nil(t, httpProxy.GetLimiter("/unknown"))
+}
+
+func TestObservedPaths(t *testing.T) {
+	MaxObservedPaths = 10
+	defer func() { MaxObservedPaths = 1000 }()
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/scan",
+		ProxyPass:   []string{"http://localhost:8080"},
+		BalanceMode: "round-robin",
+	})
+	assert.NoError(t, err)
+	defer m.Close()
+	httpProxy, _ := m.GetProxy("/scan")
+	assert.NoError(t, httpProxy.SetRateLimiter(LimiterInfo{
+		PathName:    "/users/:id",
+		LimiterType: "qps",
+		Volumn:      10,
+		Speed:       10,
+	}))
+
+	// 没有匹配规则的路径不会创建限流器
+	for i := 0; i < 100; i++ {
+		limiter, err := httpProxy.invaildToken(httptest.NewRequest("GET", "/scan/random", nil), fmt.Sprintf("/random/%d", i))
+		assert.NoError(t, err)
+		assert.Nil(t, limiter)
+	}
+	limiter, err := httpProxy.invaildToken(httptest.NewRequest("GET", "/scan/users/1", nil), "/users/1")
+	assert.NoError(t, err)
+	assert.NotNil(t, limiter)
+
+	assert.Equal(t, 1, len(httpProxy.GetMethods()))
+	assert.Equal(t, 1, len(m.Limiters["/scan"]))
+	observed := httpProxy.ObservedPaths()
+	assert.Equal(t, 10, len(observed))
+	var found bool
+	for _, p := range observed {
+		if p.Path == "/users/1" {
+			found = true
+			assert.Equal(t, "/users/:id", p.Rule)
+		}
+	}
+	assert.True(t, found)
+}
@@ -4,17 +4,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"sync"
-	"time"
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/qiancijun/cheryl/acl"
 	"github.com/qiancijun/cheryl/balancer"
 	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/cors"
+	"github.com/qiancijun/cheryl/filter"
 	"github.com/qiancijun/cheryl/logger"
-	"github.com/qiancijun/cheryl/utils"
+	ratelimit "github.com/qiancijun/cheryl/rate_limit"
 )
 
 type ProxyMap struct {
@@ -22,7 +21,11 @@ type ProxyMap struct {
 	Relations map[string]*HTTPProxy `json:"-"`
 	Locations map[string]config.Location
 	Limiters  map[string][]LimiterInfo
-	Infos     Info
+	// pattern -> host -> 主机状态，只记录不处于 active 状态的主机
+	HostStates map[string]map[string]string
+	// 全局过滤器链的配置
+	GlobalFilters []config.FilterConfig
+	Infos         Info
 }
 
 type Info struct {
@@ -30,13 +33,21 @@ type Info struct {
 }
 
 type LimiterInfo struct {
-	Prefix      string `json:"prefix"`
-	PathName    string `json:"pathName"`
-	LimiterType string `json:"limiterType"`
-	Volumn      int    `json:"volumn"`    // 容量
-	Speed       int64  `json:"speed"`     // 速率
-	MaxThread   int    `json:"maxThread"` // 最大并发数量
-	Duration    int    `json:"duration"`  // 超时时间
+	Prefix         string   `json:"prefix"`
+	PathName       string   `json:"pathName"`
+	LimiterType    string   `json:"limiterType"`
+	Volumn         int      `json:"volumn"`         // 容量
+	Speed          int64    `json:"speed"`          // 速率
+	MaxThread      int      `json:"maxThread"`      // 最大并发数量
+	Duration       int      `json:"duration"`       // 超时时间
+	Window         int      `json:"window"`         // 窗口长度（毫秒）
+	KeyBy          string   `json:"keyBy"`          // 按客户端限流的识别方式，为空时整个接口共享
+	KeyName        string   `json:"keyName"`        // 请求头、claim 或者 cookie 的名称
+	MaxKeys        int      `json:"maxKeys"`        // 最多记录的客户端数量
+	IdleTimeout    int      `json:"idleTimeout"`    // 客户端空闲多久之后淘汰（毫秒）
+	Global         bool     `json:"global"`         // 集群共享配额，只支持 qps 限流器
+	PriorityHeader string   `json:"priorityHeader"` // 排队限流器决定优先级的请求头
+	Lanes          []string `json:"lanes"`          // 请求头的取值，按照优先级从高到低排列
 }
 
 func NewProxyMap() *ProxyMap {
@@ -49,7 +60,8 @@ func NewProxyMap() *ProxyMap {
 		Infos: Info{
 			RouterType: "default",
 		},
-		Limiters: make(map[string][]LimiterInfo),
+		Limiters:   make(map[string][]LimiterInfo),
+		HostStates: make(map[string]map[string]string),
 	}
 }
 
@@ -67,87 +79,136 @@ func (proxyMap *ProxyMap) UnMarshal(serialized io.ReadCloser) error {
 	return nil
 }
 
+func (proxyMap *ProxyMap) GetProxy(pattern string) (*HTTPProxy, bool) {
+	proxyMap.RLock()
+	defer proxyMap.RUnlock()
+	httpProxy, has := proxyMap.Relations[pattern]
+	return httpProxy, has
+}
+
+// 返回所有反向代理的快照，用于遍历时不持有锁
+func (proxyMap *ProxyMap) Proxies() map[string]*HTTPProxy {
+	proxyMap.RLock()
+	defer proxyMap.RUnlock()
+	res := make(map[string]*HTTPProxy, len(proxyMap.Relations))
+	for k, v := range proxyMap.Relations {
+		res[k] = v
+	}
+	return res
+}
+
+// 调用者需要持有写锁
 func (proxyMap *ProxyMap) AddRelations(pattern string, proxy *HTTPProxy, location config.Location) {
 	proxy.ProxyMap = proxyMap
+	proxy.setLocation(location)
+	if old, has := proxyMap.Relations[pattern]; has {
+		old.Close()
+	}
 	proxyMap.Relations[pattern] = proxy
-	proxy.ProxyMap.Locations[pattern] = location
+	proxyMap.Locations[pattern] = location
 	RouterSingleton.Add(pattern, proxy)
 	proxy.HealthCheck()
 }
 
 func (proxyMap *ProxyMap) AddProxyWithLocation(l config.Location) error {
+	if _, err := acl.NewAccessList(l.Acl); err != nil {
+		logger.Warnf("invaild acl of location %s: %s", l.Pattern, err.Error())
+		return err
+	}
+	if _, err := filter.NewFilterChain(l.Filters); err != nil {
+		logger.Warnf("invaild filters of location %s: %s", l.Pattern, err.Error())
+		return err
+	}
+	if _, err := cors.NewPolicy(l.Cors); err != nil {
+		logger.Warnf("invaild cors of location %s: %s", l.Pattern, err.Error())
+		return err
+	}
 	httpProxy, err := NewHTTPProxy(l.Pattern, l.ProxyPass, balancer.Algorithm(l.BalanceMode))
 	if err != nil {
 		logger.Warnf("create proxy error: %s", err.Error())
 		return err
 	}
+	proxyMap.Lock()
+	defer proxyMap.Unlock()
 	proxyMap.AddRelations(l.Pattern, httpProxy, l)
 	return nil
 }
 
 func (proxyMap *ProxyMap) AddProxy(pattern string, host string) error {
-	proxyMap.printAllRelationKey()
 	logger.Debugf("{AddHost} pattern: %s, host: %s will create proxy", pattern, host)
-	httpProxy := proxyMap.Relations[pattern]
-	if httpProxy == nil {
+	httpProxy, has := proxyMap.GetProxy(pattern)
+	if !has {
 		return errors.New("pattern is not exists, please use config or webui first")
 	}
-	url, err := url.Parse(host)
-	if err != nil {
-		return err
-	}
-	logger.Debugf("%s will add to %s", url, pattern)
-	proxy := httputil.NewSingleHostReverseProxy(url)
-	originDirector := proxy.Director
-	proxy.Director = func(r *http.Request) {
-		originDirector(r)
-		r.Header.Set(XProxy, ReverseProxy)
-		r.Header.Set(XRealIP, utils.GetIP(r.RemoteAddr))
-	}
-	host = utils.GetHost(url)
-	httpProxy.HostMap[host] = proxy
-	httpProxy.Alive[host] = true
-	httpProxy.HostsShutDown[host] = make(chan bool)
-	httpProxy.Lb.Add(host)
-	go httpProxy.healthCheck(host)
-	return nil
+	logger.Debugf("%s will add to %s", host, pattern)
+	return httpProxy.AddHost(host)
 }
 
 func (proxyMap *ProxyMap) RemoveProxy(pattern string) error {
 	proxyMap.Lock()
 	defer proxyMap.Unlock()
-	if _, has := proxyMap.Relations[pattern]; !has {
+	httpProxy, has := proxyMap.Relations[pattern]
+	if !has {
 		return fmt.Errorf("can't find the reverseproxy with the pattern %s", pattern)
 	}
 	logger.Debugf("%s will remove from proxyMap", pattern)
-	// TODO 超时控制
-	proxyMap.Relations[pattern].ShutDown <- true
+	httpProxy.Close()
 	RouterSingleton.Remove(pattern)
 	delete(proxyMap.Relations, pattern)
 	delete(proxyMap.Locations, pattern)
+	delete(proxyMap.Limiters, pattern)
+	delete(proxyMap.HostStates, pattern)
 	return nil
 }
 
 func (proxyMap *ProxyMap) RemoveHost(pattern string, host string) error {
 	logger.Debugf("%s will remove from the %s", host, pattern)
-	httpProxy, has := proxyMap.Relations[pattern]
-	for k := range httpProxy.HostsShutDown {
-		logger.Debug(k)
-	}
+	httpProxy, has := proxyMap.GetProxy(pattern)
 	if !has {
 		return fmt.Errorf("can't find the reverseproxy with the pattern %s", pattern)
 	}
-	select {
-	case <-time.After(5 * time.Second):
-		return errors.New("shut down reverproxy timeout")
-	case httpProxy.HostsShutDown[host] <- true:
-		delete(httpProxy.HostMap, host)
-		return nil
+	if err := httpProxy.RemoveHost(host); err != nil {
+		return err
+	}
+	proxyMap.Lock()
+	defer proxyMap.Unlock()
+	delete(proxyMap.HostStates[pattern], host)
+	return nil
+}
+
+// 关闭所有的反向代理，用于从快照恢复之前
+func (proxyMap *ProxyMap) Close() {
+	proxyMap.Lock()
+	defer proxyMap.Unlock()
+	for pattern, httpProxy := range proxyMap.Relations {
+		httpProxy.Close()
+		RouterSingleton.Remove(pattern)
+	}
+}
+
+// 记录限流器的配置，同一个接口只保留最新的一份
+func (proxyMap *ProxyMap) recordLimiter(pattern string, info LimiterInfo) {
+	proxyMap.Lock()
+	defer proxyMap.Unlock()
+	limiters := proxyMap.Limiters[pattern]
+	for i, l := range limiters {
+		if l.PathName == info.PathName {
+			limiters[i] = info
+			return
+		}
 	}
+	proxyMap.Limiters[pattern] = append(limiters, info)
 }
 
-func (proxyMap *ProxyMap) printAllRelationKey() {
-	for k := range proxyMap.Relations {
-		logger.Debug(k)
+// 返回所有集群全局限流器，键为 pattern + path
+func (proxyMap *ProxyMap) GlobalLimiters() map[string]*ratelimit.GlobalLimiter {
+	res := make(map[string]*ratelimit.GlobalLimiter)
+	for pattern, httpProxy := range proxyMap.Proxies() {
+		for path, limiter := range httpProxy.Limiters() {
+			if global, ok := limiter.(*ratelimit.GlobalLimiter); ok {
+				res[pattern+path] = global
+			}
+		}
 	}
+	return res
 }
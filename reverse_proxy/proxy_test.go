@@ -1,7 +1,12 @@
 package reverseproxy
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/qiancijun/cheryl/config"
 	"github.com/stretchr/testify/assert"
@@ -44,4 +49,144 @@ func TestRemoveProxy(t *testing.T) {
 	assert.NoError(t, err)
 	api := m.Relations["api"]
 	assert.Nil(t, api)
-}
\ No newline at end of file
+}
+func TestConcurrentAdminAndTraffic(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	backend2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend2.Close()
+
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/race",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+	})
+	assert.NoError(t, err)
+	httpProxy, has := m.GetProxy("/race")
+	assert.True(t, has)
+	host2 := strings.TrimPrefix(backend2.URL, "http://")
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	// 流量
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req := httptest.NewRequest("GET", "/race/hello", nil)
+				w := httptest.NewRecorder()
+				RouterSingleton.ServeHTTP(w, req)
+			}
+		}()
+	}
+	// 健康检查
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			httpProxy.checkOnce(host2)
+		}
+	}()
+
+	// 管理操作不应该阻塞
+	for i := 0; i < 50; i++ {
+		start := time.Now()
+		assert.NoError(t, m.AddProxy("/race", backend2.URL))
+		assert.NoError(t, m.RemoveHost("/race", host2))
+		assert.NoError(t, httpProxy.ChangeLb("round-robin"))
+		_, err := m.Marshal()
+		assert.NoError(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+	}
+	close(stop)
+	wg.Wait()
+
+	assert.Equal(t, 1, len(httpProxy.Hosts()))
+	assert.Equal(t, 1, httpProxy.GetLb().Len())
+	// 移除的主机不再保留健康检查的结果
+	alive, checkedBy := httpProxy.ReadHealth(host2)
+	assert.False(t, alive)
+	assert.Empty(t, checkedBy)
+	assert.NoError(t, m.RemoveProxy("/race"))
+	assert.Error(t, httpProxy.AddHost(backend2.URL))
+}
+
+func TestConcurrentRateLimiter(t *testing.T) {
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/concurrent",
+		ProxyPass:   []string{"http://localhost:8080"},
+		BalanceMode: "round-robin",
+	})
+	assert.NoError(t, err)
+	httpProxy, _ := m.GetProxy("/concurrent")
+	err = httpProxy.SetRateLimiter(LimiterInfo{
+		Prefix:      "/concurrent",
+		PathName:    "/hello",
+		LimiterType: "concurrent",
+		MaxThread:   1,
+		Duration:    50,
+	})
+	assert.NoError(t, err)
+	limiter := httpProxy.GetLimiter("/hello")
+	assert.Equal(t, 1, limiter.GetVolumn())
+	assert.Equal(t, 50*time.Millisecond, limiter.GetTimeout())
+
+	taken, err := httpProxy.invaildToken(httptest.NewRequest("GET", "/concurrent/hello", nil), "/hello")
+	assert.NoError(t, err)
+	_, err = httpProxy.invaildToken(httptest.NewRequest("GET", "/concurrent/hello", nil), "/hello")
+	assert.Error(t, err)
+	taken.Done()
+	taken, err = httpProxy.invaildToken(httptest.NewRequest("GET", "/concurrent/hello", nil), "/hello")
+	assert.NoError(t, err)
+	taken.Done()
+	assert.Equal(t, 1, len(m.Limiters["/concurrent"]))
+}
+
+func TestGlobalRateLimiter(t *testing.T) {
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/global",
+		ProxyPass:   []string{"http://localhost:8080"},
+		BalanceMode: "round-robin",
+	})
+	assert.NoError(t, err)
+	httpProxy, _ := m.GetProxy("/global")
+	assert.Error(t, httpProxy.SetRateLimiter(LimiterInfo{
+		PathName:    "/hello",
+		LimiterType: "concurrent",
+		Global:      true,
+	}))
+	assert.NoError(t, httpProxy.SetRateLimiter(LimiterInfo{
+		PathName:    "/hello",
+		LimiterType: "qps",
+		Volumn:      10,
+		Speed:       10,
+		Global:      true,
+	}))
+	assert.NoError(t, httpProxy.SetRateLimiter(LimiterInfo{
+		PathName:    "/index",
+		LimiterType: "qps",
+		Volumn:      10,
+		Speed:       10,
+	}))
+	limiters := m.GlobalLimiters()
+	assert.Equal(t, 1, len(limiters))
+	assert.NotNil(t, limiters["/global/hello"])
+}
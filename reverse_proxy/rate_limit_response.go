@@ -0,0 +1,97 @@
+package reverseproxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/qiancijun/cheryl/auth"
+	"github.com/qiancijun/cheryl/quota"
+	ratelimit "github.com/qiancijun/cheryl/rate_limit"
+)
+
+const (
+	RetryAfter         string = "Retry-After"
+	RateLimitLimit     string = "RateLimit-Limit"
+	RateLimitRemaining string = "RateLimit-Remaining"
+	RateLimitReset     string = "RateLimit-Reset"
+	QuotaReset         string = "X-Quota-Reset"
+
+	defaultRejectBody        = "too many requests"
+	defaultRejectContentType = "text/plain; charset=utf-8"
+)
+
+// 按照 RateLimit 头部草案设置响应头，限流器没有限制时不设置，返回配额恢复的时间
+func setRateLimitHeaders(header http.Header, limiter ratelimit.RateLimiter) (time.Duration, bool) {
+	reporter, ok := limiter.(ratelimit.QuotaReporter)
+	if !ok {
+		return 0, false
+	}
+	limit, remaining, reset := reporter.Quota()
+	if limit < 0 {
+		return 0, false
+	}
+	header.Set(RateLimitLimit, strconv.Itoa(limit))
+	header.Set(RateLimitRemaining, strconv.Itoa(remaining))
+	header.Set(RateLimitReset, strconv.Itoa(seconds(reset)))
+	return reset, true
+}
+
+// 限流拒绝的请求返回 429，响应体和类型可以在 location 中配置
+func (httpProxy *HTTPProxy) rejectRequest(w http.ResponseWriter, limiter ratelimit.RateLimiter) {
+	location := httpProxy.GetLocation()
+	header := w.Header()
+	// 无法预估恢复时间时，建议客户端一秒之后重试
+	retry := 1
+	if reset, ok := setRateLimitHeaders(header, limiter); ok && reset > 0 {
+		retry = seconds(reset)
+	}
+	header.Set(RetryAfter, strconv.Itoa(retry))
+
+	body, contentType := location.RejectBody, location.RejectContentType
+	if body == "" {
+		body = defaultRejectBody
+	}
+	if contentType == "" {
+		contentType = defaultRejectContentType
+	}
+	header.Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(body))
+}
+
+/**
+*	计入配额的消费者：consumer-auth 过滤器认证的消费者，
+*	或者 quota_header 中的 API Key 属于某个注册的消费者。
+*	请求头中的其他取值无法证明身份，不计入任何消费者的配额
+ */
+func quotaConsumer(req *http.Request) string {
+	if consumer := auth.ConsumerOf(req); consumer != "" {
+		return consumer
+	}
+	if c, ok := auth.Consumers.AuthenticateKey(req.Header.Get(quota.Quotas.KeyHeader)); ok {
+		return c.Name
+	}
+	return ""
+}
+
+// 消费者的配额用尽时返回 429，并且告知配额恢复的时间
+func (httpProxy *HTTPProxy) rejectQuota(w http.ResponseWriter, reset time.Time) {
+	header := w.Header()
+	retry := seconds(time.Until(reset))
+	header.Set(RetryAfter, strconv.Itoa(retry))
+	header.Set(RateLimitReset, strconv.Itoa(retry))
+	header.Set(QuotaReset, reset.UTC().Format(http.TimeFormat))
+	header.Set("Content-Type", defaultRejectContentType)
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(quota.QuotaExceededError.Error()))
+}
+
+// 向上取整的秒数
+func seconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
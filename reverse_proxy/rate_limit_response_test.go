@@ -0,0 +1,252 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qiancijun/cheryl/auth"
+	"github.com/qiancijun/cheryl/config"
+	"github.com/qiancijun/cheryl/quota"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:           "/limited",
+		ProxyPass:         []string{backend.URL},
+		BalanceMode:       "round-robin",
+		RateLimitHeaders:  true,
+		RejectBody:        `{"code":429}`,
+		RejectContentType: "application/json",
+	})
+	assert.NoError(t, err)
+	defer m.Close()
+	httpProxy, _ := m.GetProxy("/limited")
+	assert.NoError(t, httpProxy.SetRateLimiter(LimiterInfo{
+		PathName:    "/hello",
+		LimiterType: "sliding-log",
+		Volumn:      1,
+		Window:      60000,
+	}))
+
+	w := httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, httptest.NewRequest("GET", "/limited/hello", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get(RateLimitLimit))
+	assert.Equal(t, "0", w.Header().Get(RateLimitRemaining))
+
+	w = httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, httptest.NewRequest("GET", "/limited/hello", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"code":429}`, w.Body.String())
+	assert.Equal(t, "60", w.Header().Get(RetryAfter))
+	assert.Equal(t, "60", w.Header().Get(RateLimitReset))
+}
+
+func TestAdaptiveLimiterShed(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/adaptive",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+	})
+	assert.NoError(t, err)
+	defer m.Close()
+	httpProxy, _ := m.GetProxy("/adaptive")
+	assert.NoError(t, httpProxy.SetRateLimiter(LimiterInfo{
+		PathName:    "/hello",
+		LimiterType: "adaptive",
+		Volumn:      1,
+		MaxThread:   1,
+	}))
+
+	w := httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, httptest.NewRequest("GET", "/adaptive/hello", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 占满并发数量之后的请求被拒绝
+	limiter := httpProxy.GetLimiter("/hello")
+	assert.NoError(t, limiter.Take())
+	w = httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, httptest.NewRequest("GET", "/adaptive/hello", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	limiter.Done()
+}
+
+func TestLocationAdaptiveLimiter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/location-adaptive",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+		Adaptive:    config.Adaptive{Limit: 1, MaxLimit: 1},
+	})
+	assert.NoError(t, err)
+	defer m.Close()
+	httpProxy, _ := m.GetProxy("/location-adaptive")
+	adaptive := httpProxy.GetAdaptive()
+	assert.NotNil(t, adaptive)
+
+	// 没有配置限流规则的路径同样受 location 的并发数量限制
+	w := httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, httptest.NewRequest("GET", "/location-adaptive/any", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, adaptive.Inflight())
+	assert.Greater(t, adaptive.MinRTT(), time.Duration(0))
+
+	assert.NoError(t, adaptive.Take())
+	w = httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, httptest.NewRequest("GET", "/location-adaptive/other", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	adaptive.Done()
+
+	// 配置没有变化时保留调整过的限流器
+	httpProxy.setLocation(httpProxy.GetLocation())
+	assert.Same(t, adaptive, httpProxy.GetAdaptive())
+
+	// location 已经开启自适应并发限流时不能再添加自适应限流规则
+	assert.Error(t, httpProxy.SetRateLimiter(LimiterInfo{
+		PathName:    "/hello",
+		LimiterType: "adaptive",
+		Volumn:      1,
+		MaxThread:   1,
+	}))
+}
+
+func TestAdaptiveIgnoresFailedRoundTrips(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	m := NewProxyMap()
+	defer m.Close()
+	for pattern, backend := range map[string]string{"/failing": failing.URL, "/refused": closed.URL} {
+		assert.NoError(t, m.AddProxyWithLocation(config.Location{
+			Pattern:     pattern,
+			ProxyPass:   []string{backend},
+			BalanceMode: "round-robin",
+			Adaptive:    config.Adaptive{Limit: 10, MaxLimit: 10},
+		}))
+	}
+
+	// 上游返回 5xx 或者连接失败时不更新响应时间
+	for pattern, code := range map[string]int{"/failing": http.StatusInternalServerError, "/refused": http.StatusBadGateway} {
+		w := httptest.NewRecorder()
+		RouterSingleton.ServeHTTP(w, httptest.NewRequest("GET", pattern+"/hello", nil))
+		assert.Equal(t, code, w.Code, pattern)
+		httpProxy, _ := m.GetProxy(pattern)
+		assert.Equal(t, time.Duration(0), httpProxy.GetAdaptive().MinRTT(), pattern)
+		assert.Equal(t, 0, httpProxy.GetAdaptive().Inflight(), pattern)
+	}
+}
+
+func TestQuotaResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/quota",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+	})
+	assert.NoError(t, err)
+	defer m.Close()
+	assert.NoError(t, quota.Quotas.SetAllowance("quota-test", quota.DAILY, 1))
+	defer quota.Quotas.SetAllowance("quota-test", quota.DAILY, 0)
+	assert.NoError(t, auth.Consumers.Set(auth.Consumer{Name: "quota-test", Keys: []string{auth.HashKey("quota-key")}}))
+	defer auth.Consumers.Remove("quota-test")
+
+	request := func(key string) *http.Request {
+		req := httptest.NewRequest("GET", "/quota/hello", nil)
+		req.Header.Set(quota.DefaultKeyHeader, key)
+		return req
+	}
+	w := httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, request("quota-key"))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, request("quota-key"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get(RetryAfter))
+	_, err = http.ParseTime(w.Header().Get(QuotaReset))
+	assert.NoError(t, err)
+
+	// 请求头中的消费者名称或者未注册的 API Key 不计入配额
+	w = httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, request("quota-test"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", quotaConsumer(request("unknown-key")))
+
+	// 通过认证的消费者
+	req := auth.WithConsumer(httptest.NewRequest("GET", "/quota/hello", nil), "quota-test")
+	assert.Equal(t, "quota-test", quotaConsumer(req))
+}
+
+func TestQuotaNotChargedWithoutHost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := NewProxyMap()
+	err := m.AddProxyWithLocation(config.Location{
+		Pattern:     "/quota-down",
+		ProxyPass:   []string{backend.URL},
+		BalanceMode: "round-robin",
+	})
+	assert.NoError(t, err)
+	defer m.Close()
+	assert.NoError(t, quota.Quotas.SetAllowance("quota-down", quota.DAILY, 10))
+	defer quota.Quotas.SetAllowance("quota-down", quota.DAILY, 0)
+	assert.NoError(t, auth.Consumers.Set(auth.Consumer{Name: "quota-down", Keys: []string{auth.HashKey("quota-down-key")}}))
+	defer auth.Consumers.Remove("quota-down")
+	used := func() int64 {
+		return quota.Quotas.Usage("quota-down")[0].Used
+	}
+	before := used()
+
+	// 上游不可用时返回 502，不消耗配额
+	host := strings.TrimPrefix(backend.URL, "http://")
+	assert.NoError(t, m.SetHostState("/quota-down", host, HOST_MAINTENANCE))
+	req := httptest.NewRequest("GET", "/quota-down/hello", nil)
+	req.Header.Set(quota.DefaultKeyHeader, "quota-down-key")
+	w := httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, before, used())
+
+	assert.NoError(t, m.SetHostState("/quota-down", host, HOST_ACTIVE))
+	req = httptest.NewRequest("GET", "/quota-down/hello", nil)
+	req.Header.Set(quota.DefaultKeyHeader, "quota-down-key")
+	w = httptest.NewRecorder()
+	RouterSingleton.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, before+1, used())
+}
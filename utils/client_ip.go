@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type clientIPKey struct{}
+
+var (
+	trustedMu      sync.RWMutex
+	trustedProxies []*net.IPNet
+)
+
+// 设置可信的代理，没有掩码的地址视为单个主机
+func SetTrustedProxies(cidrs []string) error {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		ipNet, err := ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, ipNet)
+	}
+	trustedMu.Lock()
+	defer trustedMu.Unlock()
+	trustedProxies = nets
+	return nil
+}
+
+func ParseCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := ParseIP(cidr)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "CIDR address", Text: cidr}
+		}
+		bits := 128
+		if ip.To4() != nil && !strings.Contains(cidr, ":") {
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	return ipNet, err
+}
+
+func IsTrustedProxy(ip net.IP) bool {
+	trustedMu.RLock()
+	defer trustedMu.RUnlock()
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func HasTrustedProxies() bool {
+	trustedMu.RLock()
+	defer trustedMu.RUnlock()
+	return len(trustedProxies) > 0
+}
+
+/**
+*	解析客户端的真实地址：连接的对端是可信代理时，从右向左遍历 Forwarded 或者 X-Forwarded-For，
+*	跳过可信代理，第一个不可信的地址就是客户端。所有的地址都可信时取最左边的地址，
+*	遇到无法解析的地址时取它右边的地址
+ */
+func ClientIP(req *http.Request) string {
+	peer := ParseIP(req.RemoteAddr)
+	if peer == nil {
+		return GetIP(req.RemoteAddr)
+	}
+	if !IsTrustedProxy(peer) {
+		return peer.String()
+	}
+	client := peer
+	hops := forwardedFor(req.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := ParseIP(hops[i])
+		if hop == nil {
+			break
+		}
+		client = hop
+		if !IsTrustedProxy(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// Forwarded 优先于 X-Forwarded-For，返回的地址按照经过的顺序排列
+func forwardedFor(header http.Header) []string {
+	hops := make([]string, 0)
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+					if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+						hops = append(hops, strings.Trim(kv[1], `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// 在请求中记录解析出的客户端地址，之后的 RemoteIp 都返回同一个地址
+func WithClientIP(req *http.Request) *http.Request {
+	if _, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), clientIPKey{}, ClientIP(req)))
+}
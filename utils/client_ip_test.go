@@ -0,0 +1,125 @@
+package utils_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"testing"
+
+	. "github.com/qiancijun/cheryl/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	assert.Nil(t, SetTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}))
+	defer SetTrustedProxies(nil)
+	cases := []struct {
+		name   string
+		remote string
+		header map[string]string
+		expect string
+	}{
+		{"untrusted-peer", "1.2.3.4:80", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "1.2.3.4"},
+		{"single-hop", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		{"spoofed", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.2"}, "5.6.7.8"},
+		{"all-trusted", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "192.168.1.1, 10.0.0.2"}, "192.168.1.1"},
+		{"garbage", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"no-header", "192.168.1.1:80", nil, "192.168.1.1"},
+		{"forwarded", "[fd00::1]:80", map[string]string{
+			"Forwarded":       `for="[2001:db8::1]:4711";proto=https, for=10.0.0.3`,
+			"X-Forwarded-For": "9.9.9.9",
+		}, "2001:db8::1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = c.remote
+			for k, v := range c.header {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, c.expect, ClientIP(req))
+			assert.Equal(t, c.expect, RemoteIp(WithClientIP(req)))
+		})
+	}
+	assert.NotNil(t, SetTrustedProxies([]string{"10.0.0.0/33"}))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, payload []byte) []byte {
+		buf := bytes.NewBufferString("\r\n\r\n\x00\r\nQUIT\n")
+		buf.Write([]byte{0x20 | command, family})
+		binary.Write(buf, binary.BigEndian, uint16(len(payload)))
+		buf.Write(payload)
+		return buf.Bytes()
+	}
+	v4 := append(append(net.ParseIP("1.2.3.4").To4(), net.ParseIP("5.6.7.8").To4()...), 0x1f, 0x90, 0x01, 0xbb)
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x1f, 0x90, 0x01, 0xbb)
+	cases := []struct {
+		name   string
+		header []byte
+		expect string
+		err    bool
+	}{
+		{"v1-tcp4", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 8080 443\r\nGET"), "1.2.3.4:8080", false},
+		{"v1-tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 8080 443\r\nGET"), "[2001:db8::1]:8080", false},
+		{"v1-unknown", []byte("PROXY UNKNOWN\r\nGET"), "", false},
+		{"v1-invalid", []byte("PROXY TCP4 1.2.3.4\r\nGET"), "", true},
+		{"v2-tcp4", append(v2(1, 0x11, v4), "GET"...), "1.2.3.4:8080", false},
+		{"v2-tcp6", append(v2(1, 0x21, v6), "GET"...), "[2001:db8::1]:8080", false},
+		{"v2-local", append(v2(0, 0x00, nil), "GET"...), "", false},
+		{"no-header", []byte("GET / HTTP/1.1\r\n"), "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(c.header))
+			addr, err := ReadProxyHeader(r)
+			if c.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			if c.expect == "" {
+				assert.Nil(t, addr)
+			} else {
+				assert.Equal(t, c.expect, addr.String())
+			}
+			rest, _ := r.ReadString(0)
+			assert.Equal(t, "GET", rest)
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	l = NewProxyProtocolListener(l)
+	defer l.Close()
+
+	send := func(data string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.Write([]byte(data))
+		return l.Accept()
+	}
+
+	conn, err := send("PROXY TCP4 1.2.3.4 5.6.7.8 8080 443\r\nhello")
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.4:8080", conn.RemoteAddr().String())
+	buf := make([]byte, 5)
+	n, _ := conn.Read(buf)
+	assert.Equal(t, "hello", string(buf[:n]))
+	conn.Close()
+
+	// 对端不是可信代理时忽略头部中的地址
+	assert.Nil(t, SetTrustedProxies([]string{"10.0.0.0/8"}))
+	defer SetTrustedProxies(nil)
+	conn, err = send("PROXY TCP4 1.2.3.4 5.6.7.8 8080 443\r\nhello")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", GetIP(conn.RemoteAddr().String()))
+	conn.Close()
+}
@@ -37,7 +37,7 @@ func IsBackendAlive(host string) bool {
 	if err != nil {
 		return false
 	}
-	resolve := fmt.Sprintf("%s:%d", addr.IP, addr.Port)
+	resolve := net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
 	conn, err := net.DialTimeout("tcp", resolve, ConnectionTimeout)
 	if err != nil {
 		return false
@@ -49,62 +49,32 @@ func IsBackendAlive(host string) bool {
 func GetOutBoundIP()(ip string, err error)  {
     conn, err := net.Dial("udp", "8.8.8.8:53")
     if err != nil {
-        fmt.Println(err)
+        logger.Warnf("can't get outbound ip: %s", err.Error())
         return
     }
     localAddr := conn.LocalAddr().(*net.UDPAddr)
-    // fmt.Println(localAddr.String())
     ip = strings.Split(localAddr.String(), ":")[0]
     return
 }
 
-func InetToi(ip string) (uint32, error) {
-	ipSegs := strings.Split(ip, ".")
-	var ret uint32 = 0
-	pos := 24
-	for _, ipSeg := range ipSegs {
-		tempInt, err := strconv.Atoi(ipSeg)
-		if err != nil {
-			logger.Warnf("{inetToi} can't convert ip address: %s", err.Error())
-			return 0, err
-		}
-		tempInt <<= pos
-		ret |= uint32(tempInt)
-		pos -= 8
+// 解析可能带有端口、方括号或者 zone 的 ip 地址，例如 [fe80::1%eth0]:8080
+func ParseIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
 	}
-	return ret, nil
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if idx := strings.IndexByte(addr, '%'); idx >= 0 {
+		addr = addr[:idx]
+	}
+	return net.ParseIP(addr)
 }
 
+// 客户端的真实地址，同一个请求只解析一次，见 ClientIP
 func RemoteIp(req *http.Request) string {
-	var remoteAddr string
-	// RemoteAddr
-	remoteAddr = req.RemoteAddr
-	if remoteAddr != "" {
-		return remoteAddr
-	}
-	// ipv4
-	remoteAddr = req.Header.Get("ipv4")
-	if remoteAddr != "" {
-		return remoteAddr
-	}
-	//
-	remoteAddr = req.Header.Get("XForwardedFor")
-	if remoteAddr != "" {
-		return remoteAddr
-	}
-	// X-Forwarded-For
-	remoteAddr = req.Header.Get("X-Forwarded-For")
-	if remoteAddr != "" {
-		return remoteAddr
-	}
-	// X-Real-Ip
-	remoteAddr = req.Header.Get("X-Real-Ip")
-	if remoteAddr != "" {
-		return remoteAddr
-	} else {
-		remoteAddr = "127.0.0.1"
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
 	}
-	return remoteAddr
+	return ClientIP(req)
 }
 
 func ValidIPAddress(queryIP string) string {
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// 读取 PROXY 协议头部的超时时间
+	ProxyHeaderTimeout = 5 * time.Second
+
+	InvalidProxyHeaderError = errors.New("invalid PROXY protocol header")
+
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const proxyV1MaxLength = 107
+
+/**
+*	接收 PROXY 协议（v1 与 v2）的监听器，连接的地址替换为头部中的源地址
+*	配置了可信代理时，只接受来自可信代理的头部，其余连接仍然使用对端的地址
+ */
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func NewProxyProtocolListener(l net.Listener) net.Listener {
+	return &proxyProtocolListener{l}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+// 头部在第一次读取或者获取地址时解析，不会阻塞 Accept
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+		remote, err := ReadProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		c.remote = c.Conn.RemoteAddr()
+		if err != nil {
+			c.err = err
+			return
+		}
+		if remote == nil {
+			return
+		}
+		if peer := ParseIP(c.remote.String()); HasTrustedProxies() && (peer == nil || !IsTrustedProxy(peer)) {
+			return
+		}
+		c.remote = remote
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+/**
+*	读取 PROXY 协议头部，返回客户端的地址
+*	UNKNOWN（v1）或者 LOCAL（v2）的连接没有客户端地址，返回 nil
+ */
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	signature, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	return nil, InvalidProxyHeaderError
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, InvalidProxyHeaderError
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, InvalidProxyHeaderError
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, InvalidProxyHeaderError
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, InvalidProxyHeaderError
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, InvalidProxyHeaderError
+	}
+	command, family := header[12]&0x0f, header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL：代理自身发起的连接，例如健康检查
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, InvalidProxyHeaderError
+	}
+	switch family >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, InvalidProxyHeaderError
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, InvalidProxyHeaderError
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// UNSPEC 或者 unix socket，忽略地址
+	return nil, nil
+}